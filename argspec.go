@@ -0,0 +1,256 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ArgType is the type of the values of an argument declared with an
+// ArgSpec.
+type ArgType int
+
+const (
+	// StringArg accepts any value.
+	StringArg ArgType = iota
+	// IntArg accepts integers.
+	IntArg
+	// UintArg accepts non-negative integers.
+	UintArg
+	// FloatArg accepts floating-point numbers.
+	FloatArg
+	// BoolArg accepts booleans. A bare key, without a value, means true.
+	BoolArg
+	// DurationArg accepts durations, as parsed by time.ParseDuration.
+	DurationArg
+	// TimeArg accepts RFC 3339 timestamps.
+	TimeArg
+	// ByteSizeArg accepts non-negative integers and byte sizes, e.g. 64KiB.
+	ByteSizeArg
+)
+
+func (typ ArgType) String() string {
+	switch typ {
+	case StringArg:
+		return "string"
+	case IntArg:
+		return "int"
+	case UintArg:
+		return "uint"
+	case FloatArg:
+		return "float"
+	case BoolArg:
+		return "bool"
+	case DurationArg:
+		return "duration"
+	case TimeArg:
+		return "time"
+	case ByteSizeArg:
+		return "size"
+	default:
+		return "ArgType(" + strconv.Itoa(int(typ)) + ")"
+	}
+}
+
+// parse checks that the value is valid for the type.
+func (typ ArgType) parse(val string) error {
+	var err error
+	switch typ {
+	case IntArg:
+		_, err = parseInt(val, 64)
+	case UintArg, ByteSizeArg:
+		_, err = parseUint(val, 64)
+	case FloatArg:
+		_, err = parseFloat(val, 64)
+	case BoolArg:
+		_, err = parseBool(val)
+	case DurationArg:
+		_, err = time.ParseDuration(val)
+	case TimeArg:
+		_, err = time.Parse(time.RFC3339Nano, val)
+	}
+	return err
+}
+
+// VariadicArity is the Arity of the arguments which accept any number of
+// values.
+const VariadicArity = -1
+
+// ArgSpec declares an argument of a command registered in a Registry.
+type ArgSpec struct {
+	// Name is the key of the argument.
+	Name string
+	// Type is the type of the values of the argument.
+	Type ArgType
+	// Required is set if the argument must be specified.
+	Required bool
+	// Arity is the number of values of the argument, e.g. 2 for
+	// key=(a, b), or VariadicArity. Zero means a single value, which is
+	// optional for BoolArg.
+	Arity int
+	// Help describes the argument, for Usage.
+	Help string
+}
+
+// frameworkArgs are the arguments interpreted by the framework, which are
+// accepted by all the commands.
+var frameworkArgs = map[string]bool{
+	"compare":     true,
+	"chain":       true,
+	pendingArg:    true,
+	generatedArg:  true,
+	wrapArg:       true,
+	sortOutputArg: true,
+	noRewriteArg:  true,
+	docArg:        true,
+	groupArg:      true,
+}
+
+// WithArgs declares the arguments of the command. The arguments of the
+// directives using the command are then checked before the handler is
+// invoked: required arguments must be specified, and arguments must be
+// declared and have the declared number of values of the declared type.
+func (c *Command) WithArgs(specs ...ArgSpec) *Command {
+	c.ArgSpecs = append(c.ArgSpecs[:len(c.ArgSpecs):len(c.ArgSpecs)], specs...)
+	return c
+}
+
+// checkArgs checks the arguments of a directive against the ArgSpecs of
+// its command.
+func (c *Command) checkArgs(t *testing.T, d *TestData) {
+	t.Helper()
+	if problems := c.argProblems(d, false /* lint */); len(problems) > 0 {
+		t.Fatal(problems[0])
+	}
+}
+
+// argProblems returns the problems with the arguments of a directive,
+// according to the ArgSpecs of its command, each prefixed with its
+// position. Values which may be substituted (e.g. by foreach or ExpandEnv)
+// are not checked when lint is set.
+func (c *Command) argProblems(d *TestData, lint bool) []string {
+	specs := make(map[string]ArgSpec, len(c.ArgSpecs))
+	names := make([]string, 0, len(c.ArgSpecs))
+	for _, spec := range c.ArgSpecs {
+		specs[spec.Name] = spec
+		names = append(names, spec.Name)
+	}
+	var problems []string
+	report := func(pos Pos, format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("%s: %s: %s", pos, c.Name, fmt.Sprintf(format, args...)))
+	}
+	for _, arg := range d.CmdArgs {
+		if isFrameworkArg(arg.Key, d.opts) {
+			continue
+		}
+		pos := d.ArgPos(arg.Key)
+		spec, ok := specs[arg.Key]
+		if !ok {
+			report(pos, "unknown argument %q%s", arg.Key, didYouMean(arg.Key, names))
+			continue
+		}
+		switch n := len(arg.Vals); {
+		case spec.Arity == VariadicArity:
+		case spec.Arity == 0 && spec.Type == BoolArg && n <= 1:
+		case spec.Arity == 0 && n != 1:
+			report(pos, "argument %q takes a single value, found %d", arg.Key, n)
+			continue
+		case spec.Arity > 0 && n != spec.Arity:
+			report(pos, "argument %q takes %d values, found %d", arg.Key, spec.Arity, n)
+			continue
+		}
+		for _, val := range arg.Vals {
+			if lint && strings.Contains(val, "${") {
+				continue
+			}
+			if err := spec.Type.parse(val); err != nil {
+				report(pos, "argument %q: invalid %s %q", arg.Key, spec.Type, val)
+			}
+		}
+	}
+	for _, spec := range c.ArgSpecs {
+		if spec.Required && !d.HasArg(spec.Name) {
+			report(d.Pos, "missing required argument %q", spec.Name)
+		}
+	}
+	return problems
+}
+
+// usage returns the syntax of the argument, e.g. "key=<int>" or
+// "[span=(<string>, <string>)]".
+func (spec ArgSpec) usage() string {
+	val := "<" + spec.Type.String() + ">"
+	var u string
+	switch {
+	case spec.Arity == VariadicArity:
+		u = fmt.Sprintf("%s=(%s...)", spec.Name, val)
+	case spec.Arity == 0 && spec.Type == BoolArg:
+		u = spec.Name
+	case spec.Arity == 0:
+		u = spec.Name + "=" + val
+	default:
+		vals := make([]string, spec.Arity)
+		for i := range vals {
+			vals[i] = val
+		}
+		u = fmt.Sprintf("%s=(%s)", spec.Name, strings.Join(vals, ", "))
+	}
+	if !spec.Required {
+		u = "[" + u + "]"
+	}
+	return u
+}
+
+// Usage returns a description of the command and its arguments, in the
+// style of the --help output of command-line tools:
+//
+//   usage: scan key=<string> [limit=<int>] [reverse]
+//
+//   Scans the keys starting at key.
+//
+//   arguments:
+//     key=<string>  the first key to scan
+//     [limit=<int>] the maximum number of keys
+//     [reverse]     scan in reverse order
+func (c *Command) Usage() string {
+	var buf strings.Builder
+	buf.WriteString("usage: " + c.Name)
+	width := 0
+	for _, spec := range c.ArgSpecs {
+		buf.WriteString(" " + spec.usage())
+		if w := len(spec.usage()); w > width {
+			width = w
+		}
+	}
+	buf.WriteString("\n")
+	if c.Help != "" {
+		buf.WriteString("\n" + ensureNewline(c.Help))
+	}
+	if c.Deprecated != "" {
+		buf.WriteString("\ndeprecated: " + c.Deprecated + "\n")
+	}
+	if len(c.ArgSpecs) > 0 {
+		buf.WriteString("\narguments:\n")
+		for _, spec := range c.ArgSpecs {
+			line := fmt.Sprintf("  %-*s %s", width, spec.usage(), spec.Help)
+			buf.WriteString(strings.TrimRight(line, " ") + "\n")
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,243 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"bytes"
+	"strings"
+)
+
+// File is the syntax tree of a test file, as returned by Parse. Its nodes
+// cover the entire text of the file, so that Format(Parse(src)) == src.
+// Tools can rewrite a test file by changing the text of the sections of its
+// nodes, e.g. to rename a command, and formatting the File.
+type File struct {
+	// Name is the name of the test file.
+	Name string
+	// Nodes are the directives of the file and the text between them, in
+	// order.
+	Nodes []Node
+}
+
+// Node is a node of a File: a *Directive, or a *Trivia.
+type Node interface {
+	// Sections returns the sections of the node, in order.
+	Sections() []Section
+	// Span returns the section spanning the entire node.
+	Span() Section
+}
+
+// Directive is a directive of a test file.
+type Directive struct {
+	// Cmd and CmdArgs are the command and the arguments of the directive.
+	Cmd     string
+	CmdArgs CmdArgs
+	// CmdLine is the directive line, including its continuation lines and
+	// the indented argument lines with IndentedArgs.
+	CmdLine Section
+	// Input is the input of the directive, up to the separator.
+	Input Section
+	// Expected is the expected output of the directive, from the separator
+	// to the last line of the last expected output block, excluding the
+	// blank line which follows. It is empty if the directive has no
+	// separator.
+	Expected Section
+}
+
+// Sections implements Node.
+func (d *Directive) Sections() []Section {
+	return []Section{d.CmdLine, d.Input, d.Expected}
+}
+
+// Span implements Node.
+func (d *Directive) Span() Section {
+	return joinSections(d.Sections())
+}
+
+// Trivia are the comments and blank lines between directives.
+type Trivia struct {
+	Section
+}
+
+// Sections implements Node.
+func (tr *Trivia) Sections() []Section {
+	return []Section{tr.Section}
+}
+
+// Span implements Node.
+func (tr *Trivia) Span() Section {
+	return tr.Section
+}
+
+// Directives returns the directives of the file.
+func (f *File) Directives() []*Directive {
+	var res []*Directive
+	for _, n := range f.Nodes {
+		if d, ok := n.(*Directive); ok {
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
+// Parse parses a test file into a File. The options are those the test file
+// is run with, as for NewLexer.
+func Parse(file string, src []byte, opts ...Option) (*File, error) {
+	o := makeOptions(opts)
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	// starts are the offsets of the start of each line, followed by the
+	// end of the file; line n starts at starts[n-1].
+	starts := []int{0}
+	for i, c := range src {
+		if c == '\n' && i+1 < len(src) {
+			starts = append(starts, i+1)
+		}
+	}
+	n := len(starts)
+	if len(src) == 0 {
+		n = 0
+	}
+	starts = append(starts[:n], len(src))
+
+	// Classify the lines using the tokens they contain. Blank lines do not
+	// contain any.
+	const blank TokenKind = -1
+	kinds := make([]TokenKind, n+2)
+	hasCmd := make([]bool, n+2)
+	for i := range kinds {
+		kinds[i] = blank
+	}
+	l := NewLexer(file, bytes.NewReader(src), opts...)
+	for tok, ok := l.Next(); ok; tok, ok = l.Next() {
+		switch tok.Kind {
+		case TokenCmd:
+			hasCmd[tok.Line] = true
+			kinds[tok.Line] = TokenCmd
+		case TokenArgKey, TokenArgValue, TokenContinuation:
+			kinds[tok.Line] = TokenCmd
+		case TokenComment:
+			if kinds[tok.Line] != TokenCmd {
+				kinds[tok.Line] = TokenComment
+			}
+		default:
+			kinds[tok.Line] = tok.Kind
+		}
+	}
+	if err := l.Err(); err != nil {
+		return nil, err
+	}
+
+	// section returns the section spanning the lines from the first one up
+	// to, but excluding, the last one.
+	section := func(from, to int) Section {
+		start, end := starts[from-1], starts[to-1]
+		return Section{Text: string(src[start:end]), Line: from, Offset: start, EndOffset: end}
+	}
+	f := &File{Name: file}
+	trivia := 1
+	for line := 1; line <= n; {
+		if !hasCmd[line] {
+			line++
+			continue
+		}
+		if trivia < line {
+			f.Nodes = append(f.Nodes, &Trivia{section(trivia, line)})
+		}
+		d := &Directive{}
+		end := line + 1
+		for end <= n && kinds[end] == TokenCmd && !hasCmd[end] {
+			end++
+		}
+		d.CmdLine = section(line, end)
+		var err error
+		if d.Cmd, d.CmdArgs, _, err = parseCmdLine(d.CmdLine.Text, o.commentPrefix); err != nil {
+			return nil, err
+		}
+
+		// The input extends up to the separator, or to the end of the file
+		// if there is none.
+		inputEnd, hasInput := end, false
+		for inputEnd <= n && (kinds[inputEnd] == TokenInput || kinds[inputEnd] == blank) {
+			hasInput = hasInput || kinds[inputEnd] == TokenInput
+			inputEnd++
+		}
+		hasSeparator := inputEnd <= n && kinds[inputEnd] == TokenSeparator
+		if !hasSeparator && !hasInput {
+			inputEnd = end
+		}
+		d.Input = section(end, inputEnd)
+		expectedEnd := inputEnd
+		if hasSeparator {
+			for expectedEnd <= n && (kinds[expectedEnd] == TokenSeparator || kinds[expectedEnd] == TokenExpected) {
+				expectedEnd++
+			}
+		}
+		d.Expected = section(inputEnd, expectedEnd)
+		f.Nodes = append(f.Nodes, d)
+		line, trivia = expectedEnd, expectedEnd
+	}
+	if trivia <= n {
+		f.Nodes = append(f.Nodes, &Trivia{section(trivia, n+1)})
+	}
+	return f, nil
+}
+
+// Format returns the text of a File.
+func Format(f *File) []byte {
+	var buf bytes.Buffer
+	for _, n := range f.Nodes {
+		for _, s := range n.Sections() {
+			buf.WriteString(s.Text)
+		}
+	}
+	return buf.Bytes()
+}
+
+// parseCmdLine parses the text of a directive line, including its
+// continuation lines and indented argument lines, and returns its trailing
+// comment, if any.
+func parseCmdLine(text, commentPrefix string) (cmd string, args CmdArgs, comment string, err error) {
+	text = strings.TrimPrefix(text, utf8BOM)
+	lines := strings.Split(strings.TrimRight(text, "\r\n"), "\n")
+	line := strings.TrimSpace(lines[0])
+	i := 1
+	for ; strings.HasSuffix(line, `\`) && i < len(lines); i++ {
+		line = strings.TrimSuffix(line, `\`) + " " + strings.TrimSpace(lines[i])
+	}
+	line, comment = splitTrailingComment(line, commentPrefix)
+	if cmd, args, err = ParseLine(line); err != nil {
+		return "", nil, "", err
+	}
+	for ; i < len(lines); i++ {
+		_, more, err := ParseLine("args " + strings.TrimSpace(lines[i]))
+		if err != nil {
+			return "", nil, "", err
+		}
+		args = append(args, more...)
+	}
+	return cmd, args, comment, nil
+}
+
+// joinSections returns the section spanning the given contiguous sections.
+func joinSections(sections []Section) Section {
+	res := sections[0]
+	for _, s := range sections[1:] {
+		res.Text += s.Text
+		res.EndOffset = s.EndOffset
+	}
+	return res
+}
@@ -0,0 +1,113 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+)
+
+// CaptureMode determines what happens with the output the test function
+// writes to os.Stdout and os.Stderr (and to TestData.Out).
+type CaptureMode int
+
+const (
+	// CaptureAppend appends the captured output to the output returned
+	// by the test function.
+	CaptureAppend CaptureMode = iota + 1
+	// CaptureReplace uses the captured output instead of the output
+	// returned by the test function.
+	CaptureReplace
+)
+
+// CaptureOutput causes everything the test function writes to os.Stdout and
+// os.Stderr while handling a directive to be captured and, depending on the
+// mode, appended to or substituted for the output of the directive. This is
+// useful when testing code which prints directly.
+//
+// Note that os.Stdout and os.Stderr are process-wide, so this option cannot
+// be used by tests that run in parallel. Within the package, the directives
+// using it are serialized (see exclusiveDirectives), e.g. in concurrency
+// groups or with Parallel.
+func CaptureOutput(mode CaptureMode) Option {
+	return func(o *options) {
+		o.capture = mode
+	}
+}
+
+// captureBuffer is a buffer which can be written to concurrently.
+type captureBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *captureBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *captureBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// exclusiveDirectives serializes the directives which use process-wide
+// state: those whose output is captured, which redirect os.Stdout and
+// os.Stderr, and those run with Hermetic, which audit the files under the
+// working directory. Otherwise, the directives running concurrently, e.g.
+// in concurrency groups or in the test files of a Parallel Walk, would
+// capture each other's output, and be blamed for each other's files.
+var exclusiveDirectives sync.Mutex
+
+// redirectStdio redirects os.Stdout and os.Stderr to w until the returned
+// function is called.
+func redirectStdio(w io.Writer) (restore func(), _ error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = io.Copy(w, pr)
+	}()
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = pw, pw
+	return func() {
+		os.Stdout, os.Stderr = stdout, stderr
+		_ = pw.Close()
+		<-done
+		_ = pr.Close()
+	}, nil
+}
+
+// combineCaptured combines the output returned by the test function with
+// the captured output.
+func combineCaptured(mode CaptureMode, actual, captured string) string {
+	if mode == CaptureReplace {
+		return captured
+	}
+	if captured == "" {
+		return actual
+	}
+	if actual != "" && actual[len(actual)-1] != '\n' {
+		actual += "\n"
+	}
+	return actual + captured
+}
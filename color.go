@@ -0,0 +1,98 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"flag"
+	"os"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+)
+
+// colorMode controls the use of ANSI colors in the diffs and traces.
+type colorMode string
+
+const (
+	colorAuto   colorMode = "auto"
+	colorAlways colorMode = "always"
+	colorNever  colorMode = "never"
+)
+
+func (m *colorMode) String() string { return string(*m) }
+
+func (m *colorMode) Set(s string) error {
+	switch colorMode(s) {
+	case colorAuto, colorAlways, colorNever:
+		*m = colorMode(s)
+		return nil
+	}
+	return errors.Newf("invalid color mode %q: must be always, never or auto", s)
+}
+
+var colorFlag = colorAuto
+
+func init() {
+	flag.Var(&colorFlag, "datadriven-color",
+		"colorize the diffs and traces: always, never, or auto to colorize them when writing "+
+			"to a terminal and the NO_COLOR environment variable is not set.")
+}
+
+// useColor returns whether to colorize the text written to the given file,
+// which may be nil if the text is not written to a file.
+func useColor(f *os.File) bool {
+	switch colorFlag {
+	case colorAlways:
+		return true
+	case colorNever:
+		return false
+	}
+	if _, ok := os.LookupEnv("NO_COLOR"); ok {
+		return false
+	}
+	if f == nil {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// ANSI escape sequences.
+const (
+	ansiRed   = "\x1b[31m"
+	ansiGreen = "\x1b[32m"
+	ansiCyan  = "\x1b[36m"
+	ansiReset = "\x1b[0m"
+)
+
+// colorize wraps s in the given ANSI color.
+func colorize(s, color string) string {
+	return color + s + ansiReset
+}
+
+// colorDiff colorizes the lines of a diff produced by lineDiff: the removed
+// lines in red and the added lines in green.
+func colorDiff(diff string) string {
+	lines := strings.SplitAfter(diff, "\n")
+	for i, l := range lines {
+		switch {
+		case strings.HasPrefix(l, "- "):
+			lines[i] = colorize(strings.TrimSuffix(l, "\n"), ansiRed) + "\n"
+		case strings.HasPrefix(l, "+ "):
+			lines[i] = colorize(strings.TrimSuffix(l, "\n"), ansiGreen) + "\n"
+		}
+	}
+	return strings.Join(lines, "")
+}
@@ -0,0 +1,206 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// compareOutput compares the expected and actual output of a directive,
+// using the comparison mode selected by its compare argument. If the
+// outputs don't match, a description of the differences may be returned.
+//
+// The actual output also matches if it matches one of the alternative
+// expected outputs of the directive.
+func compareOutput(t *testing.T, d *TestData, actual string) (equal bool, diff string) {
+	t.Helper()
+	equal, diff = compareExpected(t, d, d.Expected, actual)
+	for _, alt := range d.alternatives {
+		if equal {
+			break
+		}
+		equal, _ = compareExpected(t, d, alt, actual)
+		diff += "\nor expected:\n" + alt
+	}
+	return equal, diff
+}
+
+// compareExpected compares one of the expected outputs of a directive with
+// its actual output.
+func compareExpected(
+	t *testing.T, d *TestData, expected, actual string,
+) (equal bool, diff string) {
+	t.Helper()
+	if d.hasValue {
+		return compareValue(d, expected)
+	}
+	mode, ok := d.frameworkArgValue("compare")
+	if !ok && d.opts != nil {
+		mode = d.opts.compareMode
+	}
+	switch mode {
+	case "":
+		return expected == actual, ""
+	case "rows":
+		return compareRows(expected, actual, false /* unordered */)
+	case "rows-unordered":
+		return compareRows(expected, actual, true /* unordered */)
+	default:
+		d.Fatalf(t, "unknown comparison mode: %s", mode)
+		return false, ""
+	}
+}
+
+// table is the result of parsing output consisting of a header line
+// followed by rows.
+type table struct {
+	header []string
+	rows   [][]string
+}
+
+// tableSeparatorRE matches the line which may separate the header of a
+// table from its rows, e.g. "----+----". Only the line which follows the
+// header is a separator; the rows made of the same characters are data.
+var tableSeparatorRE = regexp.MustCompile(`^[-+=| ]+$`)
+
+func parseTable(s string) table {
+	var tab table
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) == 0 || lines[0] == "" {
+		return tab
+	}
+	pipes := strings.Contains(lines[0], "|")
+	split := func(line string) []string {
+		if !pipes {
+			return strings.Fields(line)
+		}
+		cells := strings.Split(line, "|")
+		for i := range cells {
+			cells[i] = strings.TrimSpace(cells[i])
+		}
+		return cells
+	}
+	tab.header = split(lines[0])
+	lines = lines[1:]
+	if len(lines) > 0 && tableSeparatorRE.MatchString(lines[0]) {
+		lines = lines[1:]
+	}
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		tab.rows = append(tab.rows, split(line))
+	}
+	return tab
+}
+
+// compareRows compares two tables cell by cell, optionally ignoring the
+// order of the rows.
+func compareRows(expected, actual string, unordered bool) (equal bool, diff string) {
+	exp, act := parseTable(expected), parseTable(actual)
+	var buf bytes.Buffer
+	if !equalCells(exp.header, act.header) {
+		fmt.Fprintf(&buf, "header: expected %q, found %q\n", exp.header, act.header)
+	}
+	if unordered {
+		sortRows(exp.rows)
+		sortRows(act.rows)
+		missing, extra := diffRowSets(exp.rows, act.rows)
+		for _, row := range missing {
+			fmt.Fprintf(&buf, "missing row: %q\n", row)
+		}
+		for _, row := range extra {
+			fmt.Fprintf(&buf, "unexpected row: %q\n", row)
+		}
+	} else {
+		for i := 0; i < len(exp.rows) || i < len(act.rows); i++ {
+			switch {
+			case i >= len(act.rows):
+				fmt.Fprintf(&buf, "row %d: missing row %q\n", i+1, exp.rows[i])
+			case i >= len(exp.rows):
+				fmt.Fprintf(&buf, "row %d: unexpected row %q\n", i+1, act.rows[i])
+			default:
+				diffCells(&buf, i+1, exp.header, exp.rows[i], act.rows[i])
+			}
+		}
+	}
+	if buf.Len() == 0 {
+		return true, ""
+	}
+	return false, "\ndifferences:\n" + buf.String()
+}
+
+func equalCells(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// diffCells describes the differences between two versions of a row.
+func diffCells(buf *bytes.Buffer, rowNum int, header, exp, act []string) {
+	if len(exp) != len(act) {
+		fmt.Fprintf(buf, "row %d: expected %q, found %q\n", rowNum, exp, act)
+		return
+	}
+	for i := range exp {
+		if exp[i] != act[i] {
+			col := fmt.Sprintf("%d", i+1)
+			if i < len(header) {
+				col = fmt.Sprintf("%q", header[i])
+			}
+			fmt.Fprintf(buf, "row %d, column %s: expected %q, found %q\n", rowNum, col, exp[i], act[i])
+		}
+	}
+}
+
+func sortRows(rows [][]string) {
+	sort.Slice(rows, func(i, j int) bool {
+		return strings.Join(rows[i], "\x00") < strings.Join(rows[j], "\x00")
+	})
+}
+
+// diffRowSets returns the rows which only appear in exp and those which
+// only appear in act, given that both are sorted.
+func diffRowSets(exp, act [][]string) (missing, extra [][]string) {
+	i, j := 0, 0
+	for i < len(exp) && j < len(act) {
+		e, a := strings.Join(exp[i], "\x00"), strings.Join(act[j], "\x00")
+		switch {
+		case e == a:
+			i++
+			j++
+		case e < a:
+			missing = append(missing, exp[i])
+			i++
+		default:
+			extra = append(extra, act[j])
+			j++
+		}
+	}
+	missing = append(missing, exp[i:]...)
+	extra = append(extra, act[j:]...)
+	return missing, extra
+}
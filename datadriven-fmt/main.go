@@ -0,0 +1,76 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/cockroachdb/datadriven"
+)
+
+var (
+	list          = flag.Bool("l", false, "list the files whose formatting differs, without changing them")
+	joinLines     = flag.Bool("join-lines", false, "join the continued directive lines")
+	separator     = flag.String("separator", "----", "the separator of the test files")
+	commentPrefix = flag.String("comment-prefix", "#", "the prefix of the comment lines of the test files")
+	indentedArgs  = flag.Bool("indented-args", false, "interpret the indented lines following directive lines as arguments")
+	maxBlankLines = flag.Int("max-blank-lines", 1, "the maximum number of consecutive blank lines between directives")
+	builtins      = flag.Bool("builtin-directives", false, "parse the directives run by the framework, e.g. config, as such")
+)
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <test-file>...\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	style := datadriven.Style{
+		CommentPrefix:     *commentPrefix,
+		Separator:         *separator,
+		IndentedArgs:      *indentedArgs,
+		MaxBlankLines:     *maxBlankLines,
+		JoinLines:         *joinLines,
+		BuiltinDirectives: *builtins,
+	}
+	for _, path := range flag.Args() {
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		out, err := datadriven.FormatFile(src, style)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			os.Exit(1)
+		}
+		if bytes.Equal(out, src) {
+			continue
+		}
+		if *list {
+			fmt.Println(path)
+			continue
+		}
+		if err := ioutil.WriteFile(path, out, 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Formatted %s.\n", path)
+	}
+}
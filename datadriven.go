@@ -15,6 +15,7 @@
 package datadriven
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"io"
@@ -22,9 +23,12 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
-	"strconv"
+	"sort"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/cockroachdb/errors"
 )
@@ -41,6 +45,17 @@ var (
 		"datadriven-trace", false,
 		"echo the directives and responses from test files.",
 	)
+
+	checkDeterminism = flag.Bool(
+		"datadriven-check-determinism", false,
+		"invoke the test function twice for every directive and fail if the outputs differ. "+
+			"See CheckDeterminism.",
+	)
+
+	quietFlag = flag.Bool(
+		"datadriven-quiet", false,
+		"suppress the messages logged for directives which pass. See Quiet.",
+	)
 )
 
 // Verbose returns true iff -trace was passed.
@@ -58,6 +73,12 @@ func Verbose() bool {
 //   ----
 //   <expected results>
 //
+// A long directive line can be split over multiple lines by ending each
+// line but the last with a backslash:
+//
+//   <command> arg1=val1 \
+//     arg2=val2
+//
 // The command input can contain blank lines. However, by default, the expected
 // results cannot contain blank lines. This alternate syntax allows the use of
 // blank lines:
@@ -72,6 +93,137 @@ func Verbose() bool {
 //   ----
 //   ----
 //
+// The config, foreach, macro, include, skipfile and keep-going directives
+// described below are run by the framework with the BuiltinDirectives
+// option only. Otherwise, they are handed to the test function like any
+// other directive.
+//
+// A test file can be run under multiple configurations by starting it with
+// a config directive:
+//
+//   config <name> [<name>...]
+//
+// The entire file is then run once per configuration, in a subtest named
+// after the configuration, and the configuration is available to the test
+// function via TestData.Config. Directives whose results differ across
+// configurations can specify per-configuration expected results, which take
+// precedence over the default expected results:
+//
+//   <command>
+//   ----
+//   <expected results>
+//   ---- <name>
+//   <expected results for configuration name>
+//
+// When rewriting, the results of the first configuration are used as the
+// default expected results.
+//
+// Directives whose output legitimately varies, e.g. between two valid query
+// plans, can list alternative expected results, each preceded by a "---- or"
+// header; the directive passes if its output matches any of them:
+//
+//   <command>
+//   ----
+//   <expected results>
+//   ---- or
+//   <alternative expected results>
+//
+// When rewriting, the alternatives are kept if the output matches one of
+// them, and replaced with the output otherwise.
+//
+// A directive can be run multiple times with different values substituted
+// for variables in its arguments and input by preceding it with a foreach
+// directive. The expected results of each invocation are listed in turn,
+// each preceded by a header with the values of the variables:
+//
+//   foreach x=(1, 2)
+//   <command> arg=${x}
+//   <input to the command, which can also refer to ${x}>
+//   ----
+//   [x=1]
+//   <expected results with x=1>
+//   [x=2]
+//   <expected results with x=2>
+//
+// Sequences of directives which are repeated often can be defined as a
+// macro, either in the test file itself or in a file included using the
+// include directive (which may only contain macro definitions):
+//
+//   macro <name> [<param>...]
+//   <command> arg=${param}
+//
+//   <command>
+//   <input to the command>
+//   ----
+//
+// The directives of a macro are separated by blank lines, and cannot
+// themselves contain blank lines. A macro is invoked like a regular
+// command, passing a value for each parameter:
+//
+//   <name> param=val
+//   ----
+//   <combined expected results of the directives in the macro>
+//
+// Errors inside a macro report both the position of the directive in the
+// macro definition and the position of the invocation.
+//
+// The arguments of the directives described below, i.e. compare, pending,
+// no-rewrite, sort-output, doc, wrap and group, as well as chain (see
+// Shuffle) and generated (see TestData.Enqueue), are interpreted by the
+// framework with the FrameworkArgs option only. Otherwise, they are handed
+// to the test function like any other argument.
+//
+// By default, the actual results must be identical to the expected results.
+// Directives whose results are tables, with a header line followed by rows,
+// can instead use the compare argument:
+//   - compare=rows compares the tables cell by cell, ignoring the widths of
+//     the columns.
+//   - compare=rows-unordered additionally ignores the order of the rows.
+// Cells are separated by | if the header contains one, and by whitespace
+// otherwise.
+//
+// Lines starting with # are comments. A block comment starts with #| and
+// ends with |#, and may span multiple lines; this can be used to temporarily
+// disable entire directives, including their expected results. A directive
+// line can also end with a comment, preceded by white space. Comments and
+// blank lines are preserved when rewriting. The CommentPrefix option changes
+// the # prefix.
+//
+// A test file can be disabled by starting it with a skipfile directive,
+// followed by the reason on the same line:
+//
+//   skipfile <reason>
+//
+// The file is then skipped with t.Skip. Walk also skips files whose name
+// ends in .skip.
+//
+// A keep-going directive causes the mismatches of the directives which
+// follow to be reported without stopping the test file, regardless of the
+// KeepGoing option, for files which test many independent cases;
+// "keep-going off" restores the default.
+//
+// A directive with the pending argument is not run, and its expected
+// results are kept as is when rewriting. This marks test cases which are
+// not expected to pass yet; RunMain lists them at the end of the run.
+//
+// A directive with the no-rewrite argument keeps its expected results when
+// rewriting, which protects hand-curated results; RunMain lists those which
+// would have changed at the end of the run.
+//
+// The sort-output argument of a directive causes the lines of its output to
+// be sorted before they are compared with the expected output and written
+// when rewriting, for handlers whose output is in a nondeterministic order.
+//
+// The doc argument of a directive selects it for the Markdown examples
+// rendered by ExportMarkdown; it does not affect how the directive is run.
+//
+// The wrap argument of a directive wraps its long output lines at the
+// given width when rewriting, e.g. wrap=80; see WrapOutput.
+//
+// Consecutive directives with the same group=<name> argument form a
+// concurrency group, whose directives run concurrently while the groups run
+// sequentially, e.g. to follow a serial setup with a parallel load.
+//
 // To execute data-driven tests, pass the path of the test file as well as a
 // function which can interpret and execute whatever commands are present in
 // the test file. The framework invokes the function, passing it information
@@ -95,16 +247,41 @@ func Verbose() bool {
 //
 // It is also possible for a test to report an _unexpected_ test
 // error by calling t.Error().
-func RunTest(t *testing.T, path string, f func(t *testing.T, d *TestData) string) {
+//
+// A relative path is resolved relative to the directory set with the
+// TestdataRoot option or the DD_TESTDATA_ROOT environment variable (or its
+// longer form DATADRIVEN_TESTDATA_ROOT), if any, and to the working
+// directory otherwise. A relative path which does not exist in the working
+// directory is then looked up among the Bazel runfiles of the test, if any.
+// This allows running the tests in environments where the test files are
+// not in the working directory, e.g. in build sandboxes.
+func RunTest(
+	t *testing.T, path string, f func(t *testing.T, d *TestData) string, opts ...Option,
+) {
 	t.Helper()
+	o := makeOptions(opts)
+	if err := o.validate(); err != nil {
+		t.Fatal(err)
+	}
+	path = o.resolvePath(path)
+	recordUsedFile(path)
+	rewrite := *rewriteTestFiles || *rewriteToStdout
+	if *interactiveFlag && !rewrite {
+		// Mismatches are resolved interactively, which requires the test
+		// file to be rewritten.
+		rewrite = true
+	}
 	mode := os.O_RDONLY
-	if *rewriteTestFiles {
+	if rewrite && !*rewriteToStdout {
 		// We only open read-write if rewriting, so as to enable running
 		// tests on read-only copies of the source tree.
 		mode = os.O_RDWR
 	}
 	file, err := os.OpenFile(path, mode, 0644 /* irrelevant */)
 	if err != nil {
+		if mode == os.O_RDWR {
+			err = rewriteError(path, err)
+		}
 		t.Fatal(err)
 	}
 	defer func() {
@@ -117,13 +294,51 @@ func RunTest(t *testing.T, path string, f func(t *testing.T, d *TestData) string
 		t.Fatalf("%s is a directory, not a file; consider using datadriven.Walk", path)
 	}
 
-	rewriteData := runTestInternal(t, path, file, f, *rewriteTestFiles)
-	if *rewriteTestFiles {
+	if *rerunFailed {
+		// Record the directives which fail, so that they can be run again by
+		// themselves.
+		failures := loadFailureCache(path)
+		defer failures.save(t)
+		opts = append(opts[:len(opts):len(opts)], withFailureCache(failures))
+	}
+
+	if rewrite && !*rewriteTestFiles && !*rewriteToStdout {
+		session := newInteractiveSession(t, file)
+		defer session.close(t)
+		opts = append(opts, withInteractive(session))
+	}
+
+	// Keep the original contents, to tell whether the rewrite changed them.
+	var orig bytes.Buffer
+	rewriteData := runTestInternal(t, path, io.TeeReader(file, &orig), f, rewrite, opts...)
+	if rewrite {
+		for _, fn := range o.postRewrite {
+			var write bool
+			if rewriteData, write = fn(path, orig.Bytes(), rewriteData); !write {
+				if !isQuiet(&o) {
+					t.Logf("%s: rewrite vetoed", path)
+				}
+				return
+			}
+		}
+		changed := !bytes.Equal(orig.Bytes(), rewriteData)
+		recordRewrite(changed)
+		if *rewriteToStdout {
+			if err := writeRewriteToStdout(path, rewriteData); err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+		if !changed {
+			// Leave the file untouched, so that its modification time
+			// doesn't change, e.g. for build systems which track it.
+			return
+		}
 		if _, err := file.WriteAt(rewriteData, 0); err != nil {
-			t.Fatal(err)
+			t.Fatal(rewriteError(path, err))
 		}
 		if err := file.Truncate(int64(len(rewriteData))); err != nil {
-			t.Fatal(err)
+			t.Fatal(rewriteError(path, err))
 		}
 		if err := file.Sync(); err != nil {
 			t.Fatal(err)
@@ -131,11 +346,49 @@ func RunTest(t *testing.T, path string, f func(t *testing.T, d *TestData) string
 	}
 }
 
+// rewriteError explains the errors caused by test files which cannot be
+// written to when rewriting, e.g. because they are read-only or are in a
+// sandbox. Other errors are returned as is.
+func rewriteError(path string, err error) error {
+	if !os.IsPermission(err) && !errors.Is(err, syscall.EROFS) {
+		return err
+	}
+	return errors.Newf("cannot rewrite %s, which is read-only (%v); make it writable, "+
+		"or use -datadriven-rewrite-stdout to write the rewritten test files to stdout instead",
+		path, err)
+}
+
+// RunTestSimple runs the test file at path with the given test function and
+// the default options. It is equivalent to RunTest without options, and is
+// meant as the starting point for new tests: the test function only needs to
+// return the actual output of each directive.
+func RunTestSimple(t *testing.T, path string, f func(t *testing.T, d *TestData) string) {
+	t.Helper()
+	RunTest(t, path, f)
+}
+
 // RunTestFromString is a version of RunTest which takes the contents of a test
-// directly.
-func RunTestFromString(t *testing.T, input string, f func(t *testing.T, d *TestData) string) {
+// directly. See RunTestInline for positions which refer to the Go source.
+func RunTestFromString(
+	t *testing.T, input string, f func(t *testing.T, d *TestData) string, opts ...Option,
+) {
 	t.Helper()
-	runTestInternal(t, "<string>" /* sourceName */, strings.NewReader(input), f, *rewriteTestFiles)
+	runTestInternal(t, "<string>" /* sourceName */, strings.NewReader(input), f, *rewriteTestFiles, opts...)
+}
+
+// RunTestFromBytes is a version of RunTest which takes the contents of a test
+// directly, e.g. when it is generated or embedded in the test binary. The
+// name identifies the test in failure messages, in place of the path of the
+// test file.
+func RunTestFromBytes(
+	t *testing.T,
+	name string,
+	data []byte,
+	f func(t *testing.T, d *TestData) string,
+	opts ...Option,
+) {
+	t.Helper()
+	runTestInternal(t, name, bytes.NewReader(data), f, *rewriteTestFiles, opts...)
 }
 
 func runTestInternal(
@@ -144,21 +397,166 @@ func runTestInternal(
 	reader io.Reader,
 	f func(t *testing.T, d *TestData) string,
 	rewrite bool,
+	opts ...Option,
 ) (rewriteOutput []byte) {
 	t.Helper()
 
-	r := newTestDataReader(t, sourceName, reader, rewrite)
-	for r.Next(t) {
-		runDirectiveOrSubTest(t, r, "" /*mandatorySubTestPrefix*/, f)
+	o := makeOptions(opts)
+	if err := o.validate(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if t.Failed() {
+			recordFailedFile(t.Name())
+		}
+	}()
+	input, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	if r.rewrite != nil {
-		data := r.rewrite.Bytes()
-		// Remove any trailing blank line.
-		if l := len(data); l > 2 && data[l-1] == '\n' && data[l-2] == '\n' {
-			data = data[:l-1]
+	if fc := o.failures; fc != nil && !rewrite {
+		// When none of the directives failed previously, they are all run.
+		fc.selected = selectDirectives(t, sourceName, input, o, fc.previous)
+	}
+
+	// Determine whether the file declares a configuration matrix. The
+	// reader consumes the config directive internally when it is the first
+	// directive in the file.
+	configs, hasDirectives := newTestDataReader(t, sourceName, bytes.NewReader(input), false, o).readConfigs(t)
+	if !hasDirectives && o.requireDirectives {
+		t.Fatalf("%s: no directives found; check the separators in the file", sourceName)
+	}
+	if o.hermetic {
+		dir, err := ioutil.TempDir("", "datadriven-scratch")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = os.RemoveAll(dir) }()
+		// Resolve symlinks, e.g. on macOS, so that the paths handed to the
+		// test function are canonical.
+		if o.scratch, err = filepath.EvalSymlinks(dir); err != nil {
+			t.Fatal(err)
+		}
+		o.auditRoot = o.auditDir()
+	}
+
+	if o.fileTimeout > 0 {
+		w := startWatchdog(sourceName+": test file", o.fileTimeout)
+		defer w.stop()
+		o.watchdog = w
+	}
+
+	if o.leakCheck == LeakCheckFile {
+		before := goroutines()
+		defer func() {
+			if t.Failed() {
+				return
+			}
+			// Use Errorf rather than Fatalf, so as not to abort a panic
+			// which is unwinding the test.
+			if leaked := leakedGoroutines(before); len(leaked) > 0 {
+				t.Errorf("%s: %d goroutine(s) leaked:\n\n%s", sourceName, len(leaked), strings.Join(leaked, "\n\n"))
+			}
+		}()
+	}
+
+	if len(configs) > 0 && o.interactive != nil {
+		t.Fatalf("%s: -datadriven-interactive cannot be used with a config matrix; use -rewrite", sourceName)
+	}
+	if len(configs) == 0 {
+		return runTestPass(t, sourceName, input, f, rewrite, o, "" /* config */, nil /* matrix */)
+	}
+
+	// Run the entire file once per configuration. When rewriting, all but
+	// the last pass only record their results; the last pass produces the
+	// rewritten file, using the results of all the passes.
+	m := &configMatrix{
+		configs: configs,
+		rewrite: rewrite,
+		results: make(map[string]map[string]string),
+	}
+	for i, config := range configs {
+		last := i == len(configs)-1
+		t.Run(config, func(t *testing.T) {
+			out := runTestPass(t, sourceName, input, f, rewrite && last, o, config, m)
+			if last {
+				rewriteOutput = out
+			}
+		})
+	}
+	if t.Failed() {
+		// Don't let a partial rewrite clobber the test file.
+		t.FailNow()
+	}
+	return rewriteOutput
+}
+
+// runTestPass runs all the directives in the input once. config is the
+// current configuration if the file declares a configuration matrix.
+func runTestPass(
+	t *testing.T,
+	sourceName string,
+	input []byte,
+	f func(t *testing.T, d *TestData) string,
+	rewrite bool,
+	o options,
+	config string,
+	m *configMatrix,
+) (rewriteOutput []byte) {
+	t.Helper()
+
+	r := newTestDataReader(t, sourceName, bytes.NewReader(input), rewrite, o)
+	r.src = input
+	r.config = config
+	r.matrix = m
+	if seed, ok := shuffleSeed(t, o); ok && !rewrite && (m == nil || !m.rewrite) {
+		if r.shuffle(t, seed) {
+			defer func() {
+				if t.Failed() {
+					t.Logf("%s: directives were shuffled with -datadriven-shuffle=%d", sourceName, seed)
+				}
+			}()
+		} else {
+			// Read the file again, in order.
+			r = newTestDataReader(t, sourceName, bytes.NewReader(input), rewrite, o)
+			r.src = input
+			r.config = config
+			r.matrix = m
+		}
+	}
+	defer r.reportFailures(t)
+	if !r.opts.directiveSubtests {
+		for r.Next(t) {
+			runDirectiveOrSubTest(t, r, "" /*mandatorySubTestPrefix*/, f)
+		}
+	} else {
+		// The directives which call t.Parallel resume once the function of
+		// their parent test returns. Run them under a subtest, so that they
+		// completed before the file is rewritten and torn down.
+		started := false
+		t.Run(directivesSubtest, func(t *testing.T) {
+			started = true
+			for r.Next(t) {
+				runDirectiveOrSubTest(t, r, "" /*mandatorySubTestPrefix*/, f)
+			}
+		})
+		r.finishPaused()
+		if !started {
+			// Filtered out by -run: leave the file as is.
+			if rewrite {
+				return input
+			}
+			return nil
 		}
-		return data
+		if t.Failed() {
+			// Don't let a partial rewrite clobber the test file.
+			t.FailNow()
+		}
+	}
+
+	if r.rewrite != nil {
+		return r.finishRewrite(r.rewrite.Bytes())
 	}
 	return nil
 }
@@ -174,10 +572,17 @@ func runDirectiveOrSubTest(
 ) {
 	if subTestName, ok := isSubTestStart(t, r, mandatorySubTestPrefix); ok {
 		runSubTest(subTestName, t, r, f)
+	} else if group := r.readGroup(t); group != nil {
+		runGroup(t, r, group, f)
+	} else if r.opts.directiveSubtests {
+		runDirectiveSubtest(t, r, f)
 	} else {
 		runDirective(t, r, f)
 	}
-	if t.Failed() {
+	if len(r.data.enqueued) > 0 && (!t.Failed() || r.keepGoing) {
+		runGenerated(t, r, mandatorySubTestPrefix, f)
+	}
+	if t.Failed() && !r.keepGoing {
 		// If a test has failed with .Error(), we can't expect any
 		// subsequent test to be even able to start. Stop processing the
 		// file in that case.
@@ -185,6 +590,67 @@ func runDirectiveOrSubTest(
 	}
 }
 
+// directivesSubtest is the name of the subtest under which the directives
+// run with DirectiveSubtests.
+const directivesSubtest = "directives"
+
+// runDirectiveSubtest runs a directive in its own subtest, with
+// DirectiveSubtests. The subtest runs with its own copy of the reader, and
+// its own part of the rewrite buffer, so that the test function can call
+// t.Parallel: the reader then proceeds with the following directives
+// without disturbing the paused directive, which completes, and is
+// compared with its expected output, in its own subtest once the other
+// directives of the file have run. Its part of the rewritten file is then
+// put back in place by finishPaused.
+func runDirectiveSubtest(t *testing.T, r *testDataReader, f func(*testing.T, *TestData) string) {
+	dr := *r
+	d := &dr.data
+	r.detachRewrite(&dr)
+	// started is set before the test function can call t.Parallel, so as
+	// to tell a subtest which was filtered out by -run, which does not run
+	// at all, from one which was paused.
+	started, done, paused := false, false, false
+	t.Run(r.opts.directiveSubtestNameFor(d), func(t *testing.T) {
+		started = true
+		defer func() {
+			if t.Skipped() {
+				// Keep the expected output of a skipped directive.
+				dr.emitExpected(d.Expected, d.alternatives...)
+			}
+			done = true
+		}()
+		runDirective(t, &dr, f)
+		if paused && len(d.enqueued) > 0 {
+			d.Fatalf(t, "directives cannot be generated by a directive which calls t.Parallel")
+		}
+	})
+	switch {
+	case !started:
+		// Keep the expected output of a directive filtered out by -run.
+		dr.emitExpected(d.Expected, d.alternatives...)
+	case !done:
+		// The test function called t.Parallel. The directive resumes once
+		// the caller returns, so it must no longer share the state of the
+		// reader.
+		paused = true
+		dr.failures = nil
+		if r.opts.capture != 0 || r.opts.scratch != "" {
+			// The paused directive holds exclusiveDirectives.
+			r.data.Fatalf(t, "t.Parallel cannot be called with CaptureOutput or Hermetic")
+		}
+		if r.opts.interactive != nil {
+			r.data.Fatalf(t, "t.Parallel cannot be called with -datadriven-interactive")
+		}
+		offset := 0
+		if r.rewrite != nil {
+			offset = r.rewrite.Len()
+		}
+		r.paused = append(r.paused, pausedDirective{offset: offset, r: &dr})
+		return
+	}
+	r.attachRewrite(&dr)
+}
+
 // runSubTest runs a subtest up to and including the final `subtest
 // end`. The opening `subtest` directive has been consumed already.
 // The first parameter `subTestName` is the full path to the subtest,
@@ -294,21 +760,122 @@ func runDirective(t *testing.T, r *testDataReader, f func(*testing.T, *TestData)
 	t.Helper()
 
 	d := &r.data
-	actual := func() string {
-		defer func() {
-			if r := recover(); r != nil {
-				t.Logf("\npanic during %s:\n%s\n", d.Pos, d.Input)
-				panic(r)
+	if fc := r.opts.failures; fc != nil && fc.selected != nil && !fc.selected[d.Pos.Line] {
+		// Only the directives which failed previously are run.
+		return
+	}
+	if d.frameworkArgBool(t, pendingArg) {
+		if !isQuiet(d.opts) {
+			t.Logf("%s: pending", d.Pos)
+		}
+		r.skipPending(d)
+		return
+	}
+	if w := r.opts.watchdog; w != nil {
+		w.set(d)
+		defer w.set(nil)
+	}
+	if timeout := r.opts.directiveTimeout; timeout > 0 {
+		w := startWatchdog(d.Pos.String()+": directive", timeout)
+		w.set(d)
+		defer w.stop()
+	}
+	d.logs = &[]string{}
+	failedBefore := t.Failed()
+	// failed is set if the directive failed. Once an earlier directive
+	// failed, with KeepGoing, t.Failed does not tell, so the mismatches and
+	// the failures reported with d.Fatalf and d.Errorf set it as well.
+	failed := false
+	d.failed = &failed
+	// handled is set once the test function returned, so that a directive
+	// stopped with t.FailNow is known to have failed.
+	handled := false
+	// stale is set if the directive fails only because its output differs
+	// from the expected output.
+	stale := false
+	start := time.Now()
+	defer trackProgress(t, r.sourceName, d)()
+	defer func() {
+		failed = failed || t.Failed() && (!failedBefore || !handled && !t.Skipped())
+		if *statsFlag {
+			recordDirectiveStats(r.sourceName, d.Cmd, failed, time.Since(start))
+		}
+		if fc := r.opts.failures; fc != nil && failed && d.Pos.File == r.sourceName {
+			fc.record(d)
+		}
+		if failed {
+			r.recordFailure(d)
+			recordFailedDirective(t.Name(), stale)
+		}
+		// Only show the messages logged with d.Logf if the directive
+		// failed, unless running verbosely.
+		if failed || (testing.Verbose() && !isQuiet(d.opts)) {
+			for _, msg := range *d.logs {
+				t.Logf("%s: %s", d.Pos, msg)
 			}
-		}()
-		actual := f(t, d)
-		if actual != "" && !strings.HasSuffix(actual, "\n") {
-			actual += "\n"
 		}
-		return actual
+		if failed && len(d.artifacts) > 0 {
+			writeArtifacts(t, d)
+		}
 	}()
+	run := func() string {
+		// The mungers registered by the test function apply to a single
+		// invocation.
+		d.mungers = nil
+		d.enqueued = nil
+		actual := func() string {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Logf("\npanic during %s:\n%s\n", d.Pos, d.Input)
+					panic(r)
+				}
+			}()
+			if d.foreach != nil {
+				return runForeach(t, d, r.macros, f)
+			}
+			return invoke(t, d, f)
+		}()
+		return sortOutput(t, d, applyMungers(t, d, actual))
+	}
+	var before map[string]string
+	if r.opts.leakCheck == LeakCheckDirective {
+		before = goroutines()
+	}
+	actual := run()
+	if r.opts.checkDeterminism || *checkDeterminism {
+		if again := run(); again != actual {
+			d.Fatalf(t, "nondeterministic output:\nfirst run:\n%s\nsecond run:\n%s", actual, again)
+		}
+	}
+	if rep := d.replacement; rep != nil {
+		d.replacement = nil
+		if r.rewrite != nil {
+			// Run the replacement to produce its expected output.
+			d.Cmd, d.CmdArgs, d.Input = rep.cmd, rep.args, rep.input
+			d.line = formatCmdLine(rep.cmd, rep.args)
+			d.macro = r.macros[rep.cmd]
+			d.cmdArgsRewritten = false
+			r.replaceDirective(rep.cmd, rep.args, rep.input)
+			actual = run()
+			if d.replacement != nil {
+				d.Fatalf(t, "the replacement of a directive cannot be replaced in turn")
+			}
+		}
+	}
+	r.rewriteCmdLine(d)
+	if before != nil {
+		if leaked := leakedGoroutines(before); len(leaked) > 0 {
+			d.Fatalf(t, "%d goroutine(s) leaked:\n\n%s", len(leaked), strings.Join(leaked, "\n\n"))
+		}
+	}
 
-	if t.Failed() {
+	actual, err := r.opts.normalizeIndentText(actual)
+	if err != nil {
+		d.Fatalf(t, "output: %v", err)
+	}
+
+	handled = true
+	if failed || t.Failed() && !failedBefore {
 		// If the test has failed with .Error(), then we can't hope it
 		// will have produced a useful actual output. Trying to do
 		// something with it here would risk corrupting the expected
@@ -321,31 +888,205 @@ func runDirective(t *testing.T, r *testDataReader, f func(*testing.T, *TestData)
 
 	// The test has not failed, we can analyze the expected
 	// output.
-	if r.rewrite != nil {
-		r.emit("----")
-		if hasBlankLine(actual) {
-			r.emit("----")
-			r.rewrite.WriteString(actual)
-			r.emit("----")
-			r.emit("----")
-			r.emit("")
+	equal, diff := compareOutput(t, d, actual)
+	if d.Rewrite && !equal && d.frameworkArgBool(t, noRewriteArg) {
+		// Keep the expected output of a pinned directive.
+		recordPinnedChange(t, d, actual)
+		equal, actual = true, d.Expected
+	}
+	if r.matrix != nil && r.matrix.rewrite {
+		r.matrix.record(r.config, d.Pos.String(), actual)
+		r.emitConfigExpected(d.Pos.String())
+	} else if r.rewrite != nil {
+		if equal {
+			// Avoid gratuitous changes when the expected output is
+			// equivalent to the actual output, e.g. up to row order.
+			actual = d.Expected
+		} else if s := r.opts.interactive; s != nil {
+			if actual = s.resolve(t, d, actual); actual != d.Expected {
+				// Write the accepted change right away, followed by the
+				// remainder of the input.
+				r.emitExpected(actual)
+				data := append(append([]byte(nil), r.rewrite.Bytes()...), r.src[r.scanner.end:]...)
+				s.write(t, r.finishRewrite(data))
+				return
+			}
+		}
+		if equal {
+			// Keep the alternative expected outputs, one of which may be
+			// the one which matched.
+			r.emitExpected(actual, d.alternatives...)
+		} else if r.opts.keepOldExpected && d.Expected != "" && actual != d.Expected {
+			r.emitExpectedKeepingOld(actual, d.Expected)
 		} else {
-			// Here actual already ends in \n so emit adds a blank line.
-			r.emit(actual)
+			r.emitExpected(actual)
+		}
+	} else if !equal {
+		failed, stale = true, true
+		if d.foreach != nil {
+			reportForeachMismatch(t, d, actual)
 		}
-	} else if d.Expected != actual {
-		t.Fatalf("\n%s: %s\nexpected:\n%s\nfound:\n%s", d.Pos, d.Input, d.Expected, actual)
+		if useColor(os.Stdout) {
+			diff += "\ndiff (-expected +found):\n" + colorDiff(lineDiff(d.Expected, actual))
+		}
+		if dir := dumpFailure(t, d, actual); dir != "" {
+			diff += "\nfailure artifacts written to " + dir
+		}
+		diff += writeGotWantFiles(t, d, actual)
+		if r.keepGoing {
+			t.Errorf("\n%s: %s\nexpected:\n%s\nfound:\n%s%s", d.Pos, d.Input, d.Expected, actual, diff)
+			return
+		}
+		t.Fatalf("\n%s: %s\nexpected:\n%s\nfound:\n%s%s", d.Pos, d.Input, d.Expected, actual, diff)
 	} else if *traceLog {
 		input := d.Input
 		if input == "" {
 			input = "<no input to command>"
 		}
+		pos := d.Pos.String()
+		if useColor(os.Stdout) {
+			pos = colorize(pos, ansiCyan)
+		}
 		// TODO(tbg): it's awkward to reproduce the args, but it would be helpful.
-		t.Logf("\n%s:\n%s [%d args]\n%s\n----\n%s", d.Pos, d.Cmd, len(d.CmdArgs), input, actual)
+		t.Logf("\n%s:\n%s [%d args]\n%s\n%s\n%s", pos, d.Cmd, len(d.CmdArgs), input, r.opts.separator, actual)
+	}
+	if equal && r.rewrite == nil {
+		removeGotWantFiles(d)
 	}
 	return
 }
 
+// applyMungers applies the mungers registered with the Munger option,
+// followed by those registered for the directive, to its output.
+func applyMungers(t *testing.T, d *TestData, actual string) string {
+	t.Helper()
+	var mungers []munger
+	if d.opts != nil {
+		mungers = append(mungers, d.opts.mungers...)
+	}
+	return runMungers(t, d, append(mungers, d.mungers...), actual)
+}
+
+// runMungers applies the given mungers to the output of a directive.
+func runMungers(t *testing.T, d *TestData, mungers []munger, actual string) string {
+	t.Helper()
+	for _, m := range mungers {
+		actual = m.fn(actual)
+		if actual != "" && !strings.HasSuffix(actual, "\n") {
+			actual += "\n"
+		}
+		if *traceLog {
+			t.Logf("%s: applied munger %s", d.Pos, m.name)
+		}
+	}
+	return actual
+}
+
+// sortOutputArg is the argument which causes the lines of the output of a
+// directive to be sorted, for handlers whose output is in a nondeterministic
+// order.
+const sortOutputArg = "sort-output"
+
+// sortOutput sorts the lines of the output of the directive if it has the
+// sort-output argument.
+func sortOutput(t *testing.T, d *TestData, actual string) string {
+	t.Helper()
+	if actual == "" || !d.frameworkArgBool(t, sortOutputArg) {
+		return actual
+	}
+	lines := strings.Split(strings.TrimSuffix(actual, "\n"), "\n")
+	sort.Strings(lines)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// invoke runs a directive, which is either a macro invocation or is
+// handled by the test function.
+func invoke(t *testing.T, d *TestData, f func(*testing.T, *TestData) string) string {
+	if d.macro != nil {
+		return runMacro(t, d, f, 0 /* depth */)
+	}
+	return callHandler(t, d, f)
+}
+
+// callHandler invokes the test function for a directive and returns its
+// output, terminated by a newline if non-empty.
+func callHandler(t *testing.T, d *TestData, f func(*testing.T, *TestData) string) string {
+	t.Helper()
+	// Expand the arguments and input of a copy, and restore the originals
+	// afterwards, so that each invocation of the directive (e.g. with
+	// CheckDeterminism or Eventually) starts from the unexpanded directive.
+	// Arguments and input rewritten by the test function are mapped back to
+	// their unexpanded form, so that the test file is rewritten with them.
+	args, input := d.CmdArgs, d.Input
+	d.CmdArgs = cloneArgs(args)
+	var expanded CmdArgs
+	var expandedInput string
+	defer func() {
+		if d.cmdArgsRewritten {
+			d.CmdArgs = unexpandArgs(d.CmdArgs, expanded, args)
+		} else {
+			d.CmdArgs = args
+		}
+		d.Input = input
+		if rep := d.replacement; rep != nil {
+			rep.args = unexpandArgs(rep.args, expanded, args)
+			if rep.input == expandedInput {
+				rep.input = input
+			}
+		}
+	}()
+	if d.opts != nil && d.opts.expandEnv {
+		expandEnv(t, d)
+	}
+	if d.opts != nil && d.opts.scratch != "" {
+		expandScratch(t, d)
+	}
+	if d.opts != nil && d.opts.argsFromFiles {
+		loadArgFiles(t, d)
+	}
+	if d.opts != nil && d.opts.inputTemplate != nil {
+		d.Input = d.opts.inputTemplate.execute(t, d)
+	}
+	expanded, expandedInput = cloneArgs(d.CmdArgs), d.Input
+	if d.opts != nil && d.opts.builtinEcho && d.Cmd == "echo" {
+		return ensureNewline(d.Input)
+	}
+	var mode CaptureMode
+	if d.opts != nil {
+		mode = d.opts.capture
+	}
+	if mode != 0 || (d.opts != nil && d.opts.scratch != "") {
+		exclusiveDirectives.Lock()
+		defer exclusiveDirectives.Unlock()
+	}
+	var audit map[string]fileState
+	if d.opts != nil && d.opts.scratch != "" {
+		audit = auditFiles(t, d.opts.auditRoot, d.opts.scratch)
+	}
+	captured := &captureBuffer{}
+	d.Out = captured
+	actual := func() string {
+		if mode != 0 {
+			restore, err := redirectStdio(captured)
+			if err != nil {
+				d.Fatalf(t, "%v", err)
+			}
+			defer restore()
+			// Send writes to d.Out through the redirected os.Stdout, so
+			// that they are ordered with respect to the other writes.
+			d.Out = os.Stdout
+		}
+		return f(t, d)
+	}()
+	if audit != nil {
+		if changed := changedFiles(audit, auditFiles(t, d.opts.auditRoot, d.opts.scratch)); len(changed) > 0 {
+			d.Fatalf(t, "files changed outside the scratch directory:\n%s", strings.Join(changed, "\n"))
+		}
+	}
+	actual = combineCaptured(mode, actual, captured.String())
+	return ensureNewline(actual)
+}
+
 // Walk goes through all the files in a subdirectory, creating subtests to match
 // the file hierarchy; for each "leaf" file, the given function is called.
 //
@@ -372,71 +1113,196 @@ func runDirective(t *testing.T, r *testDataReader, f func(*testing.T, *TestData)
 //   If path is "testdata", the function is called three times, in subtest
 //   hierarchy /typing, /logprops/scan, /logprops/select.
 //
-func Walk(t *testing.T, path string, f func(t *testing.T, path string)) {
+// The path is resolved in the same way as by RunTest. The files and
+// directories which are visited can be restricted with the WalkFilter,
+// ExcludeGlob, MaxDepth and Extensions options, and the files can be
+// dispatched to different functions depending on their extension with the
+// ExtensionHandler option. By default, Walk skips hidden files (whose name starts
+// with a dot), follows symbolic links, and fails on broken symbolic links;
+// see WalkHiddenFiles, SkipSymlinks and IgnoreBrokenSymlinks. Symbolic links
+// to a directory being walked are not followed, to avoid cycles. The other
+// options are ignored.
+//
+// With the -datadriven-watch flag, Walk then keeps watching the files for
+// changes, and calls the function again (in a new subtest) for every file
+// which is created or modified, until the test binary is interrupted.
+//
+func Walk(t *testing.T, path string, f func(t *testing.T, path string), opts ...Option) {
+	o := makeOptions(opts)
+	if err := o.validate(); err != nil {
+		t.Fatal(err)
+	}
+	path = o.resolvePath(path)
+	o.walkRoot = path
+	if o.progressInterval > 0 {
+		// The progress is stopped once all the files are completed, which
+		// happens after walk returns when they are run in parallel.
+		if n := countWalkFiles(path, &o, nil /* ancestors */); n > 0 {
+			o.progress = startProgress(t, n, o.progressInterval)
+		}
+	}
+	func() {
+		if p := o.progress; p != nil && (!o.parallel || *watchFlag) {
+			defer p.stop()
+		}
+		walk(t, path, f, &o, nil /* ancestors */)
+	}()
+	if *watchFlag {
+		watch(t, path, f, &o, watchInterval, nil /* stop */)
+	}
+}
+
+// walk implements Walk. ancestors are the resolved paths of the
+// directories being walked, used to detect cycles of symbolic links.
+func walk(
+	t *testing.T, path string, f func(t *testing.T, path string), o *options, ancestors []string,
+) {
 	finfo, err := os.Stat(path)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if !finfo.IsDir() {
-		f(t, path)
+		if o.progress != nil {
+			defer o.progress.filesDone(1)
+		}
+		if o.parallel && !*watchFlag {
+			start := time.Now()
+			defer func() {
+				if !t.Failed() && !t.Skipped() {
+					saveDuration(t, path, time.Since(start))
+				}
+			}()
+		}
+		o.walkHandler(f, path)(t, path)
 		return
 	}
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		for _, a := range ancestors {
+			if a == real {
+				t.Skipf("%s: not following symbolic link to %s, which is being walked", path, real)
+			}
+		}
+		ancestors = append(ancestors[:len(ancestors):len(ancestors)], real)
+	}
 	files, err := ioutil.ReadDir(path)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if o.parallel && !*watchFlag {
+		scheduleFiles(path, files)
+	}
 	for _, file := range files {
-		if tempFileRe.MatchString(file.Name()) {
-			// Temp or hidden file, don't even try processing.
+		file := file
+		p := filepath.Join(path, file.Name())
+		if !o.walkIncludes(p, file) {
 			continue
 		}
-		t.Run(file.Name(), func(t *testing.T) {
-			Walk(t, filepath.Join(path, file.Name()), f)
+		if file.Mode()&os.ModeSymlink != 0 {
+			if o.skipSymlinks {
+				continue
+			}
+			if _, err := os.Stat(p); err != nil {
+				if o.ignoreBrokenSymlinks {
+					continue
+				}
+				t.Fatalf("%s: broken symbolic link: %v", p, err)
+			}
+		}
+		name := file.Name()
+		if o.subtestName != nil {
+			name = o.subtestName(p)
+		}
+		// started is set if the subtest is run, i.e. not filtered out by
+		// -run.
+		started := false
+		t.Run(sanitizeSubtestName(name), func(t *testing.T) {
+			started = true
+			if o.parallel && !file.IsDir() && !*watchFlag {
+				t.Parallel()
+			}
+			if o.failFast {
+				if atomic.LoadInt32(&o.walkFailed) != 0 {
+					if o.progress != nil {
+						o.progress.filesSkipped(countWalkFiles(p, o, ancestors))
+					}
+					t.Skipf("%s: skipped after an earlier failure", p)
+				}
+				defer func() {
+					if t.Failed() {
+						atomic.StoreInt32(&o.walkFailed, 1)
+					}
+				}()
+			}
+			if !file.IsDir() && strings.HasSuffix(file.Name(), skipSuffix) {
+				t.Skipf("%s: skipping file with %s suffix", p, skipSuffix)
+			}
+			walk(t, p, f, o, ancestors)
 		})
+		if !started && o.progress != nil {
+			o.progress.filesSkipped(countWalkFiles(p, o, ancestors))
+		}
 	}
 }
 
-func ClearResults(path string) error {
-	file, err := os.OpenFile(path, os.O_RDWR, 0644 /* irrelevant */)
+// ClearResults removes the expected results of the directives of the test
+// file at the given path, leaving only their separator, e.g. to regenerate
+// them with -rewrite. The file is only parsed, not run. The options are
+// those the test file is run with, as for Parse.
+func ClearResults(path string, opts ...Option) error {
+	finfo, err := os.Stat(path)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		_ = file.Close()
-	}()
-	finfo, err := file.Stat()
+	if finfo.IsDir() {
+		return errors.Newf("%s is a directory, not a file", path)
+	}
+	src, err := ioutil.ReadFile(path)
 	if err != nil {
 		return err
 	}
-
-	if finfo.IsDir() {
-		return errors.Newf("%s is a directory, not a file", path)
+	f, err := Parse(path, src, opts...)
+	if err != nil {
+		return err
 	}
-
-	runTestInternal(
-		&testing.T{}, path, file,
-		func(t *testing.T, d *TestData) string { return "" },
-		true, /* rewrite */
-	)
-
-	return nil
+	o := makeOptions(opts)
+	for _, d := range f.Directives() {
+		if d.Expected.Text == "" {
+			continue
+		}
+		eol := "\n"
+		if strings.HasPrefix(d.Expected.Text, o.separator+"\r\n") {
+			eol = "\r\n"
+		}
+		d.Expected.Text = o.separator + eol
+	}
+	return ioutil.WriteFile(path, Format(f), finfo.Mode())
 }
 
-// Ignore files named .XXXX, XXX~ or #XXX#.
-var tempFileRe = regexp.MustCompile(`(^\..*)|(.*~$)|(^#.*#$)`)
+// skipSuffix is the suffix of the names of the test files which Walk skips.
+const skipSuffix = ".skip"
+
+// Ignore files named XXX~ or #XXX#, and the XXX.<line>.got and
+// XXX.<line>.want files written with -datadriven-got-want. Files named
+// .XXXX are ignored unless the WalkHiddenFiles option is used.
+var tempFileRe = regexp.MustCompile(`(.*~$)|(^#.*#$)|(\.[0-9]+\.(got|want)$)`)
 
 // TestData contains information about one data-driven test case that was
 // parsed from the test file.
 type TestData struct {
-	// Pos is a file:line prefix for the input test file, suitable for
-	// inclusion in logs and error messages.
-	Pos string
+	// Pos is the position of the directive in the input test file. It
+	// renders as a file:line prefix, suitable for inclusion in logs and
+	// error messages.
+	Pos Pos
+
+	// Config is the configuration the test file is being run under, if the
+	// file starts with a config directive.
+	Config string
 
 	// Cmd is the first string on the directive line (up to the first whitespace).
 	Cmd string
 
 	// CmdArgs contains the k/v arguments to the command.
-	CmdArgs []CmdArg
+	CmdArgs CmdArgs
 
 	// Input is the text between the first directive line and the ---- separator.
 	Input string
@@ -446,16 +1312,158 @@ type TestData struct {
 	// This field is provided so that a test can perform an early return
 	// with "return d.Expected" to signal that nothing has changed.
 	Expected string
+
+	// Raw describes the text of the directive in the test file, as it
+	// was before any processing.
+	Raw RawDirective
+
+	// Out is a writer available to the test function. Anything written to
+	// it is appended to the output of the directive (or replaces it, when
+	// using CaptureOutput(CaptureReplace)).
+	Out io.Writer
+
+	// cmdArgsRewritten is set if RewriteCmdArgs was called, until the
+	// directive line is rewritten.
+	cmdArgsRewritten bool
+	// replacement is set if ReplaceDirective was called.
+	replacement *directiveSpec
+	// enqueued are the directives generated with Enqueue.
+	enqueued []directiveSpec
+
+	// Rewrite is set if the expected output is being rewritten, with
+	// -rewrite, -datadriven-rewrite-stdout or -datadriven-interactive,
+	// rather than compared with the actual output. Test functions can use
+	// it to skip expensive work when the output is compared, or to produce
+	// more thorough output when it is regenerated.
+	Rewrite bool
+
+	// line is the directive line, with continuations joined.
+	line string
+	// foreach holds the variables of the foreach directive preceding this
+	// directive, if any.
+	foreach []foreachVar
+	// file is the name of the file the directive was read from.
+	file string
+	// opts are the options the test is run with.
+	opts *options
+	// value is the result of the directive, if it was run by
+	// RunTestStructured and produced a structured value.
+	value    interface{}
+	hasValue bool
+	// mungers are the mungers registered for this directive by the test
+	// function.
+	mungers []munger
+	// expectedUnknown is set for the directives of a macro, whose expected
+	// output is not known separately from that of the macro invocation.
+	expectedUnknown bool
+	// macro is the macro invoked by this directive, if any.
+	macro *macro
+	// inputLine is the line number of the first non-blank line of the
+	// input, or zero if there is no input.
+	inputLine int
+	// logs are the messages recorded with Logf. It is shared with the
+	// directives derived from this one by foreach and macros.
+	logs *[]string
+	// failed is set by Fatalf and Errorf, so that the failure of the
+	// directive is known even if the test already failed, with KeepGoing.
+	// It is shared with the directives derived from this one.
+	failed *bool
+	// artifacts are the artifacts of the Result of the directive, if any.
+	artifacts map[string][]byte
+	// wrap is the width at which the output is wrapped, or 0.
+	wrap int
+	// alternatives are the alternative expected outputs of the directive,
+	// which are accepted in addition to Expected.
+	alternatives []string
+	// argPos are the positions of the arguments on the directive line,
+	// keyed by the first occurrence of each key.
+	argPos map[string]Pos
+}
+
+// Logf formats its arguments and records the message for the current
+// directive. The messages are only logged, prefixed with the position of
+// the directive, if the directive fails or the test is run with -v. This
+// allows test functions to leave diagnostics in place without cluttering
+// the output of passing runs.
+func (td *TestData) Logf(format string, args ...interface{}) {
+	if td.logs == nil {
+		td.logs = &[]string{}
+	}
+	*td.logs = append(*td.logs, fmt.Sprintf(format, args...))
+}
+
+// AddMunger registers a transformation which is applied to the output of
+// the current directive, after the mungers registered with the Munger
+// option. The name identifies the munger in traces. For a directive
+// generated by foreach or a macro, the munger applies to the output of that
+// directive only, before it is combined with the output of the others.
+func (td *TestData) AddMunger(name string, fn func(string) string) {
+	td.mungers = append(td.mungers, munger{name: name, fn: fn})
+}
+
+// RawDirective describes the sections of the text of a directive in a test
+// file.
+type RawDirective struct {
+	// CmdLine is the directive line, including continuation lines.
+	CmdLine Section
+	// Input is the input to the command, between the directive line and the
+	// separator.
+	Input Section
+	// Expected is the expected output, following the separator. It
+	// includes the closing separators of the double separator syntax, but
+	// not the blank line terminating the expected output.
+	Expected Section
 }
 
-// HasArg checks whether the CmdArgs array contains an entry for the given key.
+// Section is a range of the text of a test file.
+type Section struct {
+	// Text is the raw text of the section, including line terminators.
+	Text string
+	// Line is the line number of the first line of the section.
+	Line int
+	// Offset and EndOffset are the byte offsets of the start and end of the
+	// section in the test file.
+	Offset, EndOffset int
+}
+
+// HasArg checks whether the CmdArgs array contains an entry for the given key,
+// whatever its value: it returns true for key=false as well as for a bare
+// key. Boolean arguments are read with ArgBool instead, as is done for the
+// arguments interpreted by the framework, e.g. pending or sort-output.
 func (td *TestData) HasArg(key string) bool {
-	for i := range td.CmdArgs {
-		if td.CmdArgs[i].Key == key {
-			return true
-		}
+	_, ok := td.GetArg(key)
+	return ok
+}
+
+// ArgBool returns the value of a boolean argument: false if it is absent,
+// true if it is given without a value (a bare key), and its value otherwise,
+// which must be one of true, false, 1, 0, yes or no. A fatal error results
+// if the value is invalid.
+func (td *TestData) ArgBool(t *testing.T, key string) bool {
+	t.Helper()
+	if !td.HasArg(key) {
+		return false
+	}
+	var b bool
+	td.ScanArgs(t, key, &b)
+	return b
+}
+
+// GetArg returns the first CmdArg matching the given key, and whether it
+// exists.
+func (td *TestData) GetArg(key string) (CmdArg, bool) {
+	return td.CmdArgs.Get(key)
+}
+
+// ArgValue returns the value at index i of the first CmdArg matching the
+// given key. The boolean is false if the arg does not exist or does not
+// have a value at that index.
+func (td *TestData) ArgValue(key string, i int) (string, bool) {
+	arg, ok := td.GetArg(key)
+	if !ok || i < 0 || i >= len(arg.Vals) {
+		return "", false
 	}
-	return false
+	return arg.Vals[i], true
 }
 
 // ScanArgs looks up the first CmdArg matching the given key and scans it into
@@ -475,24 +1483,40 @@ func (td *TestData) HasArg(key string) bool {
 // td.ScanArgs(t, "arg1", &i1)
 // td.ScanArgs(t, "arg2", &s)
 // td.ScanArgs(t, "arg3", &i2, &i3, &i4)
+//
+// The supported destinations are pointers to strings, booleans, integers,
+// floating-point numbers, time.Duration (e.g. 3m30s) and time.Time, from
+// RFC 3339 timestamps (e.g. 2024-01-01T00:00:00Z), net.IP, net.IPNet (from
+// CIDR notation), url.URL (from absolute URLs) and, with Go 1.18 or later,
+// netip.Addr, netip.Prefix and netip.AddrPort. Numbers may be negative,
+// use a base prefix (0x10), separate digits with underscores (1_000_000)
+// and use scientific notation (1e6), including for integers as long as
+// their value is integral. Integers may also be given as byte sizes with a
+// decimal or binary unit, e.g. 64KiB or 1.5GB. Booleans are true, false, 1,
+// 0, yes or no; a bare key (without a value) scans as true into a single
+// boolean destination.
 func (td *TestData) ScanArgs(t *testing.T, key string, dests ...interface{}) {
 	t.Helper()
-	var arg CmdArg
-	for i := range td.CmdArgs {
-		if td.CmdArgs[i].Key == key {
-			arg = td.CmdArgs[i]
-			break
-		}
+	arg, ok := td.GetArg(key)
+	if !ok {
+		td.Fatalf(t, "missing argument: %s", key)
 	}
-	if arg.Key == "" {
-		t.Fatalf("missing argument: %s", key)
+	if len(arg.Vals) == 0 && len(dests) == 1 {
+		if b, ok := dests[0].(*bool); ok {
+			// A bare key is true.
+			*b = true
+			return
+		}
 	}
 	if len(dests) != len(arg.Vals) {
-		t.Fatalf("%s: got %d destinations, but %d values", arg.Key, len(dests), len(arg.Vals))
+		t.Fatalf("%s: %s: got %d destinations, but %d values",
+			td.ArgPos(key), arg.Key, len(dests), len(arg.Vals))
 	}
 
 	for i := range dests {
-		arg.Scan(t, i, dests[i])
+		if err := scanValue(arg.Vals[i], dests[i]); err != nil {
+			t.Fatalf("%s: %s: destination #%d: %v", td.ArgPos(key), arg.Key, i+1, err)
+		}
 	}
 }
 
@@ -506,6 +1530,112 @@ type CmdArg struct {
 	Vals []string
 }
 
+// CmdArgs is the list of arguments on a directive line, in the order in
+// which they appear. It can be used as an ordered map from keys to
+// arguments; for example, a handler can Remove the arguments it knows
+// about and then verify that no arguments remain.
+type CmdArgs []CmdArg
+
+// Get returns the first argument with the given key, and whether it exists.
+func (a CmdArgs) Get(key string) (CmdArg, bool) {
+	for i := range a {
+		if a[i].Key == key {
+			return a[i], true
+		}
+	}
+	return CmdArg{}, false
+}
+
+// Keys returns the distinct keys of the arguments, in order of their first
+// occurrence.
+func (a CmdArgs) Keys() []string {
+	var keys []string
+	seen := make(map[string]bool, len(a))
+	for i := range a {
+		if !seen[a[i].Key] {
+			seen[a[i].Key] = true
+			keys = append(keys, a[i].Key)
+		}
+	}
+	return keys
+}
+
+// Duplicates returns the keys which occur more than once, in order of their
+// first occurrence.
+func (a CmdArgs) Duplicates() []string {
+	var dups []string
+	count := make(map[string]int, len(a))
+	for i := range a {
+		count[a[i].Key]++
+		if count[a[i].Key] == 2 {
+			dups = append(dups, a[i].Key)
+		}
+	}
+	return dups
+}
+
+// Remove removes all the arguments with the given key, and returns the
+// first of them. The boolean is false if there was no such argument.
+func (a *CmdArgs) Remove(key string) (CmdArg, bool) {
+	var removed CmdArg
+	var found bool
+	res := (*a)[:0]
+	for _, arg := range *a {
+		if arg.Key != key {
+			res = append(res, arg)
+		} else if !found {
+			removed, found = arg, true
+		}
+	}
+	*a = res
+	return removed, found
+}
+
+// RewriteCmdArgs replaces the arguments of the directive. When rewriting,
+// the directive line is updated accordingly in the test file, which allows
+// migrating the arguments of a directive across all the test files:
+//
+//   if arg, ok := d.CmdArgs.Remove("old-name"); ok {
+//     arg.Key = "new-name"
+//     d.RewriteCmdArgs(append(d.CmdArgs, arg))
+//   }
+//
+// The directive line is written on a single line, with the arguments as
+// given. Values left unchanged by the test function are written as they
+// appear in the test file, before the expansions of e.g. ExpandEnv and
+// ArgsFromFiles. It is not updated for the directives generated by foreach
+// and macros. See also MigrateArgs.
+func (td *TestData) RewriteCmdArgs(args CmdArgs) {
+	td.CmdArgs = args
+	td.cmdArgsRewritten = true
+}
+
+// ReplaceDirective replaces the directive with the given one in the test
+// file when rewriting, and has no effect otherwise. This allows deprecated
+// directives to rewrite themselves into their successors across all the
+// test files:
+//
+//   case "old-cmd":
+//     d.ReplaceDirective("new-cmd", d.CmdArgs, d.Input)
+//     return runOldCmd(d)
+//
+// When rewriting, the test function is then invoked again for the
+// replacement, whose output becomes the expected output. The replacement is
+// written with its directive line on a single line, and with unchanged
+// values and input in their unexpanded form, as for RewriteCmdArgs. It is
+// not applied to the directives generated by foreach and macros.
+func (td *TestData) ReplaceDirective(cmd string, args CmdArgs, input string) {
+	td.replacement = &directiveSpec{cmd: cmd, args: args, input: input}
+}
+
+func (a CmdArgs) String() string {
+	strs := make([]string, len(a))
+	for i := range a {
+		strs[i] = a[i].String()
+	}
+	return "[" + strings.Join(strs, " ") + "]"
+}
+
 func (arg CmdArg) String() string {
 	switch len(arg.Vals) {
 	case 0:
@@ -521,43 +1651,126 @@ func (arg CmdArg) String() string {
 
 // Scan attempts to parse the value at index i into the dest.
 func (arg CmdArg) Scan(t *testing.T, i int, dest interface{}) {
+	t.Helper()
+	if b, ok := dest.(*bool); ok && i == 0 && len(arg.Vals) == 0 {
+		// A bare key is true.
+		*b = true
+		return
+	}
 	if i < 0 || i >= len(arg.Vals) {
 		t.Fatalf("cannot scan index %d of key %s", i, arg.Key)
 	}
-	val := arg.Vals[i]
+	if err := scanValue(arg.Vals[i], dest); err != nil {
+		t.Fatalf("%s: destination #%d: %v", arg.Key, i+1, err)
+	}
+}
+
+// scanValue parses val into dest, which must be a pointer to one of the
+// supported types.
+func scanValue(val string, dest interface{}) error {
 	switch dest := dest.(type) {
 	case *string:
 		*dest = val
 	case *int:
-		n, err := strconv.ParseInt(val, 10, 64)
+		n, err := parseInt(val, 64)
 		if err != nil {
-			t.Fatal(err)
+			return err
 		}
 		*dest = int(n) // assume 64bit ints
+	case *int64:
+		n, err := parseInt(val, 64)
+		if err != nil {
+			return err
+		}
+		*dest = n
+	case *int32:
+		n, err := parseInt(val, 32)
+		if err != nil {
+			return err
+		}
+		*dest = int32(n)
+	case *uint:
+		n, err := parseUint(val, 64)
+		if err != nil {
+			return err
+		}
+		*dest = uint(n)
 	case *uint64:
-		n, err := strconv.ParseUint(val, 10, 64)
+		n, err := parseUint(val, 64)
 		if err != nil {
-			t.Fatal(err)
+			return err
 		}
 		*dest = n
+	case *uint32:
+		n, err := parseUint(val, 32)
+		if err != nil {
+			return err
+		}
+		*dest = uint32(n)
+	case *float64:
+		f, err := parseFloat(val, 64)
+		if err != nil {
+			return err
+		}
+		*dest = f
+	case *float32:
+		f, err := parseFloat(val, 32)
+		if err != nil {
+			return err
+		}
+		*dest = float32(f)
+	case *time.Duration:
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return errors.Newf("invalid duration: %q", val)
+		}
+		*dest = d
+	case *time.Time:
+		ts, err := time.Parse(time.RFC3339Nano, val)
+		if err != nil {
+			return errors.Newf("invalid RFC 3339 timestamp: %q", val)
+		}
+		*dest = ts
 	case *bool:
-		b, err := strconv.ParseBool(val)
+		b, err := parseBool(val)
 		if err != nil {
-			t.Fatal(err)
+			return err
 		}
 		*dest = b
 	default:
-		t.Fatalf("unsupported type %T for destination #%d (might be easy to add it)", dest, i+1)
+		for _, scan := range extraScanners {
+			if ok, err := scan(val, dest); ok {
+				return err
+			}
+		}
+		return errors.Newf("unsupported type %T (might be easy to add it)", dest)
 	}
+	return nil
 }
 
 // Fatalf wraps a fatal testing error with test file position information, so
 // that it's easy to locate the source of the error.
 func (td TestData) Fatalf(tb testing.TB, format string, args ...interface{}) {
 	tb.Helper()
+	td.markFailed()
 	tb.Fatalf("%s: %s", td.Pos, fmt.Sprintf(format, args...))
 }
 
+// Errorf is like Fatalf, but does not stop the test function. The directive
+// still fails, and its output is not compared with the expected output.
+func (td TestData) Errorf(tb testing.TB, format string, args ...interface{}) {
+	tb.Helper()
+	td.markFailed()
+	tb.Errorf("%s: %s", td.Pos, fmt.Sprintf(format, args...))
+}
+
+// markFailed records that the directive failed.
+func (td TestData) markFailed() {
+	if td.failed != nil {
+		*td.failed = true
+	}
+}
+
 // hasBlankLine returns true iff `s` contains at least one line that's
 // empty or contains only whitespace.
 func hasBlankLine(s string) bool {
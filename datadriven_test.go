@@ -16,13 +16,25 @@ package datadriven
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"text/template"
+	"time"
 
 	"github.com/cockroachdb/errors"
 )
@@ -68,6 +80,26 @@ parse
 xx a=b b=c c=(1,2,3)
 ----
 "xx" [a=b b=c c=(1, 2, 3)]
+
+parse
+xx ${x} k=${env:NAME}/${y} u=http://[::1]:80/p?a=1&b=%20
+----
+"xx" [${x} k=${env:NAME}/${y} u=http://[::1]:80/p?a=1&b=%20]
+
+parse
+xx a$b
+----
+here: cannot parse directive at column 4: xx a$b
+
+parse
+xx {a}=b
+----
+here: cannot parse directive at column 4: xx {a}=b
+
+parse
+xx a:b
+----
+here: cannot parse directive at column 4: xx a:b
 `, func(t *testing.T, d *TestData) string {
 		cmd, args, err := ParseLine(d.Input)
 		if err != nil {
@@ -77,6 +109,42 @@ xx a=b b=c c=(1,2,3)
 	})
 }
 
+func TestParseLineDetailed(t *testing.T) {
+	RunTestFromString(t, `
+parse
+xx  a=b c d=(1,  2) e=
+----
+cmd 1-3 "xx"
+arg 5-8 "a=b": key 5-6 "a", vals [7-8 "b"]
+arg 9-10 "c": key 9-10 "c", vals []
+arg 11-20 "d=(1,  2)": key 11-12 "d", vals [14-15 "1" 18-19 "2"]
+arg 21-23 "e=": key 21-22 "e", vals [23-23 ""]
+
+parse
+xx a=+++ b=(
+----
+error: cannot parse directive at column 10: xx a=+++ b=(
+`, func(t *testing.T, d *TestData) string {
+		p, err := ParseLineDetailed(d.Input)
+		if err != nil {
+			return "error: " + err.Error() + "\n"
+		}
+		tok := func(tok Token) string {
+			return fmt.Sprintf("%d-%d %q", tok.Start, tok.End, tok.Text)
+		}
+		var buf strings.Builder
+		fmt.Fprintf(&buf, "cmd %s\n", tok(p.Cmd))
+		for _, a := range p.Args {
+			var vals []string
+			for _, v := range a.Vals {
+				vals = append(vals, tok(v))
+			}
+			fmt.Fprintf(&buf, "arg %s: key %s, vals [%s]\n", tok(a.Arg), tok(a.Key), strings.Join(vals, " "))
+		}
+		return buf.String()
+	})
+}
+
 func TestSkip(t *testing.T) {
 	RunTestFromString(t, `
 skip
@@ -252,3 +320,4215 @@ func TestRewrite(t *testing.T) {
 		})
 	}
 }
+
+func TestCaseInsensitiveCommands(t *testing.T) {
+	const input = `
+SELECT
+----
+select
+
+Select a=1
+----
+select
+`
+	handler := func(t *testing.T, d *TestData) string {
+		return d.Cmd
+	}
+	RunTestFromString(t, input, handler, CaseInsensitiveCommands())
+
+	rewritten := runTestInternal(
+		t, "<string>", strings.NewReader(input), handler, true /* rewrite */, CaseInsensitiveCommands(),
+	)
+	if expected := strings.ToLower(input); string(rewritten) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, rewritten)
+	}
+}
+
+func TestByteOrderMark(t *testing.T) {
+	RunTestFromString(t, "\ufeffcmd\n----\ncmd\n", func(t *testing.T, d *TestData) string {
+		return d.Cmd
+	})
+}
+
+func TestIndentationPolicy(t *testing.T) {
+	input := "cmd\na\n\tx\n  \ty\n----\na\n    x\n    y\n"
+	RunTestFromString(t, input, func(t *testing.T, d *TestData) string {
+		return d.Input
+	}, ExpandTabs(4))
+
+	o := makeOptions([]Option{RejectMixedIndentation()})
+	if _, err := o.normalizeIndentText("a\n \tb\n"); err == nil || err.Error() != "line 2: mixed tabs and spaces in indentation" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestMarkTrailingWhitespace(t *testing.T) {
+	const input = `
+cmd
+a  
+b
+c¶
+----
+a  ¶
+b
+c¶¶
+`
+	handler := func(t *testing.T, d *TestData) string {
+		return d.Input
+	}
+	RunTestFromString(t, input, handler, MarkTrailingWhitespace())
+
+	rewritten := runTestInternal(
+		t, "<string>", strings.NewReader(input), handler, true /* rewrite */, MarkTrailingWhitespace(),
+	)
+	if string(rewritten) != input {
+		t.Errorf("expected:\n%s\ngot:\n%s", input, rewritten)
+	}
+}
+
+func TestSeparator(t *testing.T) {
+	if os.Getenv("DATADRIVEN_TEST_CHILD") != "" {
+		RunTestFromString(t, "cmd\n----\n", func(t *testing.T, d *TestData) string {
+			return ""
+		}, Separator(""))
+		return
+	}
+	const input = `
+cmd
+----
+====
+----
+
+cmd
+a
+
+b
+====
+====
+a
+
+b
+====
+====
+`
+	handler := func(t *testing.T, d *TestData) string {
+		return d.Input
+	}
+	RunTestFromString(t, input, handler, Separator("===="))
+
+	rewritten := runTestInternal(
+		t, "<string>", strings.NewReader(input), handler, true /* rewrite */, Separator("===="),
+	)
+	if string(rewritten) != input {
+		t.Errorf("expected:\n%s\ngot:\n%s", input, rewritten)
+	}
+
+	// An empty separator fails the test, or is returned as an error.
+	if out := runChild(t, "TestSeparator"); !strings.Contains(out, "the separator cannot be empty") {
+		t.Errorf("expected the empty separator to be reported:\n%s", out)
+	}
+	if _, err := Parse("test", []byte("cmd\n----\n"), Separator("")); err == nil ||
+		err.Error() != "the separator cannot be empty" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	const path = "testdata/config"
+	handler := func(t *testing.T, d *TestData) string {
+		switch d.Cmd {
+		case "echo":
+			return d.Input
+		case "which":
+			return d.Config
+		case "which-blank":
+			return fmt.Sprintf("%s\n\n%s", d.Config, d.Config)
+		case "only-b":
+			if d.Config == "b" {
+				return d.Config
+			}
+			return ""
+		default:
+			t.Fatalf("unknown directive: %s", d.Cmd)
+			return ""
+		}
+	}
+	RunTest(t, path, handler, BuiltinDirectives())
+
+	t.Run("rewrite", func(t *testing.T) {
+		expected, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rewritten := runTestInternal(t, path, bytes.NewReader(expected), handler, true /* rewrite */, BuiltinDirectives())
+		if string(rewritten) != string(expected) {
+			t.Errorf("expected:\n%s\ngot:\n%s", expected, rewritten)
+		}
+	})
+}
+
+func TestForeach(t *testing.T) {
+	RunTestFromString(t, `
+foreach x=(1, 2) y=(a, b)
+make n=${x} s=${y}
+input ${x}${y}
+----
+[x=1 y=a]
+make 1 a input 1a
+[x=1 y=b]
+make 1 b input 1b
+[x=2 y=a]
+make 2 a input 2a
+[x=2 y=b]
+make 2 b input 2b
+
+foreach z=hello
+${z}
+----
+[z=hello]
+hello
+`, func(t *testing.T, d *TestData) string {
+		if d.Cmd != "make" {
+			return d.Cmd
+		}
+		var n int
+		var s string
+		d.ScanArgs(t, "n", &n)
+		d.ScanArgs(t, "s", &s)
+		return fmt.Sprintf("%s %d %s %s", d.Cmd, n, s, d.Input)
+	}, BuiltinDirectives())
+
+	// The generated directives are normalized as those of the test file.
+	RunTestFromString(t, `
+macro greet name
+Say ${name}
+----
+
+foreach c=(Say, greet)
+${c} name=world
+----
+[c=Say]
+say name=world
+[c=greet]
+say world
+`, func(t *testing.T, d *TestData) string {
+		return d.Cmd + " " + d.CmdArgs[0].String()
+	}, CaseInsensitiveCommands(), BuiltinDirectives())
+
+	// Without BuiltinDirectives, foreach is an ordinary directive.
+	RunTestFromString(t, `
+foreach x=(1, 2)
+----
+foreach x=(1, 2)
+`, func(t *testing.T, d *TestData) string {
+		return d.Cmd + " " + d.CmdArgs[0].String()
+	})
+}
+
+func TestMacro(t *testing.T) {
+	RunTest(t, "testdata/macro/test", func(t *testing.T, d *TestData) string {
+		switch d.Cmd {
+		case "put":
+			return fmt.Sprintf("put %s %s", d.CmdArgs[0].Vals[0], d.Input)
+		case "say":
+			if d.CmdArgs[0].Key == "set" {
+				return "set " + d.CmdArgs[1].Key
+			}
+			return "hello " + d.CmdArgs[0].Key
+		default:
+			t.Fatalf("unknown directive: %s", d.Cmd)
+			return ""
+		}
+	}, BuiltinDirectives())
+}
+
+func TestTemplateInput(t *testing.T) {
+	RunTestFromString(t, `
+echo
+{{.Name}} {{repeat "ab" 3}}
+----
+monkey ababab
+`, func(t *testing.T, d *TestData) string {
+		return d.Input
+	}, TemplateInput(
+		struct{ Name string }{Name: "monkey"},
+		template.FuncMap{"repeat": strings.Repeat},
+	))
+}
+
+func TestExpandEnv(t *testing.T) {
+	if err := os.Setenv("DATADRIVEN_TEST_VAR", "banana"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Unsetenv("DATADRIVEN_TEST_VAR") }()
+
+	RunTestFromString(t, `
+eat fruit=${env:DATADRIVEN_TEST_VAR}
+a ${env:DATADRIVEN_TEST_VAR} a day
+----
+banana
+a banana a day
+`, func(t *testing.T, d *TestData) string {
+		var fruit string
+		d.ScanArgs(t, "fruit", &fruit)
+		return fruit + "\n" + d.Input
+	}, ExpandEnv())
+
+	// The values are substituted after parsing, so they may contain spaces
+	// and special characters, and they are not expanded again when the
+	// directive is invoked a second time.
+	if err := os.Setenv("DATADRIVEN_TEST_VAR2", "two words? ${env:DATADRIVEN_TEST_VAR}"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Unsetenv("DATADRIVEN_TEST_VAR2") }()
+
+	RunTestFromString(t, `
+say what=${env:DATADRIVEN_TEST_VAR2}
+${env:DATADRIVEN_TEST_VAR2}
+----
+two words? ${env:DATADRIVEN_TEST_VAR}
+two words? ${env:DATADRIVEN_TEST_VAR}
+`, func(t *testing.T, d *TestData) string {
+		var what string
+		d.ScanArgs(t, "what", &what)
+		return what + "\n" + d.Input
+	}, ExpandEnv(), CheckDeterminism())
+}
+
+func TestArgsFromFiles(t *testing.T) {
+	RunTest(t, "testdata/args-from-files/test", func(t *testing.T, d *TestData) string {
+		var buf bytes.Buffer
+		for _, arg := range d.CmdArgs {
+			fmt.Fprintf(&buf, "%s: %s\n", arg.Key, arg.Vals[0])
+		}
+		return buf.String()
+	}, ArgsFromFiles(), CheckDeterminism())
+}
+
+func TestLineContinuation(t *testing.T) {
+	RunTestFromString(t, `
+make a=1 \
+  b=2 \
+  c=(3, 4)
+input
+----
+make [a=1 b=2 c=(3, 4)] input
+`, func(t *testing.T, d *TestData) string {
+		return fmt.Sprintf("%s %v %s", d.Cmd, d.CmdArgs, d.Input)
+	})
+}
+
+func TestIndentedArgs(t *testing.T) {
+	RunTestFromString(t, `
+make a=1
+  b=2
+	c=(3, 4) d
+input
+  indented input
+----
+make [a=1 b=2 c=(3, 4) d] input
+  indented input
+`, func(t *testing.T, d *TestData) string {
+		return fmt.Sprintf("%s %v %s", d.Cmd, d.CmdArgs, d.Input)
+	}, IndentedArgs())
+}
+
+func TestGetArg(t *testing.T) {
+	RunTestFromString(t, `
+lookup a=1 b=(2, 3) c
+----
+a: [1] true
+b: [2 3] true
+c: [] true
+d: [] false
+b[1]: 3 true
+b[2]:  false
+d[0]:  false
+`, func(t *testing.T, d *TestData) string {
+		var buf bytes.Buffer
+		for _, key := range []string{"a", "b", "c", "d"} {
+			arg, ok := d.GetArg(key)
+			fmt.Fprintf(&buf, "%s: %v %t\n", key, arg.Vals, ok)
+		}
+		for _, key := range []string{"b[1]", "b[2]", "d[0]"} {
+			i := int(key[2] - '0')
+			val, ok := d.ArgValue(key[:1], i)
+			fmt.Fprintf(&buf, "%s: %s %t\n", key, val, ok)
+		}
+		return buf.String()
+	})
+}
+
+func TestCmdArgs(t *testing.T) {
+	RunTestFromString(t, `
+consume a=1 b=2 a=3 c d=(4, 5) c
+----
+keys: [a b c d]
+duplicates: [a c]
+removed: a=1
+remaining: [b=2 c d=(4, 5) c]
+`, func(t *testing.T, d *TestData) string {
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "keys: %v\n", d.CmdArgs.Keys())
+		fmt.Fprintf(&buf, "duplicates: %v\n", d.CmdArgs.Duplicates())
+		args := append(CmdArgs(nil), d.CmdArgs...)
+		if arg, ok := args.Remove("a"); ok {
+			fmt.Fprintf(&buf, "removed: %s\n", arg)
+		}
+		if _, ok := args.Remove("e"); ok {
+			t.Fatal("unexpectedly removed e")
+		}
+		fmt.Fprintf(&buf, "remaining: %s\n", args)
+		return buf.String()
+	})
+}
+
+func TestScanInputLine(t *testing.T) {
+	RunTestFromString(t, `
+sum
+
+a 1 true
+b 2 false
+c 3 true
+----
+a+c=4
+`, func(t *testing.T, d *TestData) string {
+		var names []string
+		var total int
+		for i := range d.InputLines() {
+			var name string
+			var n int
+			var include bool
+			d.ScanInputLine(t, i, &name, &n, &include)
+			if include {
+				names = append(names, name)
+				total += n
+			}
+		}
+		if pos := d.inputPos(2).String(); pos != "<string>:6" {
+			t.Errorf("unexpected position of input line: %s", pos)
+		}
+		return fmt.Sprintf("%s=%d", strings.Join(names, "+"), total)
+	})
+}
+
+func TestInputCSV(t *testing.T) {
+	RunTestFromString(t, `
+csv
+a,"b,c",d
+"e ""quoted""",f
+----
+[a b,c d]
+[e "quoted" f]
+
+tsv
+a	b c	d
+----
+[a b c d]
+`, func(t *testing.T, d *TestData) string {
+		var records [][]string
+		if d.Cmd == "csv" {
+			records = d.InputCSV(t)
+		} else {
+			records = d.InputDelimited(t, '\t')
+		}
+		var buf bytes.Buffer
+		for _, r := range records {
+			fmt.Fprintf(&buf, "%v\n", r)
+		}
+		return buf.String()
+	})
+}
+
+func TestUnmarshalInput(t *testing.T) {
+	type point struct {
+		X int `json:"x" yaml:"x"`
+		Y int `json:"y" yaml:"y"`
+	}
+	RunTestFromString(t, `
+json
+{"x": 1, "y": 2}
+----
+{1 2}
+
+yaml
+x: 3
+y: 4
+----
+{3 4}
+`, func(t *testing.T, d *TestData) string {
+		var p point
+		if d.Cmd == "json" {
+			d.UnmarshalInputJSON(t, &p)
+		} else {
+			d.UnmarshalInputYAML(t, &p)
+		}
+		return fmt.Sprint(p)
+	})
+}
+
+func TestCompareRows(t *testing.T) {
+	RunTestFromString(t, `
+query compare=rows
+----
+name  count
+a     1
+bb    22
+
+query compare=rows-unordered
+----
+ name | count
+------+-------
+ bb   | 22
+ a    | 1
+`, func(t *testing.T, d *TestData) string {
+		if strings.Contains(d.Expected, "|") {
+			return "name | count\n-----+------\na | 1\nbb | 22\n"
+		}
+		return "name count\na 1\nbb 22\n"
+	}, FrameworkArgs())
+
+	for _, tc := range []struct {
+		expected, actual string
+		unordered        bool
+		diff             string
+	}{
+		{"k v\na 1\n", "k v\na 2\n", false, `row 1, column "v": expected "1", found "2"`},
+		{"k v\na 1\nb 2\n", "k v\nb 2\n", false, `row 1, column "k": expected "a", found "b"`},
+		{"k v\na 1\nb 2\n", "k v\nb 2\nc 3\n", true, `missing row: ["a" "1"]` + "\n" + `unexpected row: ["c" "3"]`},
+		{"k | v\n--+--\n- | -\n", "k | v\n--+--\n", false, `row 1: missing row ["-" "-"]`},
+	} {
+		equal, diff := compareRows(tc.expected, tc.actual, tc.unordered)
+		if equal || !strings.Contains(diff, tc.diff) {
+			t.Errorf("expected difference %q, got %q", tc.diff, diff)
+		}
+	}
+}
+
+func TestRunTestStructured(t *testing.T) {
+	type point struct {
+		X, Y int
+		Tags []string
+	}
+	RunTestStructured(t, "testdata/structured", func(t *testing.T, d *TestData) interface{} {
+		switch d.Cmd {
+		case "text":
+			return "plain text"
+		case "none":
+			return nil
+		}
+		var p point
+		d.ScanArgs(t, "x", &p.X)
+		d.ScanArgs(t, "y", &p.Y)
+		if arg, ok := d.GetArg("tags"); ok {
+			p.Tags = arg.Vals
+		}
+		return p
+	})
+
+	d := &TestData{
+		Expected: `{"X": 1, "Y": 2, "Tags": ["a"]}`,
+		value:    point{X: 1, Y: 3, Tags: []string{"a"}},
+		hasValue: true,
+	}
+	if equal, diff := compareValue(d, d.Expected); equal || !strings.Contains(diff, "Y:") {
+		t.Errorf("unexpected diff: %s", diff)
+	}
+
+	d = &TestData{hasValue: true}
+	if equal, diff := compareValue(d, "{}"); equal || diff == "" {
+		t.Errorf("expected a nil value not to match {}")
+	}
+}
+
+func TestMungers(t *testing.T) {
+	RunTestFromString(t, `
+now
+----
+the time is <timestamp>
+
+now shout
+----
+THE TIME IS <TIMESTAMP>
+`, func(t *testing.T, d *TestData) string {
+		if d.HasArg("shout") {
+			d.AddMunger("shout", strings.ToUpper)
+		}
+		return "the time is 12:34:56"
+	}, Munger("timestamps", func(s string) string {
+		return regexp.MustCompile(`\d+:\d+:\d+`).ReplaceAllString(s, "<timestamp>")
+	}))
+
+	// The mungers registered by the directives generated by foreach and
+	// macros apply to their own output.
+	RunTestFromString(t, `
+foreach x=(a, b)
+say ${x} shout=${x}
+----
+[x=a]
+A
+[x=b]
+b
+
+macro twice
+say a shout=a
+
+say b shout=b
+----
+
+twice
+----
+A
+b
+`, func(t *testing.T, d *TestData) string {
+		if v, _ := d.ArgValue("shout", 0); v == "a" {
+			d.AddMunger("shout", strings.ToUpper)
+		}
+		return d.CmdArgs[0].Key
+	}, BuiltinDirectives())
+}
+
+func TestCaptureOutput(t *testing.T) {
+	handler := func(t *testing.T, d *TestData) string {
+		fmt.Println("to stdout")
+		fmt.Fprintln(os.Stderr, "to stderr")
+		fmt.Fprint(d.Out, "to out")
+		return "returned"
+	}
+	RunTestFromString(t, `
+print
+----
+returned
+to stdout
+to stderr
+to out
+`, handler, CaptureOutput(CaptureAppend))
+
+	RunTestFromString(t, `
+print
+----
+to stdout
+to stderr
+to out
+`, handler, CaptureOutput(CaptureReplace))
+}
+
+func TestLogf(t *testing.T) {
+	var logged []string
+	d := &TestData{Pos: Pos{File: "file", Line: 1}}
+	d.Logf("hello %s", "world")
+	d.Logf("%d", 2)
+	for _, msg := range *d.logs {
+		logged = append(logged, msg)
+	}
+	if fmt.Sprint(logged) != "[hello world 2]" {
+		t.Errorf("unexpected messages: %v", logged)
+	}
+
+	RunTestFromString(t, `
+quiet
+----
+ok
+`, func(t *testing.T, d *TestData) string {
+		d.Logf("this message is only shown with -v")
+		return "ok"
+	})
+}
+
+func TestRawDirective(t *testing.T) {
+	const input = `# comment
+cmd a=1 \
+  b=2
+some
+input
+----
+out
+
+double
+----
+----
+first
+
+second
+----
+----
+`
+	var raws []RawDirective
+	RunTestFromString(t, input, func(t *testing.T, d *TestData) string {
+		raws = append(raws, d.Raw)
+		return d.Expected
+	})
+	expected := []RawDirective{
+		{
+			CmdLine:  Section{Text: "cmd a=1 \\\n  b=2\n", Line: 2, Offset: 10, EndOffset: 26},
+			Input:    Section{Text: "some\ninput\n", Line: 4, Offset: 26, EndOffset: 37},
+			Expected: Section{Text: "out\n", Line: 7, Offset: 42, EndOffset: 46},
+		},
+		{
+			CmdLine:  Section{Text: "double\n", Line: 9, Offset: 47, EndOffset: 54},
+			Input:    Section{Line: 10, Offset: 54, EndOffset: 54},
+			Expected: Section{Text: "----\nfirst\n\nsecond\n----\n----\n", Line: 11, Offset: 59, EndOffset: 88},
+		},
+	}
+	if len(raws) != len(expected) {
+		t.Fatalf("expected %d directives, found %d", len(expected), len(raws))
+	}
+	for i := range expected {
+		if raws[i] != expected[i] {
+			t.Errorf("%d: expected %+v, found %+v", i, expected[i], raws[i])
+		}
+		for _, s := range []Section{raws[i].CmdLine, raws[i].Input, raws[i].Expected} {
+			if input[s.Offset:s.EndOffset] != s.Text {
+				t.Errorf("%d: offsets %d-%d do not match text %q", i, s.Offset, s.EndOffset, s.Text)
+			}
+		}
+	}
+}
+
+func TestPos(t *testing.T) {
+	pos := Pos{File: "f", Line: 3, Col: 5}
+	if s := pos.String(); s != "f:3:5" {
+		t.Errorf("unexpected position %s", s)
+	}
+	inMacro := Pos{File: "m", Line: 2, Macro: "mac", Invocation: &pos}
+	if s := inMacro.String(); s != "m:2 (in macro mac invoked at f:3:5)" {
+		t.Errorf("unexpected position %s", s)
+	}
+	if s := inMacro.Location(); s != "m:2" {
+		t.Errorf("unexpected location %s", s)
+	}
+
+	RunTestFromString(t, `
+  cmd a=1 \
+      b=(1, 2) a=3
+----
+<string>:2:7 <string>:3:7 <string>:2
+`, func(t *testing.T, d *TestData) string {
+		return fmt.Sprintf("%s %s %s", d.ArgPos("a"), d.ArgPos("b"), d.ArgPos("c"))
+	})
+
+	RunTestFromString(t, `
+cmd a=1
+  b=2
+----
+<string>:2:5 <string>:3:3
+`, func(t *testing.T, d *TestData) string {
+		return fmt.Sprintf("%s %s", d.ArgPos("a"), d.ArgPos("b"))
+	}, IndentedArgs())
+}
+
+func TestCheckDeterminism(t *testing.T) {
+	calls := 0
+	RunTestFromString(t, `
+stable
+----
+ok
+`, func(t *testing.T, d *TestData) string {
+		calls++
+		d.AddMunger("calls", func(s string) string { return regexp.MustCompile(`\d`).ReplaceAllString(s, "") })
+		return fmt.Sprintf("ok%d", calls)
+	}, CheckDeterminism())
+	if calls != 2 {
+		t.Errorf("expected the test function to be invoked twice, got %d", calls)
+	}
+}
+
+func TestShuffle(t *testing.T) {
+	if os.Getenv("DATADRIVEN_TEST_CHILD") != "" {
+		// The failures of a shuffled file are summarized, and directives
+		// with both the chain and group arguments are rejected.
+		t.Run("keep-going", func(t *testing.T) {
+			RunTestFromString(t, "a\n----\nok\n\nb\n----\nok\n", func(t *testing.T, d *TestData) string {
+				return d.Cmd
+			}, Shuffle(1), KeepGoing())
+		})
+		t.Run("chain-group", func(t *testing.T) {
+			RunTestFromString(t, "a chain=x group=g\n----\nok\n", func(t *testing.T, d *TestData) string {
+				return "ok"
+			}, Shuffle(1), FrameworkArgs())
+		})
+		return
+	}
+	out := runChild(t, "TestShuffle")
+	for _, s := range []string{
+		"2 directives failed",
+		"directives were shuffled with -datadriven-shuffle=1",
+		"the chain and group arguments cannot be combined",
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("expected %q in the output:\n%s", s, out)
+		}
+	}
+
+	const input = `
+a chain=x
+----
+ok
+
+b
+----
+ok
+
+c chain=x
+----
+ok
+
+d
+----
+ok
+
+e chain=x
+----
+ok
+`
+	orders := make(map[string]bool)
+	for seed := int64(1); seed <= 20; seed++ {
+		var order []string
+		RunTestFromString(t, input, func(t *testing.T, d *TestData) string {
+			order = append(order, d.Cmd)
+			return "ok"
+		}, Shuffle(seed), FrameworkArgs())
+		s := strings.Join(order, "")
+		if len(s) != 5 || strings.Index(s, "a") > strings.Index(s, "c") ||
+			strings.Index(s, "c") > strings.Index(s, "e") {
+			t.Fatalf("seed %d: unexpected order %s", seed, s)
+		}
+		orders[s] = true
+	}
+	if len(orders) < 2 {
+		t.Errorf("expected directives to be shuffled, got %v", orders)
+	}
+
+	// The directives of a concurrency group run together, in their group,
+	// and the generated directives run after the directive which generated
+	// them.
+	for seed := int64(1); seed <= 20; seed++ {
+		var mu sync.Mutex
+		var order []string
+		RunTestFromString(t, `
+a group=g
+----
+ok
+
+b group=g
+----
+ok
+
+c
+----
+ok
+
+gen
+----
+ok
+
+d generated
+----
+ok
+
+e
+----
+ok
+`, func(t *testing.T, d *TestData) string {
+			mu.Lock()
+			defer mu.Unlock()
+			switch d.Cmd {
+			case "a", "b":
+				if !strings.Contains(t.Name(), "/g") {
+					t.Errorf("%s did not run in its group", d.Cmd)
+				}
+				// The order of a and b is not deterministic.
+				order = append(order, "g")
+			case "gen":
+				d.Enqueue("d", nil, "")
+				order = append(order, d.Cmd)
+			default:
+				order = append(order, d.Cmd)
+			}
+			return "ok"
+		}, Shuffle(seed), FrameworkArgs())
+		s := strings.Join(order, "")
+		if len(order) != 6 || !strings.Contains(s, "gg") || !strings.Contains(s, "gend") {
+			t.Fatalf("seed %d: unexpected order %s", seed, s)
+		}
+	}
+}
+
+func TestRerunFailed(t *testing.T) {
+	if os.Getenv("DATADRIVEN_TEST_CHILD") != "" {
+		RunTest(t, os.Getenv("DATADRIVEN_TEST_FILE"), func(t *testing.T, d *TestData) string {
+			return d.Cmd
+		}, KeepGoing())
+		return
+	}
+	dir, err := ioutil.TempDir("", "datadriven")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	defer func(old string) { _ = os.Setenv("XDG_CACHE_HOME", old) }(os.Getenv("XDG_CACHE_HOME"))
+	if err := os.Setenv("XDG_CACHE_HOME", dir); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "test")
+	if err := ioutil.WriteFile(path, []byte(`reset
+----
+ok
+
+a chain=x
+----
+ok
+
+b
+----
+ok
+
+c chain=x
+----
+ok
+
+d
+----
+ok
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend that c and d failed in the previous run. The directives are
+	// identified by their contents, so the lines they are at do not matter.
+	fc := loadFailureCache(path)
+	fc.record(&TestData{Cmd: "c", CmdArgs: CmdArgs{{Key: "chain", Vals: []string{"x"}}}})
+	fc.record(&TestData{Cmd: "d"})
+	fc.save(t)
+
+	var ran []string
+	run := func() {
+		ran = nil
+		RunTest(t, path, func(t *testing.T, d *TestData) string {
+			ran = append(ran, d.Cmd)
+			return "ok"
+		}, SetupCommands("reset"), FrameworkArgs())
+	}
+
+	// The cache is neither used nor updated without the flag.
+	run()
+	if s := strings.Join(ran, " "); s != "reset a b c d" {
+		t.Errorf("unexpected directives: %s", s)
+	}
+	if fc := loadFailureCache(path); len(fc.previous) != 2 {
+		t.Errorf("unexpected failures: %v", fc.previous)
+	}
+
+	defer func(old bool) { *rerunFailed = old }(*rerunFailed)
+	*rerunFailed = true
+	run()
+	if s := strings.Join(ran, " "); s != "reset a c d" {
+		t.Errorf("unexpected directives: %s", s)
+	}
+
+	// All the directives passed, so they are all run the next time.
+	if fc := loadFailureCache(path); len(fc.previous) != 0 {
+		t.Errorf("unexpected failures: %v", fc.previous)
+	}
+	run()
+	if s := strings.Join(ran, " "); s != "reset a b c d" {
+		t.Errorf("unexpected directives: %s", s)
+	}
+
+	// All the directives which fail with KeepGoing are recorded.
+	path = filepath.Join(dir, "keep-going")
+	if err := ioutil.WriteFile(path, []byte(keepGoingFailures), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(old string) { _ = os.Setenv("DATADRIVEN_TEST_FILE", old) }(os.Getenv("DATADRIVEN_TEST_FILE"))
+	if err := os.Setenv("DATADRIVEN_TEST_FILE", path); err != nil {
+		t.Fatal(err)
+	}
+	out := runChild(t, "TestRerunFailed", "-datadriven-rerun-failed")
+	if fc := loadFailureCache(path); len(fc.previous) != 3 {
+		t.Errorf("unexpected failures: %v\n%s", fc.previous, out)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datadriven")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	for _, name := range []string{"a", "b", ".hidden"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Modify b, and the hidden file which must be ignored.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		later := time.Now().Add(time.Hour)
+		for _, name := range []string{"b", ".hidden"} {
+			_ = os.Chtimes(filepath.Join(dir, name), later, later)
+		}
+	}()
+
+	stop := make(chan struct{})
+	var ran []string
+	watch(t, dir, func(t *testing.T, path string) {
+		ran = append(ran, filepath.Base(path))
+		close(stop)
+	}, &options{}, 5*time.Millisecond, stop)
+	if fmt.Sprint(ran) != "[b]" {
+		t.Errorf("unexpected files: %v", ran)
+	}
+
+	// The files which the test files depend on are watched as well, even
+	// outside of the watched directory.
+	tests := filepath.Join(dir, "tests")
+	if err := os.Mkdir(tests, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string]string{
+		"value":   "v\n",
+		"tests/a": "run v=@../value\n----\nv\n",
+		"tests/b": "run\n----\nok\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	RunTest(t, filepath.Join(tests, "a"), func(t *testing.T, d *TestData) string {
+		return d.CmdArgs[0].Vals[0]
+	}, ArgsFromFiles())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		later := time.Now().Add(time.Hour)
+		_ = os.Chtimes(filepath.Join(dir, "value"), later, later)
+	}()
+	stop = make(chan struct{})
+	ran = nil
+	watch(t, tests, func(t *testing.T, path string) {
+		ran = append(ran, filepath.Base(path))
+		close(stop)
+	}, &options{}, 5*time.Millisecond, stop)
+	if fmt.Sprint(ran) != "[a]" {
+		t.Errorf("unexpected files: %v", ran)
+	}
+}
+
+type fakeTTY struct {
+	in  io.Reader
+	out bytes.Buffer
+}
+
+func (tty *fakeTTY) Read(p []byte) (int, error)  { return tty.in.Read(p) }
+func (tty *fakeTTY) Write(p []byte) (int, error) { return tty.out.Write(p) }
+func (*fakeTTY) Close() error                    { return nil }
+
+func TestInteractive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datadriven")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "test")
+	if err := ioutil.WriteFile(path, []byte(`echo
+a
+b
+----
+a
+
+echo
+c
+----
+c
+
+echo
+d
+----
+e
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tty := &fakeTTY{in: strings.NewReader("a\nx\naccept\n")}
+	defer func(old func() (io.ReadWriteCloser, error)) { openTTY = old }(openTTY)
+	openTTY = func() (io.ReadWriteCloser, error) { return tty, nil }
+	defer func(old bool) { *interactiveFlag = old }(*interactiveFlag)
+	*interactiveFlag = true
+
+	RunTest(t, path, func(t *testing.T, d *TestData) string {
+		return d.Input
+	})
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `echo
+a
+b
+----
+a
+b
+
+echo
+c
+----
+c
+
+echo
+d
+----
+d
+`; string(data) != expected {
+		t.Errorf("expected:\n%s\nfound:\n%s", expected, data)
+	}
+	if prompts := strings.Count(tty.out.String(), "[a/s/q]"); prompts != 3 {
+		t.Errorf("expected 3 prompts, found %d:\n%s", prompts, tty.out.String())
+	}
+	if !strings.Contains(tty.out.String(), "  a\n+ b\n") || !strings.Contains(tty.out.String(), "- e\n+ d\n") {
+		t.Errorf("unexpected diff:\n%s", tty.out.String())
+	}
+}
+
+func TestCheckRewriteStats(t *testing.T) {
+	defer func(old bool) { *rewriteTestFiles = old }(*rewriteTestFiles)
+	defer func(old bool) { *failNoopRewrite = old }(*failNoopRewrite)
+	*rewriteTestFiles = true
+	*failNoopRewrite = true
+	defer func(files, changed int) {
+		rewriteStats.files, rewriteStats.changed = files, changed
+	}(rewriteStats.files, rewriteStats.changed)
+	rewriteStats.files, rewriteStats.changed = 0, 0
+
+	var buf bytes.Buffer
+	if checkRewriteStats(&buf) {
+		t.Errorf("expected failure when no test file was run")
+	}
+	recordRewrite(false)
+	if checkRewriteStats(&buf) {
+		t.Errorf("expected failure when no test file changed")
+	}
+	recordRewrite(true)
+	if !checkRewriteStats(&buf) {
+		t.Errorf("unexpected failure")
+	}
+	if expected := `rewrite: no test file was run; check the package and -run filter
+rewrite: none of the 1 test file(s) changed
+rewrite: 1 of 2 test file(s) changed
+`; buf.String() != expected {
+		t.Errorf("expected:\n%s\nfound:\n%s", expected, buf.String())
+	}
+}
+
+func TestCheckGoroutineLeaks(t *testing.T) {
+	// Goroutines which exit shortly after the directive are not leaked.
+	for _, mode := range []LeakCheckMode{LeakCheckDirective, LeakCheckFile} {
+		RunTestFromString(t, `
+spawn
+----
+ok
+`, func(t *testing.T, d *TestData) string {
+			go time.Sleep(20 * time.Millisecond)
+			return "ok"
+		}, CheckGoroutineLeaks(mode))
+	}
+
+	before := goroutines()
+	done := make(chan struct{})
+	go func() { <-done }()
+	defer func(old time.Duration) { leakGracePeriod = old }(leakGracePeriod)
+	leakGracePeriod = 0
+	if leaked := leakedGoroutines(before); len(leaked) != 1 || !strings.Contains(leaked[0], "TestCheckGoroutineLeaks") {
+		t.Errorf("expected one leaked goroutine, found:\n%s", strings.Join(leaked, "\n\n"))
+	}
+	close(done)
+}
+
+func TestFileTimeout(t *testing.T) {
+	var w *watchdog
+	RunTestFromString(t, `
+run
+some input
+----
+ok
+`, func(t *testing.T, d *TestData) string {
+		w = d.opts.watchdog
+		var buf bytes.Buffer
+		w.dump(&buf)
+		for _, s := range []string{
+			"<string>: test file exceeded its deadline of 1m0s",
+			"running directive at <string>:2:\nrun\nsome input\n",
+			"goroutine stacks:\ngoroutine ",
+		} {
+			if !strings.Contains(buf.String(), s) {
+				t.Errorf("expected %q in:\n%s", s, buf.String())
+			}
+		}
+		return "ok"
+	}, FileTimeout(time.Minute))
+
+	var buf bytes.Buffer
+	w.dump(&buf)
+	if !strings.Contains(buf.String(), "not running any directive") {
+		t.Errorf("unexpected dump:\n%s", buf.String())
+	}
+}
+
+func TestHermetic(t *testing.T) {
+	var scratch string
+	RunTestFromString(t, `
+write path=${scratch}/a
+hello
+----
+ok
+
+read file=a
+----
+hello
+`, func(t *testing.T, d *TestData) string {
+		scratch = d.ScratchDir()
+		switch d.Cmd {
+		case "write":
+			var path string
+			d.ScanArgs(t, "path", &path)
+			if err := ioutil.WriteFile(path, []byte(d.Input), 0644); err != nil {
+				t.Fatal(err)
+			}
+			return "ok"
+		case "read":
+			var file string
+			d.ScanArgs(t, "file", &file)
+			data, err := ioutil.ReadFile(d.ScratchPath(t, file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return string(data)
+		}
+		return ""
+	}, Hermetic())
+	if _, err := os.Stat(scratch); !os.IsNotExist(err) {
+		t.Errorf("expected the scratch directory %s to be removed: %v", scratch, err)
+	}
+
+	// The files are compared by modification time, size and contents, as
+	// the modification times may be too coarse to tell a change.
+	now := time.Now()
+	s := fileState{modTime: now, size: 1}
+	resized := fileState{modTime: now, size: 2}
+	rewritten := fileState{modTime: now, size: 1, hash: sha256.Sum256([]byte("x"))}
+	touched := fileState{modTime: now.Add(time.Second), size: 1}
+	before := map[string]fileState{"a": s, "b": s, "c": s, "e": s, "f": s}
+	after := map[string]fileState{"a": s, "c": touched, "d": s, "e": resized, "f": rewritten}
+	if changed := changedFiles(before, after); fmt.Sprint(changed) != "[b c d e f]" {
+		t.Errorf("unexpected changed files: %v", changed)
+	}
+
+	// The audit is limited to the testdata root, and skips the scratch
+	// directory.
+	dir, err := ioutil.TempDir("", "datadriven")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	o := makeOptions([]Option{TestdataRoot(dir)})
+	if root := o.auditDir(); root != dir {
+		t.Errorf("expected the audit of %s, found %s", dir, root)
+	}
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "scratch"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	before = auditFiles(t, dir, filepath.Join(dir, "scratch"))
+	if err := ioutil.WriteFile(filepath.Join(dir, "scratch", "file"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, before[file].modTime, before[file].modTime); err != nil {
+		t.Fatal(err)
+	}
+	after = auditFiles(t, dir, filepath.Join(dir, "scratch"))
+	if changed := changedFiles(before, after); fmt.Sprint(changed) != fmt.Sprint([]string{file}) {
+		t.Errorf("unexpected changed files: %v", changed)
+	}
+}
+
+func TestEventually(t *testing.T) {
+	calls := 0
+	RunTestFromString(t, `
+converge
+----
+state 3
+`, func(t *testing.T, d *TestData) string {
+		return d.Eventually(t, time.Minute, func() string {
+			if calls < 3 {
+				calls++
+			}
+			return fmt.Sprintf("state %d", calls)
+		})
+	})
+	if calls != 3 {
+		t.Errorf("expected 3 calls, found %d", calls)
+	}
+
+	// The output is sorted with sort-output before it is compared.
+	calls = 0
+	RunTestFromString(t, `
+converge sort-output
+----
+a
+b
+state 3
+`, func(t *testing.T, d *TestData) string {
+		return d.Eventually(t, 2*time.Second, func() string {
+			calls++
+			return fmt.Sprintf("state %d\nb\na", calls)
+		})
+	}, FrameworkArgs())
+	if calls != 3 {
+		t.Errorf("expected 3 calls, found %d", calls)
+	}
+
+	// When rewriting, the output must be stable.
+	calls = 0
+	d := &TestData{Rewrite: true}
+	if out := d.Eventually(t, time.Minute, func() string {
+		if calls < 3 {
+			calls++
+		}
+		return fmt.Sprintf("state %d", calls)
+	}); out != "state 3" {
+		t.Errorf("unexpected output %q", out)
+	}
+
+	// The directives generated by foreach compare with the expected output
+	// of their iteration, and those of macros wait for a stable output,
+	// rather than waiting for the timeout.
+	counts := map[string]int{}
+	start := time.Now()
+	RunTestFromString(t, `
+foreach x=(a, b)
+converge ${x}
+----
+[x=a]
+a 3
+[x=b]
+b 3
+
+macro both
+converge c
+
+converge d
+----
+
+both
+----
+c 3
+d 3
+`, func(t *testing.T, d *TestData) string {
+		key := d.CmdArgs[0].Key
+		return d.Eventually(t, time.Minute, func() string {
+			if counts[key] < 3 {
+				counts[key]++
+			}
+			return fmt.Sprintf("%s %d", key, counts[key])
+		})
+	}, BuiltinDirectives())
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Errorf("Eventually waited for the timeout (%s)", elapsed)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datadriven")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	for _, name := range []string{"w", ".hidden", "a/x", "a/b/y", "skip/z"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var names []string
+	Walk(t, dir, func(t *testing.T, path string) {
+		names = append(names, strings.TrimPrefix(t.Name(), "TestWalk/"))
+	}, WalkFilter(func(path string, info os.FileInfo) bool {
+		return info.Name() != "skip"
+	}))
+	if fmt.Sprint(names) != "[a/b/y a/x w]" {
+		t.Errorf("unexpected subtests: %v", names)
+	}
+}
+
+func TestSkipFile(t *testing.T) {
+	ran := false
+	t.Run("directive", func(t *testing.T) {
+		RunTestFromString(t, `
+# Disabled until the frobnicator is fixed.
+skipfile frobnicator is broken
+cmd
+----
+ok
+`, func(t *testing.T, d *TestData) string {
+			ran = true
+			return "ok"
+		}, BuiltinDirectives())
+	})
+	if ran {
+		t.Errorf("expected the file to be skipped")
+	}
+
+	dir, err := ioutil.TempDir("", "datadriven")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	if err := ioutil.WriteFile(filepath.Join(dir, "test.skip"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	Walk(t, dir, func(t *testing.T, path string) {
+		t.Errorf("expected %s to be skipped", path)
+	})
+}
+
+func TestWalkSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datadriven")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	for _, name := range []string{"a", ".hidden"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range map[string]string{"link": "a", "broken": "missing", "loop": "."} {
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Skipf("cannot create symbolic links: %v", err)
+		}
+	}
+
+	for _, tc := range []struct {
+		opts     []Option
+		expected string
+	}{
+		{[]Option{IgnoreBrokenSymlinks()}, "[a link]"},
+		{[]Option{IgnoreBrokenSymlinks(), WalkHiddenFiles()}, "[.hidden a link]"},
+		{[]Option{SkipSymlinks()}, "[a]"},
+	} {
+		var names []string
+		Walk(t, dir, func(t *testing.T, path string) {
+			names = append(names, filepath.Base(path))
+		}, tc.opts...)
+		if fmt.Sprint(names) != tc.expected {
+			t.Errorf("expected %s, found %v", tc.expected, names)
+		}
+	}
+}
+
+func TestTestdataRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datadriven")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	if err := os.MkdirAll(filepath.Join(dir, "testdata"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "testdata", "test"), []byte(`cmd
+----
+ok
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	handler := func(t *testing.T, d *TestData) string { return "ok" }
+
+	RunTest(t, "testdata/test", handler, TestdataRoot(dir))
+
+	for _, env := range testdataRootEnvs {
+		func() {
+			defer func(old string) { _ = os.Setenv(env, old) }(os.Getenv(env))
+			if err := os.Setenv(env, dir); err != nil {
+				t.Fatal(err)
+			}
+			ran := 0
+			Walk(t, "testdata", func(t *testing.T, path string) {
+				ran++
+				RunTest(t, path, handler)
+			})
+			if ran != 1 {
+				t.Errorf("%s: expected one file, found %d", env, ran)
+			}
+		}()
+	}
+
+	// The paths which do not exist are looked up among the Bazel runfiles.
+	runfiles := filepath.Join(dir, "runfiles")
+	if err := os.MkdirAll(filepath.Join(runfiles, "ws", "testdata"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "testdata", "test"), filepath.Join(runfiles, "ws", "testdata", "runfile")); err != nil {
+		t.Fatal(err)
+	}
+	manifest := filepath.Join(dir, "MANIFEST")
+	if err := ioutil.WriteFile(manifest, []byte("ws/testdata/manifest "+filepath.Join(runfiles, "ws", "testdata", "runfile")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for env, val := range map[string]string{
+		"TEST_SRCDIR":            runfiles,
+		"TEST_WORKSPACE":         "ws",
+		"RUNFILES_MANIFEST_FILE": manifest,
+	} {
+		defer func(env, old string) { _ = os.Setenv(env, old) }(env, os.Getenv(env))
+		if err := os.Setenv(env, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	RunTest(t, "testdata/runfile", handler)
+	RunTest(t, "testdata/manifest", handler)
+}
+
+func TestRunTestFromBytes(t *testing.T) {
+	RunTestFromBytes(t, "generated", []byte(`
+pos
+----
+generated:2
+`), func(t *testing.T, d *TestData) string {
+		return d.Pos.String()
+	})
+}
+
+func TestRequireDirectives(t *testing.T) {
+	RunTestFromString(t, `
+cmd
+----
+ok
+`, func(t *testing.T, d *TestData) string {
+		return "ok"
+	}, RequireDirectives())
+
+	for input, expected := range map[string]bool{
+		"# just a comment\n":            false,
+		"config a b\n":                  false,
+		"config a b\n\ncmd\n----\nok\n": true,
+	} {
+		r := newTestDataReader(t, "<string>", strings.NewReader(input), false, makeOptions([]Option{BuiltinDirectives()}))
+		if _, ok := r.readConfigs(t); ok != expected {
+			t.Errorf("%q: expected %t, found %t", input, expected, ok)
+		}
+	}
+}
+
+func TestCheckOrphans(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datadriven")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	for _, name := range []string{"used", "orphan", "disabled.skip", ".hidden"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("cmd\n----\nok\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	RunTest(t, filepath.Join(dir, "used"), func(t *testing.T, d *TestData) string {
+		return "ok"
+	})
+
+	var buf bytes.Buffer
+	o := makeOptions([]Option{CheckOrphans(dir)})
+	if checkOrphans(&buf, &o) {
+		t.Errorf("expected orphans to be found")
+	}
+	if expected := fmt.Sprintf("test files not used by any test:\n  %s\n",
+		filepath.Join(dir, "orphan")); buf.String() != expected {
+		t.Errorf("expected:\n%s\nfound:\n%s", expected, buf.String())
+	}
+}
+
+func TestSubtestNames(t *testing.T) {
+	var names []string
+	handler := func(t *testing.T, d *TestData) string {
+		names = append(names, strings.TrimPrefix(t.Name(), "TestSubtestNames/"))
+		return "ok"
+	}
+	const input = `
+build
+----
+ok
+
+run a=1
+----
+ok
+`
+	RunTestFromString(t, input, handler, DirectiveSubtests(nil))
+	RunTestFromString(t, input, handler, DirectiveSubtests(func(d *TestData) string {
+		return d.Cmd + " " + strings.Join(d.CmdArgs.Keys(), " ")
+	}))
+	if expected := "[directives/2_build directives/6_run directives#01/build_ directives#01/run_a]"; fmt.Sprint(names) != expected {
+		t.Errorf("expected %s, found %v", expected, names)
+	}
+
+	dir, err := ioutil.TempDir("", "datadriven")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	if err := ioutil.WriteFile(filepath.Join(dir, "some file.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	names = nil
+	Walk(t, dir, func(t *testing.T, path string) {
+		names = append(names, strings.TrimPrefix(t.Name(), "TestSubtestNames/"))
+	}, SubtestNames(func(path string) string {
+		return "dir/" + strings.TrimSuffix(filepath.Base(path), ".txt")
+	}))
+	if expected := "[dir_some_file]"; fmt.Sprint(names) != expected {
+		t.Errorf("expected %s, found %v", expected, names)
+	}
+}
+
+func TestWalkExcludeAndDepth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datadriven")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	for _, name := range []string{"a", "b.out", "scratch/x", "sub/c", "sub/deep/d"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		opts     []Option
+		expected string
+	}{
+		{[]Option{ExcludeGlob("*.out", "scratch")}, "[a sub/c sub/deep/d]"},
+		{[]Option{ExcludeGlob("sub/deep")}, "[a b.out scratch/x sub/c]"},
+		{[]Option{MaxDepth(1)}, "[a b.out]"},
+		{[]Option{MaxDepth(2)}, "[a b.out scratch/x sub/c]"},
+	} {
+		var names []string
+		Walk(t, dir, func(t *testing.T, path string) {
+			rel, _ := filepath.Rel(dir, path)
+			names = append(names, filepath.ToSlash(rel))
+		}, tc.opts...)
+		if fmt.Sprint(names) != tc.expected {
+			t.Errorf("expected %s, found %v", tc.expected, names)
+		}
+	}
+}
+
+func TestWalkExtensions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datadriven")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	for _, name := range []string{"a.dd", "b.sql", "c.txt", "sub/d.dd"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var calls []string
+	handler := func(kind string) func(t *testing.T, path string) {
+		return func(t *testing.T, path string) {
+			calls = append(calls, kind+":"+filepath.Base(path))
+		}
+	}
+	Walk(t, dir, handler("default"), Extensions("dd"), ExtensionHandler(".sql", handler("sql")))
+	if expected := "[default:a.dd sql:b.sql default:d.dd]"; fmt.Sprint(calls) != expected {
+		t.Errorf("expected %s, found %v", expected, calls)
+	}
+}
+
+func TestResult(t *testing.T) {
+	RunTestFromString(t, `
+result
+----
+out
+00000000  00 01 02                                          |...|
+stats:
+count: 3
+error: boom
+`, ResultHandler(func(t *testing.T, d *TestData) Result {
+		return Result{
+			Output:    "out",
+			Data:      []byte{0, 1, 2},
+			Sections:  []ResultSection{{Name: "stats", Output: "count: 3"}},
+			Err:       errors.New("boom"),
+			Artifacts: map[string][]byte{"dump": []byte("not rendered")},
+		}
+	}))
+
+	if s := (Result{}).String(); s != "" {
+		t.Errorf("expected empty output, found %q", s)
+	}
+}
+
+func TestRunTestSimple(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datadriven-simple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "test")
+	if err := ioutil.WriteFile(path, []byte("echo a=1\n----\n1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	RunTestSimple(t, path, func(t *testing.T, d *TestData) string {
+		var a int
+		d.ScanArgs(t, "a", &a)
+		return fmt.Sprint(a)
+	})
+}
+
+func TestCompareOption(t *testing.T) {
+	RunTestFromString(t, `
+rows
+----
+a b
+2 1
+1 2
+
+rows compare=
+----
+a b
+1 2
+2 1
+`, func(t *testing.T, d *TestData) string {
+		return "a b\n1 2\n2 1\n"
+	}, Compare("rows-unordered"))
+}
+
+func TestCommentPrefix(t *testing.T) {
+	if os.Getenv("DATADRIVEN_TEST_CHILD") != "" {
+		Walk(t, "testdata", func(t *testing.T, path string) {
+			t.Errorf("%s: unexpected file", path)
+		}, CommentPrefix(""))
+		return
+	}
+	RunTestFromString(t, `
+// a comment
+run
+----
+run
+
+//| a block comment
+disabled
+----
+|//
+`, func(t *testing.T, d *TestData) string {
+		return d.Cmd
+	}, CommentPrefix("//"))
+
+	RunTestFromString(t, `
+run --flag a=1 -- trailing comment
+----
+--flag a
+`, func(t *testing.T, d *TestData) string {
+		var keys []string
+		for _, a := range d.CmdArgs {
+			keys = append(keys, a.Key)
+		}
+		return strings.Join(keys, " ") + "\n"
+	}, CommentPrefix("--"))
+
+	// An empty comment prefix fails the test, or is returned as an error.
+	if out := runChild(t, "TestCommentPrefix"); !strings.Contains(out, "the comment prefix cannot be empty") {
+		t.Errorf("expected the empty comment prefix to be reported:\n%s", out)
+	}
+	l := NewLexer("test", strings.NewReader("cmd\n"), CommentPrefix(""))
+	if _, ok := l.Next(); ok || l.Err() == nil || l.Err().Error() != "the comment prefix cannot be empty" {
+		t.Errorf("unexpected error: %v", l.Err())
+	}
+}
+
+func TestDirectiveTimeout(t *testing.T) {
+	RunTestFromString(t, `
+run
+----
+ok
+`, func(t *testing.T, d *TestData) string {
+		return "ok"
+	}, DirectiveTimeout(time.Minute))
+
+	w := startWatchdog("<string>:2: directive", time.Minute)
+	defer w.stop()
+	var buf bytes.Buffer
+	w.dump(&buf)
+	if exp := "<string>:2: directive exceeded its deadline of 1m0s"; !strings.Contains(buf.String(), exp) {
+		t.Errorf("expected %q in:\n%s", exp, buf.String())
+	}
+}
+
+func TestWalkParallel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datadriven-parallel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	for _, name := range []string{"a", "b", "c"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("run\n----\nok\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var mu sync.Mutex
+	var ran []string
+	t.Run("walk", func(t *testing.T) {
+		Walk(t, dir, func(t *testing.T, path string) {
+			RunTest(t, path, func(t *testing.T, d *TestData) string { return "ok" })
+			mu.Lock()
+			defer mu.Unlock()
+			ran = append(ran, filepath.Base(path))
+		}, Parallel())
+	})
+	sort.Strings(ran)
+	if exp := "a b c"; strings.Join(ran, " ") != exp {
+		t.Errorf("expected %s, found %v", exp, ran)
+	}
+}
+
+func TestSetDefaults(t *testing.T) {
+	defer SetDefaults()
+	SetDefaults(CommentPrefix("--"), Separator("===="))
+	RunTestFromString(t, `
+-- a comment
+run
+====
+ok
+`, func(t *testing.T, d *TestData) string {
+		return "ok"
+	})
+	RunTestFromString(t, `
+run
+----
+ok
+`, func(t *testing.T, d *TestData) string {
+		return "ok"
+	}, Separator("----"))
+
+	SetDefaults()
+	if o := makeOptions(nil); o.commentPrefix != "#" || o.separator != "----" {
+		t.Errorf("expected the defaults to be reset, found %q and %q", o.commentPrefix, o.separator)
+	}
+}
+
+func TestRewriteField(t *testing.T) {
+	const input = `
+run
+----
+ok
+`
+	for _, rewrite := range []bool{false, true} {
+		out := runTestInternal(t, "<string>", strings.NewReader(input), func(t *testing.T, d *TestData) string {
+			if d.Rewrite != rewrite {
+				t.Errorf("expected Rewrite=%t", rewrite)
+			}
+			return "ok"
+		}, rewrite)
+		if rewrite && string(out) != input {
+			t.Errorf("expected the file to be unchanged, found:\n%s", out)
+		}
+	}
+}
+
+func TestRewriteCmdArgs(t *testing.T) {
+	const input = `
+run old=1 \
+  b=(2, 3)
+----
+1
+
+other old=4
+input
+----
+4
+`
+	const expected = `
+run new=1 b=(2, 3)
+----
+1
+
+other new=4
+input
+----
+4
+`
+	out := runTestInternal(t, "<string>", strings.NewReader(input), func(t *testing.T, d *TestData) string {
+		if d.Cmd == "run" {
+			if arg, ok := d.CmdArgs.Remove("old"); ok {
+				arg.Key = "new"
+				d.RewriteCmdArgs(append(CmdArgs{arg}, d.CmdArgs...))
+			}
+		}
+		var v int
+		d.ScanArgs(t, "new", &v)
+		return fmt.Sprint(v)
+	}, true /* rewrite */, MigrateArgs(func(cmd string, args CmdArgs) CmdArgs {
+		if cmd == "other" {
+			for i := range args {
+				if args[i].Key == "old" {
+					args[i].Key = "new"
+				}
+			}
+		}
+		return args
+	}))
+	if string(out) != expected {
+		t.Errorf("expected:\n%s\nfound:\n%s", expected, out)
+	}
+}
+
+func TestRewritePreservesFormatting(t *testing.T) {
+	for _, input := range []string{
+		"a\n----\nx\n\n",
+		"\n\na\n----\nx\n\n\n",
+		"a\n----\nx\n\n\n\nb\n----\nx\n",
+		"a\n----\nx\n   \nb\n----\nx\n",
+		"# comment\na # trailing comment\n----\nx\n# not a comment\n\nb\n----\nx\n",
+		"a\n----\n----\nx\n\ny\n----\n----\n\n\n# comment\nb\n----\nx\n",
+	} {
+		out := runTestInternal(t, "<string>", strings.NewReader(input), func(t *testing.T, d *TestData) string {
+			return d.Expected
+		}, true /* rewrite */)
+		if string(out) != input {
+			t.Errorf("expected:\n%q\nfound:\n%q", input, out)
+		}
+	}
+
+	const input = `
+run a=1 b=(2, 3)  # keep this
+----
+x
+`
+	const expected = `
+run a=2 b=(2, 3) # keep this
+----
+x
+`
+	out := runTestInternal(t, "<string>", strings.NewReader(input), func(t *testing.T, d *TestData) string {
+		d.RewriteCmdArgs(CmdArgs{{Key: "a", Vals: []string{"2"}}, d.CmdArgs[1]})
+		return "x"
+	}, true /* rewrite */)
+	if string(out) != expected {
+		t.Errorf("expected:\n%s\nfound:\n%s", expected, out)
+	}
+}
+
+func TestRewriteExpandedArgs(t *testing.T) {
+	// The arguments and input are rewritten in their unexpanded form.
+	const input = `
+cmd old=1 f=@testdata/args-from-files/value.txt x=(a, @testdata/args-from-files/value.txt)
+----
+a large value
+
+old-cmd f=@testdata/args-from-files/value.txt
+${env:DATADRIVEN_TEST_VAR}
+----
+banana
+`
+	const expected = `
+cmd f=@testdata/args-from-files/value.txt x=(a, @testdata/args-from-files/value.txt) new=1
+----
+a large value
+
+new-cmd g=@testdata/args-from-files/value.txt
+${env:DATADRIVEN_TEST_VAR}
+----
+a large value banana
+`
+	if err := os.Setenv("DATADRIVEN_TEST_VAR", "banana"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Unsetenv("DATADRIVEN_TEST_VAR") }()
+
+	out := runTestInternal(t, "<string>", strings.NewReader(input), func(t *testing.T, d *TestData) string {
+		switch d.Cmd {
+		case "cmd":
+			if arg, ok := d.CmdArgs.Remove("old"); ok {
+				arg.Key = "new"
+				d.RewriteCmdArgs(append(d.CmdArgs, arg))
+			}
+			return d.CmdArgs[0].Vals[0]
+		case "old-cmd":
+			arg := d.CmdArgs[0]
+			arg.Key = "g"
+			d.ReplaceDirective("new-cmd", CmdArgs{arg}, d.Input)
+			return d.Input
+		}
+		return d.CmdArgs[0].Vals[0] + " " + d.Input
+	}, true /* rewrite */, ArgsFromFiles(), ExpandEnv())
+	if string(out) != expected {
+		t.Errorf("expected:\n%s\nfound:\n%s", expected, out)
+	}
+}
+
+func TestReplaceDirective(t *testing.T) {
+	const input = `
+old-sum a=1
+2
+3
+----
+5
+
+sum a=1
+4
+----
+5
+`
+	const expected = `
+sum a=1 b=2
+2
+3
+----
+a=1 b=2: 5
+
+sum a=1
+4
+----
+a=1: 4
+`
+	handler := func(t *testing.T, d *TestData) string {
+		sum := 0
+		for _, l := range strings.Split(d.Input, "\n") {
+			var n int
+			fmt.Sscan(l, &n)
+			sum += n
+		}
+		switch d.Cmd {
+		case "old-sum":
+			d.ReplaceDirective("sum", append(d.CmdArgs, CmdArg{Key: "b", Vals: []string{"2"}}), d.Input)
+			return fmt.Sprint(sum)
+		case "sum":
+			return fmt.Sprintf("%s: %d", strings.Trim(d.CmdArgs.String(), "[]"), sum)
+		}
+		t.Fatalf("unknown command %s", d.Cmd)
+		return ""
+	}
+	out := runTestInternal(t, "<string>", strings.NewReader(input), handler, true /* rewrite */)
+	if string(out) != expected {
+		t.Errorf("expected:\n%s\nfound:\n%s", expected, out)
+	}
+	// When not rewriting, the directive is run as is.
+	RunTestFromString(t, `
+old-sum
+2
+----
+2
+`, handler)
+}
+
+func TestEnqueue(t *testing.T) {
+	const input = `
+expand n=2
+x
+----
+expanded 2
+
+variant i=5 generated
+x
+----
+stale
+
+# A comment.
+other
+----
+other
+`
+	const expected = `
+expand n=2
+x
+----
+expanded 2
+
+variant i=0 generated
+x
+----
+x0
+
+variant i=1 generated
+x
+----
+x1
+
+# A comment.
+other
+----
+other
+`
+	handler := func(t *testing.T, d *TestData) string {
+		switch d.Cmd {
+		case "expand":
+			var n int
+			d.ScanArgs(t, "n", &n)
+			for i := 0; i < n; i++ {
+				d.Enqueue("variant", CmdArgs{{Key: "i", Vals: []string{fmt.Sprint(i)}}}, d.Input)
+			}
+			return fmt.Sprintf("expanded %d", n)
+		case "variant":
+			var i int
+			d.ScanArgs(t, "i", &i)
+			return fmt.Sprintf("%s%d", d.Input, i)
+		default:
+			return d.Cmd
+		}
+	}
+	out := runTestInternal(t, "<string>", strings.NewReader(input), handler, true /* rewrite */, FrameworkArgs())
+	if string(out) != expected {
+		t.Errorf("expected:\n%s\nfound:\n%s", expected, out)
+	}
+	// The rewritten file passes, and is unchanged by another rewrite.
+	RunTestFromString(t, expected, handler, FrameworkArgs())
+	if out := runTestInternal(t, "<string>", strings.NewReader(expected), handler, true /* rewrite */, FrameworkArgs()); string(out) != expected {
+		t.Errorf("expected:\n%s\nfound:\n%s", expected, out)
+	}
+	// Generated directives at the end of the file.
+	const last = "expand n=1\nx\n----\nexpanded 1\n\nvariant i=0 generated\nx\n----\nx0\n"
+	if out := runTestInternal(t, "<string>", strings.NewReader("expand n=1\nx\n----\n"), handler, true /* rewrite */, FrameworkArgs()); string(out) != last {
+		t.Errorf("expected:\n%s\nfound:\n%s", last, out)
+	}
+	RunTestFromString(t, last, handler, FrameworkArgs())
+}
+
+func TestBuiltinEcho(t *testing.T) {
+	RunTestFromString(t, `
+foreach x=(a, b)
+echo
+value: ${x}
+----
+[x=a]
+value: a
+[x=b]
+value: b
+
+run
+----
+run
+`, func(t *testing.T, d *TestData) string {
+		if d.Cmd == "echo" {
+			t.Fatalf("the test function must not be invoked for echo")
+		}
+		return d.Cmd
+	}, BuiltinEcho(), BuiltinDirectives())
+}
+
+func TestPending(t *testing.T) {
+	defer func(old []string) { pendingDirectives.positions = old }(pendingDirectives.positions)
+	pendingDirectives.positions = nil
+
+	const input = `
+run pending
+----
+not implemented
+
+run
+----
+run
+
+run pending=false
+----
+run
+`
+	handler := func(t *testing.T, d *TestData) string {
+		if d.ArgBool(t, "pending") {
+			t.Fatalf("the test function must not be invoked for pending directives")
+		}
+		return d.Cmd
+	}
+	RunTestFromString(t, input, handler, FrameworkArgs())
+	if out := runTestInternal(t, "<string>", strings.NewReader(input), handler, true /* rewrite */, FrameworkArgs()); string(out) != input {
+		t.Errorf("expected:\n%s\nfound:\n%s", input, out)
+	}
+
+	var buf bytes.Buffer
+	reportPending(&buf)
+	if exp := "2 pending directive(s):\n  <string>:2\n  <string>:2\n"; buf.String() != exp {
+		t.Errorf("expected %q, found %q", exp, buf.String())
+	}
+
+	// Without FrameworkArgs, the argument is handed to the test function.
+	RunTestFromString(t, "run pending\n----\npending\n", func(t *testing.T, d *TestData) string {
+		if d.HasArg("pending") {
+			return "pending"
+		}
+		return d.Cmd
+	})
+}
+
+func TestRegistry(t *testing.T) {
+	reg := NewRegistry()
+	reg.Register("put", func(t *testing.T, d *TestData) string { return "put " + d.Input })
+	reg.Register("get", func(t *testing.T, d *TestData) string { return "get " + d.Input })
+	RunTestFromString(t, `
+put
+a
+----
+put a
+
+get
+a
+----
+get a
+`, reg.Handler())
+
+	if cmds := reg.Commands(); len(cmds) != 2 || cmds[0].Name != "get" || cmds[1].Name != "put" {
+		t.Errorf("unexpected commands: %v", cmds)
+	}
+	for name, expected := range map[string]string{
+		"gte":        `; did you mean "get"?`,
+		"putt":       `; did you mean "put"?`,
+		"delete":     "",
+		"x":          "",
+		"get-prefix": "",
+	} {
+		if s := reg.suggest(name); s != expected {
+			t.Errorf("%s: expected %q, found %q", name, expected, s)
+		}
+	}
+}
+
+func TestDeprecatedCommands(t *testing.T) {
+	defer func(old map[*Command][]string) { deprecatedUses.m = old }(deprecatedUses.m)
+	deprecatedUses.m = nil
+
+	reg := NewRegistry()
+	reg.Register("scan", func(t *testing.T, d *TestData) string { return "ok" })
+	reg.Register("iter", func(t *testing.T, d *TestData) string { return "ok" }).Deprecate("use scan instead")
+	RunTestFromString(t, `
+iter
+----
+ok
+
+scan
+----
+ok
+
+iter
+----
+ok
+`, reg.Handler())
+
+	var buf bytes.Buffer
+	reportDeprecatedUses(&buf)
+	if exp := "deprecated command \"iter\" (use scan instead) used at:\n  <string>:2\n  <string>:10\n"; buf.String() != exp {
+		t.Errorf("expected %q, found %q", exp, buf.String())
+	}
+}
+
+func TestArgSpecs(t *testing.T) {
+	reg := NewRegistry()
+	reg.Register("scan", func(t *testing.T, d *TestData) string {
+		return d.CmdArgs.String()
+	}).WithArgs(
+		ArgSpec{Name: "key", Required: true},
+		ArgSpec{Name: "limit", Type: IntArg},
+		ArgSpec{Name: "span", Arity: 2},
+		ArgSpec{Name: "reverse", Type: BoolArg},
+		ArgSpec{Name: "cols", Type: UintArg, Arity: VariadicArity},
+		ArgSpec{Name: "timeout", Type: DurationArg},
+	)
+	RunTestFromString(t, `
+scan key=a limit=-1 span=(a, c) reverse cols=(1, 2, 3) timeout=1m30s chain=x
+----
+[key=a limit=-1 span=(a, c) reverse cols=(1, 2, 3) timeout=1m30s chain=x]
+
+scan key=b reverse=false
+----
+[key=b reverse=false]
+`, reg.Handler(), FrameworkArgs())
+
+	for _, tc := range []struct {
+		typ   ArgType
+		val   string
+		valid bool
+	}{
+		{StringArg, "anything", true},
+		{IntArg, "-12", true},
+		{IntArg, "0x10", true},
+		{IntArg, "1.5", false},
+		{UintArg, "-1", false},
+		{FloatArg, "1e3", true},
+		{BoolArg, "yes", true},
+		{BoolArg, "maybe", false},
+		{DurationArg, "3m30s", true},
+		{DurationArg, "3", false},
+	} {
+		if err := tc.typ.parse(tc.val); (err == nil) != tc.valid {
+			t.Errorf("%s %q: expected valid=%t, found %v", tc.typ, tc.val, tc.valid, err)
+		}
+	}
+}
+
+func TestLint(t *testing.T) {
+	reg := NewRegistry()
+	scan := reg.Register("scan", func(t *testing.T, d *TestData) string { return "" }).
+		WithHelp("Scans the keys starting at key.").
+		WithArgs(
+			ArgSpec{Name: "key", Required: true, Help: "the first key to scan"},
+			ArgSpec{Name: "limit", Type: IntArg, Help: "the maximum number of keys"},
+			ArgSpec{Name: "span", Arity: 2},
+			ArgSpec{Name: "reverse", Type: BoolArg, Help: "scan in reverse order"},
+		)
+	const usage = `usage: scan key=<string> [limit=<int>] [span=(<string>, <string>)] [reverse]
+
+Scans the keys starting at key.
+
+arguments:
+  key=<string>                the first key to scan
+  [limit=<int>]               the maximum number of keys
+  [span=(<string>, <string>)]
+  [reverse]                   scan in reverse order
+`
+	if u := scan.Usage(); u != usage {
+		t.Errorf("expected:\n%s\nfound:\n%s", usage, u)
+	}
+
+	dir, err := ioutil.TempDir("", "datadriven-lint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	if err := ioutil.WriteFile(filepath.Join(dir, "test"), []byte(`
+scan key=a limit=10
+----
+
+foreach n=(1, 2)
+scan key=a limit=${n}
+----
+[n=1]
+[n=2]
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reg.Lint(t, dir, BuiltinDirectives())
+
+	r := newTestDataReader(t, "<string>", strings.NewReader("scan limit=x lmit=2 span=a\n"), false, makeOptions(nil))
+	if !r.Next(t) {
+		t.Fatal("expected a directive")
+	}
+	expected := []string{
+		`<string>:1:6: scan: argument "limit": invalid int "x"`,
+		`<string>:1:14: scan: unknown argument "lmit"; did you mean "limit"?`,
+		`<string>:1:21: scan: argument "span" takes 2 values, found 1`,
+		`<string>:1: scan: missing required argument "key"`,
+	}
+	if problems := scan.argProblems(&r.data, true /* lint */); strings.Join(problems, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected:\n%s\nfound:\n%s", strings.Join(expected, "\n"), strings.Join(problems, "\n"))
+	}
+
+	// Only the values containing ${ may be substituted, and are not checked.
+	r = newTestDataReader(t, "<string>", strings.NewReader("scan key=a limit=({x}) span=(${a}, b)\n"), false, makeOptions(nil))
+	if !r.Next(t) {
+		t.Fatal("expected a directive")
+	}
+	expected = []string{
+		`<string>:1:12: scan: argument "limit": invalid int "{x}"`,
+	}
+	if problems := scan.argProblems(&r.data, true /* lint */); strings.Join(problems, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected:\n%s\nfound:\n%s", strings.Join(expected, "\n"), strings.Join(problems, "\n"))
+	}
+}
+
+func TestReference(t *testing.T) {
+	reg := NewRegistry()
+	reg.Register("put", func(t *testing.T, d *TestData) string { return "" }).
+		WithHelp("Writes a key.").
+		WithArgs(ArgSpec{Name: "key", Required: true, Help: "the key"}).
+		WithExample("put key=a\nvalue\n----\nok\n")
+	reg.Register("del", func(t *testing.T, d *TestData) string { return "" }).
+		Deprecate("use put with an empty value")
+
+	const text = `usage: del
+
+deprecated: use put with an empty value
+
+usage: put key=<string>
+
+Writes a key.
+
+arguments:
+  key=<string> the key
+
+example:
+  put key=a
+  value
+  ----
+  ok
+`
+	if ref := reg.Reference(TextReference); ref != text {
+		t.Errorf("expected:\n%s\nfound:\n%s", text, ref)
+	}
+
+	const markdown = "## del\n\n" +
+		"**Deprecated:** use put with an empty value\n\n" +
+		"Usage: `del`\n\n" +
+		"## put\n\n" +
+		"Writes a key.\n\n" +
+		"Usage: `put key=<string>`\n\n" +
+		"| Argument | Type | Required | Description |\n" +
+		"| --- | --- | --- | --- |\n" +
+		"| `key` | string | yes | the key |\n\n" +
+		"Example:\n\n" +
+		"```\nput key=a\nvalue\n----\nok\n```\n"
+	if ref := reg.Reference(MarkdownReference); ref != markdown {
+		t.Errorf("expected:\n%s\nfound:\n%s", markdown, ref)
+	}
+}
+
+func TestScaffold(t *testing.T) {
+	reg := NewRegistry()
+	reg.Register("put", func(t *testing.T, d *TestData) string { return "" }).
+		WithHelp("Writes a key.").
+		WithArgs(
+			ArgSpec{Name: "key", Required: true},
+			ArgSpec{Name: "ts", Type: IntArg},
+			ArgSpec{Name: "sync", Type: BoolArg, Required: true},
+			ArgSpec{Name: "span", Required: true, Arity: 2},
+			ArgSpec{Name: "ttl", Type: DurationArg, Required: true},
+		)
+	reg.Register("get", func(t *testing.T, d *TestData) string { return "" }).
+		WithArgs(ArgSpec{Name: "key", Required: true}).
+		WithExample("get key=a\n----\na=1\n")
+	reg.Register("del", func(t *testing.T, d *TestData) string { return "" }).
+		Deprecate("use put with an empty value")
+
+	const expected = `get key=a
+----
+a=1
+
+# put key=<string> [ts=<int>] sync span=(<string>, <string>) ttl=<duration>
+# Writes a key.
+put key=TODO sync span=(TODO, TODO) ttl=1s
+----
+`
+	scaffold := reg.Scaffold()
+	if scaffold != expected {
+		t.Fatalf("expected:\n%s\nfound:\n%s", expected, scaffold)
+	}
+
+	dir, err := ioutil.TempDir("", "datadriven")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	defer func(old string) { *scaffoldPath = old }(*scaffoldPath)
+	*scaffoldPath = filepath.Join(dir, "scaffold")
+	t.Run("generate", reg.GenerateScaffold)
+	if b, err := ioutil.ReadFile(*scaffoldPath); err != nil || string(b) != expected {
+		t.Fatalf("unexpected scaffold file: %q, %v", b, err)
+	}
+	reg.Lint(t, *scaffoldPath)
+}
+
+func TestScanNumbers(t *testing.T) {
+	RunTestFromString(t, `
+scan i=-1 n=1_000_000 h=0x10 e=1e6 f=-2.5e-3
+----
+-1 1000000 16 1000000 -0.0025
+`, func(t *testing.T, d *TestData) string {
+		var i, n int
+		var h uint64
+		var e int64
+		var f float64
+		d.ScanArgs(t, "i", &i)
+		d.ScanArgs(t, "n", &n)
+		d.ScanArgs(t, "h", &h)
+		d.ScanArgs(t, "e", &e)
+		d.ScanArgs(t, "f", &f)
+		return fmt.Sprint(i, n, h, e, f)
+	})
+
+	for _, tc := range []struct {
+		val  string
+		dest interface{}
+		exp  string
+	}{
+		{"-0b101", new(int), "-5"},
+		{"010", new(int), "10"},
+		{"09", new(uint), "9"},
+		{"-007", new(int), "-7"},
+		{"0o17", new(int), "15"},
+		{"000", new(int), "0"},
+		{"1.5e3", new(int32), "1500"},
+		{"4294967295", new(uint32), "4294967295"},
+		{"1_000.5", new(float32), "1000.5"},
+		{"1.5", new(int), `invalid integer: "1.5"`},
+		{"1.5e0", new(int), `invalid integer: "1.5e0"`},
+		{"-1", new(uint), `invalid unsigned integer: "-1" is negative`},
+		{"1e10", new(int32), "integer 1e10 out of range for 32 bits"},
+		{"2147483648", new(int32), "integer 2147483648 out of range for 32 bits"},
+		{"x", new(float64), `invalid number: "x"`},
+	} {
+		var found string
+		if err := scanValue(tc.val, tc.dest); err != nil {
+			found = err.Error()
+		} else {
+			found = fmt.Sprint(reflect.ValueOf(tc.dest).Elem())
+		}
+		if found != tc.exp {
+			t.Errorf("%s into %T: expected %s, found %s", tc.val, tc.dest, tc.exp, found)
+		}
+	}
+}
+
+func TestScanTime(t *testing.T) {
+	RunTestFromString(t, `
+wait timeout=3m30s at=2024-01-01T00:00:00Z until=2024-01-01T01:30:00.5+02:00
+----
+3m30s 2024-01-01 00:00:00 +0000 UTC 2023-12-31 23:30:00.5 +0000 UTC
+`, func(t *testing.T, d *TestData) string {
+		var timeout time.Duration
+		var at, until time.Time
+		d.ScanArgs(t, "timeout", &timeout)
+		d.ScanArgs(t, "at", &at)
+		d.ScanArgs(t, "until", &until)
+		return fmt.Sprint(timeout, " ", at, " ", until.UTC())
+	})
+
+	for val, dest := range map[string]interface{}{
+		"3":          new(time.Duration),
+		"2024-01-01": new(time.Time),
+	} {
+		if err := scanValue(val, dest); err == nil {
+			t.Errorf("%s into %T: expected an error", val, dest)
+		}
+	}
+}
+
+func TestScanNet(t *testing.T) {
+	RunTestFromString(t, `
+route ip=10.0.0.1 ip6=fe80::1 net=10.0.0.0/8 url=http://[::1]:8080/path?q=1&r=%20
+----
+10.0.0.1 fe80::1 10.0.0.0/8 [::1]:8080 /path q=1&r=%20
+`, func(t *testing.T, d *TestData) string {
+		var ip, ip6 net.IP
+		var ipNet net.IPNet
+		var u url.URL
+		d.ScanArgs(t, "ip", &ip)
+		d.ScanArgs(t, "ip6", &ip6)
+		d.ScanArgs(t, "net", &ipNet)
+		d.ScanArgs(t, "url", &u)
+		return fmt.Sprint(ip, " ", ip6, " ", ipNet.String(), " ", u.Host, " ", u.Path, " ", u.RawQuery)
+	})
+
+	for val, dest := range map[string]interface{}{
+		"10.0.0":    new(net.IP),
+		"10.0.0.1":  new(net.IPNet),
+		"/relative": new(url.URL),
+	} {
+		if err := scanValue(val, dest); err == nil {
+			t.Errorf("%s into %T: expected an error", val, dest)
+		}
+	}
+}
+
+func TestScanByteSize(t *testing.T) {
+	RunTestFromString(t, `
+cache size=64KiB limit=1.5GB block=4_096B
+----
+65536 1500000000 4096
+`, func(t *testing.T, d *TestData) string {
+		var size int64
+		var limit uint64
+		var block int
+		d.ScanArgs(t, "size", &size)
+		d.ScanArgs(t, "limit", &limit)
+		d.ScanArgs(t, "block", &block)
+		return fmt.Sprint(size, limit, block)
+	})
+
+	for _, tc := range []struct {
+		val   string
+		bytes float64
+		ok    bool
+	}{
+		{"1mib", 1 << 20, true},
+		{"-2KB", -2000, true},
+		{"1.5KiB", 1536, true},
+		{"1.5B", 0, false},
+		{"10", 0, false},
+		{"KiB", 0, false},
+		{"1 KiB", 0, false},
+		{"1XB", 0, false},
+	} {
+		if bytes, ok := parseByteSize(tc.val); bytes != tc.bytes || ok != tc.ok {
+			t.Errorf("%s: expected %v, %t, found %v, %t", tc.val, tc.bytes, tc.ok, bytes, ok)
+		}
+	}
+	var n uint32
+	if err := scanValue("8GiB", &n); err == nil {
+		t.Errorf("expected 8GiB to be out of range for uint32")
+	}
+}
+
+func TestBoolArgs(t *testing.T) {
+	RunTestFromString(t, `
+run a b=false c=1 d=yes e=NO
+----
+a=true b=false c=true d=true e=false f=false
+`, func(t *testing.T, d *TestData) string {
+		var a bool
+		d.ScanArgs(t, "a", &a)
+		arg, _ := d.GetArg("a")
+		var a2 bool
+		arg.Scan(t, 0, &a2)
+		if a != a2 || a != d.ArgBool(t, "a") {
+			t.Errorf("inconsistent bare key: %t, %t, %t", a, a2, d.ArgBool(t, "a"))
+		}
+		var buf strings.Builder
+		for _, key := range []string{"a", "b", "c", "d", "e", "f"} {
+			fmt.Fprintf(&buf, "%s=%t ", key, d.ArgBool(t, key))
+		}
+		return strings.TrimSpace(buf.String())
+	})
+}
+
+func TestWrapOutput(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"short\n",
+		"0123456789abcdefghijklmnopqrstuvwxyz\n",
+		"ends with a backslash \\\n\\\n",
+		"ünïcödé ünïcödé ünïcödé\n",
+	} {
+		if w := wrapOutput(s, 10); unwrapOutput(w) != s {
+			t.Errorf("%q wrapped to %q, unwrapped to %q", s, w, unwrapOutput(w))
+		}
+	}
+
+	const input = `
+print
+0123456789abcdefghijklmnopqrstuvwxyz
+----
+
+print wrap=0
+0123456789abcdefghijklmnopqrstuvwxyz
+----
+
+print
+a\
+----
+`
+	const expected = `
+print
+0123456789abcdefghijklmnopqrstuvwxyz
+----
+012345678\
+9abcdefgh\
+ijklmnopq\
+rstuvwxyz
+
+print wrap=0
+0123456789abcdefghijklmnopqrstuvwxyz
+----
+0123456789abcdefghijklmnopqrstuvwxyz
+
+print
+a\
+----
+----
+a\\
+
+----
+----
+`
+	print := func(t *testing.T, d *TestData) string {
+		return d.Input + "\n"
+	}
+	out := runTestInternal(t, "<string>", strings.NewReader(input), print, true /* rewrite */, WrapOutput(10), FrameworkArgs())
+	if string(out) != expected {
+		t.Errorf("expected:\n%s\nfound:\n%s", expected, out)
+	}
+	RunTestFromString(t, expected, print, WrapOutput(10), FrameworkArgs())
+}
+
+func TestSortOutput(t *testing.T) {
+	const input = `
+keys sort-output
+c b a
+----
+
+keys
+c b a
+----
+`
+	const expected = `
+keys sort-output
+c b a
+----
+a
+b
+c
+
+keys
+c b a
+----
+c
+b
+a
+`
+	keys := func(t *testing.T, d *TestData) string {
+		return strings.Join(strings.Fields(d.Input), "\n")
+	}
+	out := runTestInternal(t, "<string>", strings.NewReader(input), keys, true /* rewrite */, FrameworkArgs())
+	if string(out) != expected {
+		t.Errorf("expected:\n%s\nfound:\n%s", expected, out)
+	}
+	RunTestFromString(t, expected, keys, FrameworkArgs())
+	RunTestFromString(t, `
+keys sort-output=false
+c b a
+----
+c
+b
+a
+`, keys, FrameworkArgs())
+}
+
+func TestPostRewrite(t *testing.T) {
+	defer func(old bool) { *rewriteTestFiles = old }(*rewriteTestFiles)
+	*rewriteTestFiles = true
+	defer func(files, changed int) {
+		rewriteStats.files, rewriteStats.changed = files, changed
+	}(rewriteStats.files, rewriteStats.changed)
+
+	dir, err := ioutil.TempDir("", "datadriven")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test")
+	const input = "echo\nhello\n----\n"
+	echo := func(t *testing.T, d *TestData) string { return d.Input }
+
+	for _, veto := range []bool{false, true} {
+		if err := ioutil.WriteFile(path, []byte(input), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var old, new string
+		RunTest(t, path, echo, PostRewrite(func(p string, o, n []byte) ([]byte, bool) {
+			if p != path {
+				t.Errorf("unexpected path %s", p)
+			}
+			old, new = string(o), string(n)
+			return append([]byte("# header\n"), n...), !veto
+		}))
+		if old != input || new != input+"hello\n" {
+			t.Errorf("unexpected contents passed to the hook:\n%s\n%s", old, new)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "# header\n" + input + "hello\n"
+		if veto {
+			expected = input
+		}
+		if string(data) != expected {
+			t.Errorf("expected:\n%s\nfound:\n%s", expected, data)
+		}
+	}
+}
+
+func TestRewriteToStdout(t *testing.T) {
+	defer func(old bool) { *rewriteToStdout = old }(*rewriteToStdout)
+	*rewriteToStdout = true
+	defer func(w io.Writer) { rewriteStdout.w = w }(rewriteStdout.w)
+	var buf bytes.Buffer
+	rewriteStdout.w = &buf
+	defer func(files, changed int) {
+		rewriteStats.files, rewriteStats.changed = files, changed
+	}(rewriteStats.files, rewriteStats.changed)
+
+	dir, err := ioutil.TempDir("", "datadriven")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test")
+	const input = "echo\nhello\n----\n"
+	if err := ioutil.WriteFile(path, []byte(input), 0444); err != nil {
+		t.Fatal(err)
+	}
+	RunTest(t, path, func(t *testing.T, d *TestData) string { return d.Input })
+	if expected := fmt.Sprintf("=== REWRITE %[1]s\n%[2]shello\n=== END %[1]s\n", path, input); buf.String() != expected {
+		t.Errorf("expected:\n%s\nfound:\n%s", expected, buf.String())
+	}
+	if data, err := ioutil.ReadFile(path); err != nil {
+		t.Fatal(err)
+	} else if string(data) != input {
+		t.Errorf("the test file was modified:\n%s", data)
+	}
+}
+
+func TestRewriteUnchanged(t *testing.T) {
+	defer func(old bool) { *rewriteTestFiles = old }(*rewriteTestFiles)
+	*rewriteTestFiles = true
+	defer func(files, changed int) {
+		rewriteStats.files, rewriteStats.changed = files, changed
+	}(rewriteStats.files, rewriteStats.changed)
+
+	dir, err := ioutil.TempDir("", "datadriven")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test")
+	if err := ioutil.WriteFile(path, []byte("echo\nhello\n----\nhello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	RunTest(t, path, func(t *testing.T, d *TestData) string { return d.Input })
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if !info.ModTime().Equal(mtime) {
+		t.Errorf("the test file was written: modified at %s, expected %s", info.ModTime(), mtime)
+	}
+}
+
+func TestRewriteError(t *testing.T) {
+	for _, err := range []error{
+		&os.PathError{Op: "open", Path: "testdata/foo", Err: os.ErrPermission},
+		&os.PathError{Op: "write", Path: "testdata/foo", Err: syscall.EROFS},
+	} {
+		msg := rewriteError("testdata/foo", err).Error()
+		if !strings.HasPrefix(msg, "cannot rewrite testdata/foo, which is read-only") ||
+			!strings.Contains(msg, "-datadriven-rewrite-stdout") {
+			t.Errorf("unexpected error: %s", msg)
+		}
+	}
+	if err := errors.New("boom"); rewriteError("testdata/foo", err) != err {
+		t.Errorf("unexpected error: %v", rewriteError("testdata/foo", err))
+	}
+}
+
+func TestKeepOldExpected(t *testing.T) {
+	const input = `
+echo
+a
+
+b
+----
+----
+x
+
+y
+----
+----
+
+echo
+same
+----
+same
+
+echo
+new
+----
+`
+	const expected = `
+echo
+a
+
+b
+----
+----
+a
+
+b
+----
+----
+
+# previous expected output, remove after review:
+# x
+#
+# y
+
+echo
+same
+----
+same
+
+echo
+new
+----
+new
+`
+	out := runTestInternal(t, "<string>", strings.NewReader(input), func(t *testing.T, d *TestData) string {
+		return d.Input
+	}, true /* rewrite */, KeepOldExpected())
+	if string(out) != expected {
+		t.Errorf("expected:\n%s\nfound:\n%s", expected, out)
+	}
+}
+
+func TestAlternativeExpected(t *testing.T) {
+	const input = `
+plan
+a
+----
+b
+---- or
+a
+
+plan
+a
+----
+----
+c
+
+d
+----
+----
+---- or
+a
+
+plan
+x
+----
+a
+---- or
+b
+`
+	plan := func(t *testing.T, d *TestData) string { return d.Input }
+	RunTestFromString(t, strings.Replace(input, "plan\nx", "plan\nb", 1), plan)
+
+	// The alternatives are kept when rewriting if one of them matches, and
+	// replaced with the actual output otherwise.
+	out := runTestInternal(t, "<string>", strings.NewReader(input), plan, true /* rewrite */)
+	if expected := strings.Replace(input, "----\na\n---- or\nb\n", "----\nx\n", 1); string(out) != expected {
+		t.Errorf("expected:\n%s\nfound:\n%s", expected, out)
+	}
+
+	// The failure shows all the alternatives.
+	d := &TestData{Expected: "a\n", alternatives: []string{"b\n"}}
+	if equal, diff := compareOutput(t, d, "x\n"); equal || diff != "\nor expected:\nb\n" {
+		t.Errorf("unexpected comparison: %t %q", equal, diff)
+	}
+}
+
+func TestNoRewrite(t *testing.T) {
+	defer func(old []string) { pinnedChanges.positions = old }(pinnedChanges.positions)
+	pinnedChanges.positions = nil
+
+	const input = `
+echo no-rewrite
+a
+----
+hand-curated
+
+echo no-rewrite
+b
+----
+b
+
+echo
+c
+----
+stale
+`
+	echo := func(t *testing.T, d *TestData) string { return d.Input }
+	out := runTestInternal(t, "<string>", strings.NewReader(input), echo, true /* rewrite */, FrameworkArgs())
+	if expected := strings.Replace(input, "stale", "c", 1); string(out) != expected {
+		t.Errorf("expected:\n%s\nfound:\n%s", expected, out)
+	}
+
+	var buf bytes.Buffer
+	reportPinnedChanges(&buf)
+	if expected := "1 directive(s) with no-rewrite would have changed:\n  <string>:2\n"; buf.String() != expected {
+		t.Errorf("expected:\n%s\nfound:\n%s", expected, buf.String())
+	}
+}
+
+func TestDirectiveStats(t *testing.T) {
+	if os.Getenv("DATADRIVEN_TEST_CHILD") != "" {
+		defer reportDirectiveStats(os.Stdout)
+		RunTestFromString(t, keepGoingFailures, func(t *testing.T, d *TestData) string {
+			return d.Cmd
+		}, KeepGoing())
+		return
+	}
+	// All the directives which fail with KeepGoing are counted.
+	if out := runChild(t, "TestDirectiveStats", "-datadriven-stats"); !strings.Contains(out, "<string>: 4 directive(s), 3 failed") {
+		t.Errorf("unexpected stats:\n%s", out)
+	}
+
+	defer func(old bool) { *statsFlag = old }(*statsFlag)
+	*statsFlag = true
+	defer func(old map[string]map[string]*commandStats) { directiveStats.files = old }(directiveStats.files)
+	directiveStats.files = nil
+
+	RunTestFromString(t, `
+put
+----
+
+get
+----
+
+put
+----
+`, func(t *testing.T, d *TestData) string { return "" })
+	cmds := directiveStats.files["<string>"]
+	if len(cmds) != 2 || cmds["put"].directives != 2 || cmds["get"].directives != 1 {
+		t.Errorf("unexpected stats: %v", cmds)
+	}
+
+	directiveStats.files = nil
+	recordDirectiveStats("b", "put", false, 20*time.Millisecond)
+	recordDirectiveStats("a", "put", false, 10*time.Millisecond)
+	recordDirectiveStats("a", "scan", true, 30*time.Millisecond)
+	recordDirectiveStats("a", "put", false, 10*time.Millisecond)
+	var buf bytes.Buffer
+	reportDirectiveStats(&buf)
+	if expected := `a: 3 directive(s), 1 failed, 50ms
+  scan 1 directive(s), 1 failed, 30ms
+  put  2 directive(s), 0 failed, 20ms
+b: 1 directive(s), 0 failed, 20ms
+  put 1 directive(s), 0 failed, 20ms
+`; buf.String() != expected {
+		t.Errorf("expected:\n%s\nfound:\n%s", expected, buf.String())
+	}
+}
+
+func TestWalkProgress(t *testing.T) {
+	defer func(w io.Writer) { progressOutput = w }(progressOutput)
+	var buf bytes.Buffer
+	progressOutput = &buf
+
+	dir, err := ioutil.TempDir("", "datadriven-progress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	for _, name := range []string{"a", "b", "c.skip"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("run\n----\nok\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := countWalkFiles(dir, &options{}, nil /* ancestors */); n != 2 {
+		t.Errorf("expected 2 files, found %d", n)
+	}
+	Walk(t, dir, func(t *testing.T, path string) {
+		RunTest(t, path, func(t *testing.T, d *TestData) string {
+			time.Sleep(50 * time.Millisecond)
+			return "ok"
+		})
+	}, WalkProgress(20*time.Millisecond))
+	out := buf.String()
+	for _, s := range []string{"datadriven: 0/2 test files completed", "running " + filepath.Join(dir, "a") + ":1 (run)"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("expected %q in:\n%s", s, out)
+		}
+	}
+
+	// The directives report to the progress of the Walk run by their
+	// ancestor test, and the files which are not run, e.g. because they are
+	// filtered out by -run, are removed from the total.
+	p := startProgress(t, 3, time.Hour)
+	t.Run("file", func(t *testing.T) {
+		defer trackProgress(t, "f", &TestData{Pos: Pos{File: "f", Line: 1}, Cmd: "run"})()
+		buf.Reset()
+		p.report(&buf)
+		if exp := "0/3 test files completed after 0s; running f:1 (run)\n"; !strings.HasSuffix(buf.String(), exp) {
+			t.Errorf("expected %q, found %q", exp, buf.String())
+		}
+	})
+	p.filesDone(1)
+	p.filesSkipped(1)
+	buf.Reset()
+	p.report(&buf)
+	if exp := "datadriven: 1/2 test files completed after 0s\n"; buf.String() != exp {
+		t.Errorf("expected %q, found %q", exp, buf.String())
+	}
+	p.filesSkipped(1)
+	select {
+	case <-p.stopped:
+	case <-time.After(10 * time.Second):
+		t.Errorf("expected the progress to stop once all the files are completed")
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	if isQuiet(nil) || isQuiet(&options{}) {
+		t.Errorf("unexpected quiet mode")
+	}
+	o := makeOptions([]Option{Quiet()})
+	if !isQuiet(&o) {
+		t.Errorf("expected quiet mode with Quiet")
+	}
+	defer func(old bool) { *quietFlag = old }(*quietFlag)
+	*quietFlag = true
+	if !isQuiet(nil) {
+		t.Errorf("expected quiet mode with -datadriven-quiet")
+	}
+
+	defer func(old []string) { pendingDirectives.positions = old }(pendingDirectives.positions)
+	RunTestFromString(t, `
+run pending
+----
+later
+
+run
+----
+ok
+`, func(t *testing.T, d *TestData) string {
+		d.Logf("this message is not shown with -v")
+		return "ok"
+	}, Quiet(), FrameworkArgs())
+}
+
+func TestColor(t *testing.T) {
+	defer func(old colorMode) { colorFlag = old }(colorFlag)
+	if err := colorFlag.Set("sometimes"); err == nil {
+		t.Errorf("expected an error for an invalid color mode")
+	}
+	for _, c := range []struct {
+		mode    colorMode
+		noColor bool
+		color   bool
+	}{
+		{colorAlways, true, true},
+		{colorNever, false, false},
+		{colorAuto, true, false},
+	} {
+		if err := colorFlag.Set(string(c.mode)); err != nil {
+			t.Fatal(err)
+		}
+		func() {
+			if c.noColor {
+				defer func(old string, ok bool) {
+					err := os.Unsetenv("NO_COLOR")
+					if ok {
+						err = os.Setenv("NO_COLOR", old)
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+				}(os.LookupEnv("NO_COLOR"))
+				if err := os.Setenv("NO_COLOR", "1"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if color := useColor(os.Stdout); color != c.color {
+				t.Errorf("%s (NO_COLOR=%t): expected color %t, found %t", c.mode, c.noColor, c.color, color)
+			}
+		}()
+	}
+
+	if diff := colorDiff(lineDiff("a\nb\n", "a\nc\n")); diff != "  a\n\x1b[31m- b\x1b[0m\n\x1b[32m+ c\x1b[0m\n" {
+		t.Errorf("unexpected diff: %q", diff)
+	}
+
+	// The diffs are minimal, and large outputs can be diffed.
+	if diff := lineDiff("a\nb\nc\nd\n", "b\nc\na\nd\ne\n"); diff != "- a\n  b\n  c\n+ a\n  d\n+ e\n" {
+		t.Errorf("unexpected diff: %q", diff)
+	}
+	var expected, actual strings.Builder
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&expected, "%d\n", i)
+		if i%1000 != 0 {
+			fmt.Fprintf(&actual, "%d\n", i)
+		}
+	}
+	if diff := "\n" + lineDiff(expected.String(), actual.String()); strings.Count(diff, "\n- ") != 100 {
+		t.Errorf("unexpected diff: %d removed lines", strings.Count(diff, "\n- "))
+	}
+}
+
+func TestFailureDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datadriven-failures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	o := makeOptions([]Option{FailureDir(dir)})
+	d := &TestData{
+		Pos: Pos{File: "testdata/foo", Line: 12}, Config: "c", Input: "in",
+		Expected: "a\n", line: "run x=1", opts: &o,
+	}
+	path := dumpFailure(t, d, "b\n")
+	if expected := filepath.Join(dir, "testdata_foo_12_c"); path != expected {
+		t.Fatalf("expected %s, found %s", expected, path)
+	}
+	for name, expected := range map[string]string{
+		"input":    "in\n",
+		"expected": "a\n",
+		"actual":   "b\n",
+		"metadata": "test: TestFailureDir\nposition: testdata/foo:12\ndirective: run x=1\nconfig: c\n",
+	} {
+		if data, err := ioutil.ReadFile(filepath.Join(path, name)); err != nil {
+			t.Error(err)
+		} else if string(data) != expected {
+			t.Errorf("%s: expected:\n%s\nfound:\n%s", name, expected, data)
+		}
+	}
+
+	d.opts = &options{}
+	if path := dumpFailure(t, d, "b\n"); path != "" {
+		t.Errorf("unexpected failure artifacts in %s", path)
+	}
+}
+
+func TestGotWantFiles(t *testing.T) {
+	defer func(old bool) { *writeGotWant = old }(*writeGotWant)
+	*writeGotWant = true
+
+	dir, err := ioutil.TempDir("", "datadriven-got-want")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "test")
+	if err := ioutil.WriteFile(path, []byte("\necho\nb\n----\nb\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &TestData{Pos: Pos{File: path, Line: 2}, Expected: "a\n"}
+	note := writeGotWantFiles(t, d, "b\n")
+	if expected := fmt.Sprintf("\nactual and expected output written to %[1]s.2.got and %[1]s.2.want", path); note != expected {
+		t.Errorf("expected %q, found %q", expected, note)
+	}
+	for ext, expected := range map[string]string{".2.got": "b\n", ".2.want": "a\n"} {
+		if data, err := ioutil.ReadFile(path + ext); err != nil {
+			t.Error(err)
+		} else if string(data) != expected {
+			t.Errorf("%s: expected %q, found %q", ext, expected, data)
+		}
+		if !tempFileRe.MatchString(filepath.Base(path + ext)) {
+			t.Errorf("%s is not ignored by Walk", path+ext)
+		}
+	}
+
+	// The files are removed once the directive passes.
+	RunTest(t, path, func(t *testing.T, d *TestData) string { return d.Input })
+	for _, ext := range []string{".2.got", ".2.want"} {
+		if _, err := os.Stat(path + ext); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed: %v", path+ext, err)
+		}
+	}
+}
+
+func TestFailFast(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datadriven-failfast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	for _, name := range []string{"a", "b"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("run\n----\nok\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Once a file failed, the remaining files are skipped.
+	o := makeOptions([]Option{FailFast()})
+	o.walkRoot = dir
+	o.walkFailed = 1
+	var ran []string
+	walk(t, dir, func(t *testing.T, path string) {
+		ran = append(ran, path)
+	}, &o, nil /* ancestors */)
+	if len(ran) > 0 {
+		t.Errorf("unexpected files run after a failure: %v", ran)
+	}
+}
+
+func TestKeepGoing(t *testing.T) {
+	input := `
+run
+----
+ok
+
+keep-going
+
+run
+----
+ok
+
+keep-going off
+
+run
+----
+ok
+`
+	for _, opts := range [][]Option{{BuiltinDirectives()}, {BuiltinDirectives(), KeepGoing()}} {
+		r := newTestDataReader(t, "<string>", strings.NewReader(input), false, makeOptions(opts))
+		var states []bool
+		for r.Next(t) {
+			states = append(states, r.keepGoing)
+		}
+		want := []bool{len(opts) > 1, true, false}
+		if !reflect.DeepEqual(states, want) {
+			t.Errorf("opts %d: expected keep-going states %v, found %v", len(opts), want, states)
+		}
+	}
+
+	// The directive does not produce output, and is kept when rewriting.
+	out := runTestInternal(t, "<string>", strings.NewReader(input), func(t *testing.T, d *TestData) string {
+		return "ok\n"
+	}, true /* rewrite */, BuiltinDirectives())
+	if string(out) != input {
+		t.Errorf("unexpected rewrite:\n%s", out)
+	}
+}
+
+func TestFailureSummary(t *testing.T) {
+	r := newTestDataReader(t, "test.txt", strings.NewReader(""), false, makeOptions(nil))
+	r.recordFailure(&TestData{Pos: Pos{File: "test.txt", Line: 3}, Cmd: "put"})
+	r.recordFailure(&TestData{Pos: Pos{File: "test.txt", Line: 12}, Cmd: "get"})
+	want := []string{"test.txt:3: put", "test.txt:12: get"}
+	if !reflect.DeepEqual(r.failures, want) {
+		t.Errorf("expected failures %q, found %q", want, r.failures)
+	}
+}
+
+// keepGoingFailures is a test file in which three directives fail with
+// KeepGoing.
+const keepGoingFailures = `
+put
+----
+wrong
+
+get
+----
+wrong
+
+ok
+----
+ok
+
+del
+----
+wrong
+`
+
+// runChild runs the given test in a child process, in which
+// DATADRIVEN_TEST_CHILD is set, so that the test can check the outcome of
+// test files which fail. It returns the output of the child.
+func runChild(t *testing.T, test string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], append([]string{"-test.run=^" + test + "$", "-test.v"}, args...)...)
+	cmd.Env = append(os.Environ(), "DATADRIVEN_TEST_CHILD=1")
+	out, err := cmd.CombinedOutput()
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestKeepGoingFailures(t *testing.T) {
+	if os.Getenv("DATADRIVEN_TEST_CHILD") != "" {
+		RunTestFromString(t, keepGoingFailures, func(t *testing.T, d *TestData) string {
+			return d.Cmd
+		}, KeepGoing())
+		return
+	}
+	out := runChild(t, "TestKeepGoingFailures")
+	defer func() {
+		if t.Failed() {
+			t.Logf("output:\n%s", out)
+		}
+	}()
+	if expected := "<string>: 3 directives failed:\n" +
+		"          <string>:2: put\n" +
+		"          <string>:6: get\n" +
+		"          <string>:14: del\n"; !strings.Contains(out, expected) {
+		t.Errorf("expected the summary of the failures")
+	}
+}
+
+func TestKeepGoingErrors(t *testing.T) {
+	if os.Getenv("DATADRIVEN_TEST_CHILD") != "" {
+		RunTestFromString(t, keepGoingFailures, func(t *testing.T, d *TestData) string {
+			if d.Cmd == "get" {
+				d.Errorf(t, "cannot get")
+				return "garbage"
+			}
+			return d.Cmd
+		}, KeepGoing())
+		return
+	}
+	// The error stops the test file after the first mismatch, before the
+	// output of the directive is compared.
+	out := runChild(t, "TestKeepGoingErrors")
+	if !strings.Contains(out, "<string>:6: cannot get") {
+		t.Errorf("expected the error, found:\n%s", out)
+	}
+	if strings.Contains(out, "garbage") || strings.Contains(out, "<string>:14") {
+		t.Errorf("unexpected output after the error:\n%s", out)
+	}
+}
+
+func TestReportStale(t *testing.T) {
+	if os.Getenv("DATADRIVEN_TEST_CHILD") != "" {
+		defer func() { fmt.Printf("only stale: %t\n", onlyStaleTests()) }()
+		RunTestFromString(t, keepGoingFailures, func(t *testing.T, d *TestData) string {
+			return d.Cmd
+		}, KeepGoing())
+		return
+	}
+	defer func(stale, other int, staleTests, otherTests, tests, failedTests map[string]bool) {
+		failedDirectives.stale, failedDirectives.other = stale, other
+		failedDirectives.staleTests, failedDirectives.otherTests = staleTests, otherTests
+		failedDirectives.tests, failedDirectives.failedTests = tests, failedTests
+	}(failedDirectives.stale, failedDirectives.other, failedDirectives.staleTests, failedDirectives.otherTests,
+		failedDirectives.tests, failedDirectives.failedTests)
+
+	for _, tc := range []struct {
+		stale, other int
+		allStale     bool
+		expected     string
+	}{
+		{0, 0, false, ""},
+		{0, 2, false, ""},
+		{3, 0, true, "3 directive(s) are stale; run with -rewrite to update their expected output\n"},
+		{1, 2, false, "1 directive(s) are stale; run with -rewrite to update their expected output\n" +
+			"2 other directive(s) failed, which -rewrite does not fix\n"},
+	} {
+		failedDirectives.stale, failedDirectives.other = 0, 0
+		for i := 0; i < tc.stale; i++ {
+			recordFailedDirective("TestStale", true)
+		}
+		for i := 0; i < tc.other; i++ {
+			recordFailedDirective("TestOther", false)
+		}
+		var buf bytes.Buffer
+		if allStale := reportStale(&buf); allStale != tc.allStale || buf.String() != tc.expected {
+			t.Errorf("%d stale, %d other: expected %t %q, found %t %q",
+				tc.stale, tc.other, tc.allStale, tc.expected, allStale, buf.String())
+		}
+	}
+
+	// The stale exit code only applies if the failed tests only failed
+	// because of stale directives.
+	failedDirectives.staleTests, failedDirectives.otherTests = nil, nil
+	if onlyStaleTests() {
+		t.Errorf("expected no stale tests when no test failed")
+	}
+	recordFailedDirective("TestA/file/1_run", true)
+	recordFailedFile("TestA/file")
+	if !onlyStaleTests() {
+		t.Errorf("expected only stale tests")
+	}
+	for _, fail := range []func(){
+		// A directive failed otherwise.
+		func() {
+			recordFailedDirective("TestB", true)
+			recordFailedDirective("TestB", false)
+			recordFailedFile("TestB")
+		},
+		// A test file failed without a failed directive, e.g. with a
+		// syntax error.
+		func() {
+			recordFailedDirective("TestC/a", true)
+			recordFailedFile("TestC/a")
+			recordFailedFile("TestC/b")
+		},
+	} {
+		failedDirectives.staleTests, failedDirectives.otherTests = nil, nil
+		recordFailedDirective("TestA/file/1_run", true)
+		recordFailedFile("TestA/file")
+		fail()
+		if onlyStaleTests() {
+			t.Errorf("expected tests which failed otherwise")
+		}
+	}
+
+	// The failures are recorded as the test files run.
+	if out := runChild(t, "TestReportStale"); !strings.Contains(out, "only stale: true\n") {
+		t.Errorf("expected only stale directives, found:\n%s", out)
+	}
+}
+
+func TestLexer(t *testing.T) {
+	input := `# comment
+config a b
+
+put k=(1, 2) \
+  v=x # trailing
+input line
+----
+out
+---- or
+other
+
+#| block
+|#
+get
+----
+----
+one
+
+two
+----
+----
+---- b
+b out
+`
+	expected := `1:1 comment "# comment"
+2:1 cmd "config"
+2:8 arg-key "a"
+2:10 arg-key "b"
+4:1 cmd "put"
+4:5 arg-key "k"
+4:8 arg-value "1"
+4:11 arg-value "2"
+4:14 continuation "\\"
+5:3 arg-key "v"
+5:5 arg-value "x"
+5:7 comment "# trailing"
+6:1 input "input line"
+7:1 separator "----"
+8:1 expected "out"
+9:1 separator "---- or"
+10:1 expected "other"
+12:1 comment "#| block"
+13:1 comment "|#"
+14:1 cmd "get"
+15:1 separator "----"
+16:1 separator "----"
+17:1 expected "one"
+18:1 expected ""
+19:1 expected "two"
+20:1 separator "----"
+21:1 separator "----"
+22:1 separator "---- b"
+23:1 expected "b out"
+`
+	l := NewLexer("test", strings.NewReader(input), BuiltinDirectives())
+	var buf strings.Builder
+	for tok, ok := l.Next(); ok; tok, ok = l.Next() {
+		fmt.Fprintf(&buf, "%d:%d %s %q\n", tok.Line, tok.Start, tok.Kind, tok.Text)
+	}
+	if err := l.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != expected {
+		t.Errorf("expected tokens:\n%s\nfound:\n%s", expected, buf.String())
+	}
+
+	l = NewLexer("test", strings.NewReader("#| unterminated\nput\n"))
+	for _, ok := l.Next(); ok; _, ok = l.Next() {
+	}
+	if err := l.Err(); err == nil || err.Error() != "test:1: unterminated block comment" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	l = NewLexer("test", strings.NewReader("put +++\n"))
+	for _, ok := l.Next(); ok; _, ok = l.Next() {
+	}
+	if err := l.Err(); err == nil || !strings.HasPrefix(err.Error(), "test:1: cannot parse directive") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	l = NewLexer("test", strings.NewReader("get\n----\n----\nx\n----\n----\ny\n"))
+	for _, ok := l.Next(); ok; _, ok = l.Next() {
+	}
+	if err := l.Err(); err == nil || err.Error() != "test:7: non-blank line after end of double ---- separator section" {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// The file is only tokenized: it is not skipped, and the included
+	// files are not read.
+	buf.Reset()
+	l = NewLexer("test", strings.NewReader("skipfile wip\ninclude missing\nget\n----\nx\n"), BuiltinDirectives())
+	for tok, ok := l.Next(); ok; tok, ok = l.Next() {
+		fmt.Fprintf(&buf, "%s ", tok.Kind)
+	}
+	if err := l.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "cmd arg-key cmd arg-key cmd separator expected "; buf.String() != expected {
+		t.Errorf("expected tokens %q, found %q", expected, buf.String())
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	// All the test files round-trip.
+	if err := filepath.Walk("testdata", func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		f, err := Parse(path, src, BuiltinDirectives())
+		if err != nil {
+			return err
+		}
+		if out := Format(f); !bytes.Equal(out, src) {
+			t.Errorf("%s: Format does not round-trip:\n%s", path, out)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	src := "# comment\n\nput k=1 \\\n  v=2\ninput\n----\nout\n\nsubtest a\n\nget\n----\n----\nx\n\ny\n----\n----\n"
+	f, err := Parse("test", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf strings.Builder
+	for _, n := range f.Nodes {
+		switch n := n.(type) {
+		case *Directive:
+			fmt.Fprintf(&buf, "directive %s %s\n", n.Cmd, n.CmdArgs)
+			for _, s := range n.Sections() {
+				fmt.Fprintf(&buf, "  %d [%d,%d) %q\n", s.Line, s.Offset, s.EndOffset, s.Text)
+			}
+		case *Trivia:
+			fmt.Fprintf(&buf, "trivia %d [%d,%d) %q\n", n.Line, n.Offset, n.EndOffset, n.Text)
+		}
+	}
+	expected := `trivia 1 [0,11) "# comment\n\n"
+directive put [k=1 v=2]
+  3 [11,27) "put k=1 \\\n  v=2\n"
+  5 [27,33) "input\n"
+  6 [33,42) "----\nout\n"
+trivia 8 [42,43) "\n"
+directive subtest [a]
+  9 [43,53) "subtest a\n"
+  10 [53,53) ""
+  10 [53,53) ""
+trivia 10 [53,54) "\n"
+directive get []
+  11 [54,58) "get\n"
+  12 [58,58) ""
+  12 [58,83) "----\n----\nx\n\ny\n----\n----\n"
+`
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\nfound:\n%s", expected, buf.String())
+	}
+
+	// The sections can be edited before formatting the file.
+	d := f.Directives()[0]
+	d.CmdLine.Text = "put k=1 v=3\n"
+	if out, exp := string(Format(f)), strings.Replace(src, "put k=1 \\\n  v=2", "put k=1 v=3", 1); out != exp {
+		t.Errorf("expected:\n%s\nfound:\n%s", exp, out)
+	}
+}
+
+func TestFormatFile(t *testing.T) {
+	src := "\n\n# comment   \n\n\n  put   k=(1,2) # note\ninput  \n----\nout  \n\n\n\nget \\\n  a=1\n----\n\nkeep  b=(x y)  \n----\n"
+	for _, tc := range []struct {
+		style    Style
+		expected string
+	}{
+		{Style{}, "# comment\n\nput k=(1, 2) # note\ninput  \n----\nout  \n\nget \\\n  a=1\n----\n\nkeep  b=(x y)\n----\n"},
+		{Style{MaxBlankLines: 2, JoinLines: true},
+			"# comment\n\n\nput k=(1, 2) # note\ninput  \n----\nout  \n\n\nget a=1\n----\n\nkeep  b=(x y)\n----\n"},
+	} {
+		out, err := FormatFile([]byte(src), tc.style)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != tc.expected {
+			t.Errorf("%+v: expected:\n%q\nfound:\n%q", tc.style, tc.expected, out)
+		}
+		if again, err := FormatFile(out, tc.style); err != nil || !bytes.Equal(again, out) {
+			t.Errorf("%+v: formatting is not idempotent: %q, %v", tc.style, again, err)
+		}
+	}
+
+	// The line endings are kept.
+	out, err := FormatFile([]byte("put  a\r\n----\r\n"), Style{})
+	if err != nil || string(out) != "put a\r\n----\r\n" {
+		t.Errorf("unexpected output: %q, %v", out, err)
+	}
+	if _, err := FormatFile([]byte("put +++\n"), Style{}); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestLegacyParsing(t *testing.T) {
+	input := `#| not a block comment
+
+include file=a
+----
+include file=a
+
+foreach x=(1, 2)
+----
+foreach x=(1, 2)
+
+echo
+a
+---- or
+b
+----
+a
+---- or
+b
+
+run pending sort-output group=g
+----
+run pending sort-output group=g
+`
+	ran := false
+	RunTestFromString(t, input, func(t *testing.T, d *TestData) string {
+		ran = ran || d.Cmd == "run"
+		if d.Cmd == "echo" {
+			return d.Input + "\n"
+		}
+		return formatCmdLine(d.Cmd, d.CmdArgs) + "\n"
+	}, LegacyParsing(), BuiltinDirectives(), FrameworkArgs())
+	if !ran {
+		t.Errorf("the framework arguments must be handed to the test function")
+	}
+
+	// The blank line which ends an expected output is emptied.
+	out := runTestInternal(t, "<string>", strings.NewReader("a\n----\nx\n  \nb\n----\nx\n"),
+		func(t *testing.T, d *TestData) string { return "x\n" }, true /* rewrite */, LegacyParsing())
+	if expected := "a\n----\nx\n\nb\n----\nx\n"; string(out) != expected {
+		t.Errorf("expected:\n%q\nfound:\n%q", expected, out)
+	}
+
+	var kinds []string
+	l := NewLexer("test", strings.NewReader(input), LegacyParsing())
+	for tok, ok := l.Next(); ok; tok, ok = l.Next() {
+		if tok.Kind != TokenArgKey && tok.Kind != TokenArgValue {
+			kinds = append(kinds, tok.Kind.String())
+		}
+	}
+	if err := l.Err(); err != nil {
+		t.Fatal(err)
+	}
+	expected := "comment cmd separator expected cmd separator expected cmd input input input separator expected expected expected cmd separator expected"
+	if found := strings.Join(kinds, " "); found != expected {
+		t.Errorf("expected tokens:\n%s\nfound:\n%s", expected, found)
+	}
+}
+
+func TestImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datadriven-import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	for name, contents := range map[string]string{
+		"select.sql":           "SELECT 1\n",
+		"select.sql.golden":    "1\n",
+		"nested/insert.sql":    "INSERT 1",
+		"nested/insert.golden": "ok\n\ninserted\n",
+		"orphan.sql":           "SELECT 2\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cases, err := ImportGoldenDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snaps, err := ImportSnapshots([]byte("\n[TestFoo - 1]\nfoo\n---\n\n[TestFoo - 2]\nbar\n  baz\n---\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := FormatCases("run", append(cases, snaps...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `run name=nested/insert.sql
+INSERT 1
+----
+----
+ok
+
+inserted
+----
+----
+
+run name=select.sql
+SELECT 1
+----
+1
+
+run name=TestFoo_-_1
+----
+foo
+
+run name=TestFoo_-_2
+----
+bar
+  baz
+`
+	if string(out) != expected {
+		t.Fatalf("expected:\n%s\nfound:\n%s", expected, out)
+	}
+
+	// The converted cases pass with a handler producing their output.
+	i := 0
+	RunTestFromString(t, string(out), func(t *testing.T, d *TestData) string {
+		i++
+		return append(cases, snaps...)[i-1].Expected
+	})
+
+	if _, err := FormatCases("run", []GoldenCase{{Name: "x", Expected: "a\n----\n"}}); err == nil {
+		t.Errorf("expected an error for a separator line")
+	}
+	if _, err := ImportSnapshots([]byte("[TestFoo - 1]\nfoo\n")); err == nil {
+		t.Errorf("expected an error for an unterminated snapshot")
+	}
+}
+
+func TestExportMarkdown(t *testing.T) {
+	src := "# Not documented.\nput k=a v=1\n----\n\n# Keys can be read back.\n# Missing keys are reported.\nget k=a doc=(Reading a key)\n----\n----\na=1\n\nb: missing\n----\n----\n\nscan doc\na\n----\nx\n---- or\ny\n"
+	md, err := ExportMarkdown("test", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "### Reading a key\n\nKeys can be read back.\nMissing keys are reported.\n\n```\nget k=a\n```\n\nOutput:\n\n```\na=1\n\nb: missing\n```\n\n" +
+		"```\nscan\na\n```\n\nOutput:\n\n```\nx\n```\n"
+	if md != expected {
+		t.Errorf("expected:\n%s\nfound:\n%s", expected, md)
+	}
+}
+
+func TestRunTestInline(t *testing.T) {
+	var positions []string
+	RunTestInline(t, `
+put k=a
+----
+ok
+
+get k=a
+----
+ok
+`, func(t *testing.T, d *TestData) string {
+		positions = append(positions, d.Pos.String())
+		return "ok\n"
+	})
+	_, _, line, _ := runtime.Caller(0)
+	// The directives are 11 and 7 lines above.
+	expected := []string{
+		fmt.Sprintf("datadriven_test.go:%d", line-11),
+		fmt.Sprintf("datadriven_test.go:%d", line-7),
+	}
+	if !reflect.DeepEqual(positions, expected) {
+		t.Errorf("expected positions %v, found %v", expected, positions)
+	}
+}
+
+func TestMinimize(t *testing.T) {
+	const src = `# Setup.
+put
+a=1
+b=2
+c=3
+----
+ok
+
+noise
+----
+ok
+
+subtest x
+
+put
+d=4
+----
+ok
+
+get a c
+----
+a=1
+c=3
+
+subtest end
+`
+	// The put command wrongly overwrites the value of c. The get command
+	// resets the state, so that each run of the file starts afresh.
+	m := map[string]string{}
+	f := func(t *testing.T, d *TestData) string {
+		switch d.Cmd {
+		case "put":
+			for _, l := range strings.Fields(d.Input) {
+				kv := strings.SplitN(l, "=", 2)
+				m[kv[0]], m["c"] = kv[1], kv[1]
+			}
+		case "get":
+			var buf strings.Builder
+			for _, arg := range d.CmdArgs {
+				fmt.Fprintf(&buf, "%s=%s\n", arg.Key, m[arg.Key])
+			}
+			m = map[string]string{}
+			return buf.String()
+		}
+		return "ok\n"
+	}
+	// Minimize can only be called once per test, as the candidates run the
+	// test again in a child process, up to the call to Minimize.
+	t.Run("subtest", func(t *testing.T) {
+		min, err := Minimize(t, []byte(src), f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		const expected = `put
+a=1
+----
+ok
+
+subtest x
+
+put
+d=4
+----
+ok
+
+get a c
+----
+a=1
+c=3
+
+subtest end
+`
+		if string(min) != expected {
+			t.Errorf("expected:\n%s\nfound:\n%s", expected, min)
+		}
+	})
+
+	t.Run("no-failure", func(t *testing.T) {
+		if _, err := Minimize(t, []byte("get\n----\n\n"), f); err == nil || err.Error() != "no directive fails" {
+			t.Errorf("expected no failure, found %v", err)
+		}
+	})
+
+	// A foreach directive is removed along with the directive it applies to.
+	t.Run("foreach", func(t *testing.T) {
+		min, err := Minimize(t, []byte("a\n----\nwrong\n\nforeach x=(1)\nb\n----\nb\n"), f, BuiltinDirectives())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := "a\n----\nwrong\n"; string(min) != expected {
+			t.Errorf("expected:\n%s\nfound:\n%s", expected, min)
+		}
+	})
+
+	// The candidates which fail the test function do not fail the test.
+	t.Run("fatal", func(t *testing.T) {
+		setup := false
+		min, err := Minimize(t, []byte("setup\n----\nok\n\nnoise\n----\nok\n\nget\n----\nwrong\n"),
+			func(t *testing.T, d *TestData) string {
+				switch d.Cmd {
+				case "setup":
+					setup = true
+				case "get":
+					if !setup {
+						t.Fatal("get requires setup")
+					}
+					return "right\n"
+				}
+				return "ok\n"
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := "setup\n----\nok\n\nget\n----\nwrong\n"; string(min) != expected {
+			t.Errorf("expected:\n%s\nfound:\n%s", expected, min)
+		}
+	})
+}
+
+func TestGroup(t *testing.T) {
+	const input = `
+put
+----
+ok
+
+inc group=load
+----
+ok
+
+inc group=load
+----
+ok
+
+get
+----
+2
+`
+	// The directives of the group must run concurrently to pass the
+	// barrier.
+	var mu sync.Mutex
+	count := 0
+	var barrier sync.WaitGroup
+	barrier.Add(2)
+	var names []string
+	RunTestFromString(t, input, func(t *testing.T, d *TestData) string {
+		mu.Lock()
+		names = append(names, t.Name())
+		mu.Unlock()
+		switch d.Cmd {
+		case "inc":
+			barrier.Done()
+			done := make(chan struct{})
+			go func() {
+				barrier.Wait()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("the directives of the group did not run concurrently")
+			}
+			mu.Lock()
+			count++
+			mu.Unlock()
+		case "get":
+			return fmt.Sprintln(count)
+		}
+		return "ok"
+	}, FrameworkArgs())
+	sort.Strings(names)
+	expected := []string{
+		"TestGroup",
+		"TestGroup",
+		"TestGroup/load/6_inc",
+		"TestGroup/load/10_inc",
+	}
+	sort.Strings(expected)
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected tests %v, found %v", expected, names)
+	}
+
+	// The groups run sequentially when rewriting.
+	count = 0
+	out := runTestInternal(t, "<string>", strings.NewReader(input), func(t *testing.T, d *TestData) string {
+		if d.Cmd == "get" {
+			return fmt.Sprintln(count)
+		}
+		if d.Cmd == "inc" {
+			count++
+		}
+		return "ok"
+	}, true /* rewrite */, FrameworkArgs())
+	if string(out) != input {
+		t.Errorf("unexpected rewrite:\n%s", out)
+	}
+
+	// The directives whose output is captured are serialized, so that they
+	// do not capture each other's output.
+	RunTestFromString(t, `
+print a group=g
+----
+a start
+a end
+
+print b group=g
+----
+b start
+b end
+`, func(t *testing.T, d *TestData) string {
+		name := d.CmdArgs[0].Key
+		fmt.Println(name, "start")
+		time.Sleep(10 * time.Millisecond)
+		fmt.Println(name, "end")
+		return ""
+	}, CaptureOutput(CaptureAppend), FrameworkArgs())
+}
+
+func TestScheduleFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datadriven")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	defer func(old string) { _ = os.Setenv("XDG_CACHE_HOME", old) }(os.Getenv("XDG_CACHE_HOME"))
+	if err := os.Setenv("XDG_CACHE_HOME", filepath.Join(dir, "cache")); err != nil {
+		t.Fatal(err)
+	}
+	testdata := filepath.Join(dir, "testdata")
+	if err := os.MkdirAll(filepath.Join(testdata, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c", "d", "sub/e"} {
+		if err := ioutil.WriteFile(filepath.Join(testdata, name), []byte("run\n----\nok\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The durations of successful runs are recorded.
+	t.Run("walk", func(t *testing.T) {
+		Walk(t, testdata, func(t *testing.T, path string) {
+			RunTest(t, path, func(t *testing.T, d *TestData) string { return "ok" })
+		}, Parallel())
+	})
+	for _, name := range []string{"a", "b", "c", "d", "sub/e"} {
+		if _, ok := loadDuration(filepath.Join(testdata, name)); !ok {
+			t.Errorf("%s: no duration recorded", name)
+		}
+	}
+
+	saveDuration(t, filepath.Join(testdata, "b"), time.Second)
+	saveDuration(t, filepath.Join(testdata, "c"), 3*time.Second)
+	saveDuration(t, filepath.Join(testdata, "d"), 2*time.Second)
+	if err := os.Remove(filepath.Join(testdata, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(testdata, "new"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(testdata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduleFiles(testdata, files)
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	if expected := []string{"sub", "new", "c", "d", "b"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected order %v, found %v", expected, names)
+	}
+}
+
+func TestDirectiveSubtestsParallel(t *testing.T) {
+	const input = `
+a
+----
+a
+
+b
+----
+b
+
+c
+----
+c
+`
+	// The directives which call t.Parallel complete after the others.
+	var mu sync.Mutex
+	var order []string
+	t.Run("run", func(t *testing.T) {
+		RunTestFromString(t, input, func(t *testing.T, d *TestData) string {
+			if d.Cmd != "c" {
+				t.Parallel()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			order = append(order, d.Cmd)
+			return d.Cmd
+		}, DirectiveSubtests(nil))
+	})
+	if len(order) > 1 {
+		sort.Strings(order[1:])
+	}
+	if expected := []string{"c", "a", "b"}; !reflect.DeepEqual(order, expected) {
+		t.Errorf("expected completion order %v, found %v", expected, order)
+	}
+
+	// When rewriting, the outputs of the paused directives are put back in
+	// place once they completed.
+	var out []byte
+	t.Run("rewrite", func(t *testing.T) {
+		out = runTestInternal(t, "test", strings.NewReader(`
+a
+----
+
+b
+----
+wrong
+
+c
+----
+`), func(t *testing.T, d *TestData) string {
+			if d.Cmd != "c" {
+				t.Parallel()
+			}
+			return d.Cmd + " " + d.Cmd
+		}, true /* rewrite */, DirectiveSubtests(nil))
+	})
+	if expected := `
+a
+----
+a a
+
+b
+----
+b b
+
+c
+----
+c c
+`; string(out) != expected {
+		t.Errorf("expected:\n%s\nfound:\n%s", expected, out)
+	}
+}
+
+func TestClearResults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datadriven")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "test")
+	if err := ioutil.WriteFile(path, []byte(`config a b
+
+# comment
+put
+k=v
+----
+ok
+
+get
+----
+----
+v
+
+w
+----
+----
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ClearResults(path); err != nil {
+		t.Fatal(err)
+	}
+	const expected = `config a b
+
+# comment
+put
+k=v
+----
+
+get
+----
+`
+	if b, err := ioutil.ReadFile(path); err != nil || string(b) != expected {
+		t.Errorf("expected:\n%s\nfound:\n%s (%v)", expected, b, err)
+	}
+	if err := ClearResults(dir); err == nil {
+		t.Errorf("expected an error for a directory")
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// FileTimeout sets a wall-clock budget for running each test file. If a
+// file takes longer, the directive being run, its input and the stacks of
+// all goroutines are dumped to stderr, and the test binary panics, in the
+// same way as when the -timeout of go test expires. This makes timeouts
+// actionable when a single test file hangs.
+func FileTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.fileTimeout = timeout
+	}
+}
+
+// DirectiveTimeout is like FileTimeout, but sets the budget for running each
+// directive rather than each test file.
+func DirectiveTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.directiveTimeout = timeout
+	}
+}
+
+// watchdog keeps track of the directive being run, to report it if the test
+// file or directive exceeds its deadline.
+type watchdog struct {
+	// what describes what is subject to the deadline, e.g. "foo: test file".
+	what    string
+	timeout time.Duration
+	timer   *time.Timer
+
+	mu struct {
+		sync.Mutex
+		d *TestData
+	}
+}
+
+// startWatchdog starts a watchdog which panics after the timeout, unless
+// stopped.
+func startWatchdog(what string, timeout time.Duration) *watchdog {
+	w := &watchdog{what: what, timeout: timeout}
+	w.timer = time.AfterFunc(timeout, func() {
+		w.dump(os.Stderr)
+		panic(fmt.Sprintf("%s exceeded its deadline of %s", what, timeout))
+	})
+	return w
+}
+
+func (w *watchdog) stop() {
+	w.timer.Stop()
+}
+
+// set records the directive being run, or nil once it completes.
+func (w *watchdog) set(d *TestData) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.mu.d = d
+}
+
+// dump writes the directive being run and the stacks of all goroutines.
+func (w *watchdog) dump(out io.Writer) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	fmt.Fprintf(out, "\n%s exceeded its deadline of %s\n", w.what, w.timeout)
+	if d := w.mu.d; d != nil {
+		fmt.Fprintf(out, "running directive at %s:\n%s\n%s\n", d.Pos, d.line, d.Input)
+	} else {
+		fmt.Fprintf(out, "not running any directive\n")
+	}
+	buf := make([]byte, 1<<20)
+	n := runtime.Stack(buf, true /* all */)
+	fmt.Fprintf(out, "\ngoroutine stacks:\n%s\n", buf[:n])
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import "strings"
+
+// lineDiff returns a line-by-line diff between expected and actual, with
+// lines only in expected prefixed by "-", lines only in actual prefixed by
+// "+" and common lines prefixed by a space. The diff is minimal, and is
+// computed with the linear space variant of the Myers algorithm, so that
+// large outputs can be diffed.
+func lineDiff(expected, actual string) string {
+	a := strings.Split(strings.TrimSuffix(expected, "\n"), "\n")
+	b := strings.Split(strings.TrimSuffix(actual, "\n"), "\n")
+	var buf strings.Builder
+	diffLines(&buf, a, b)
+	return buf.String()
+}
+
+// diffLines writes the diff between a and b to buf, in the format of
+// lineDiff.
+func diffLines(buf *strings.Builder, a, b []string) {
+	// Strip the common prefix and suffix, which also ensures that the
+	// middle snake splits the remaining lines.
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		writeDiffLine(buf, ' ', a[i])
+		i++
+	}
+	a, b = a[i:], b[i:]
+	j := 0
+	for j < len(a) && j < len(b) && a[len(a)-1-j] == b[len(b)-1-j] {
+		j++
+	}
+	suffix := a[len(a)-j:]
+	a, b = a[:len(a)-j], b[:len(b)-j]
+
+	switch {
+	case len(a) == 0:
+		for _, l := range b {
+			writeDiffLine(buf, '+', l)
+		}
+	case len(b) == 0:
+		for _, l := range a {
+			writeDiffLine(buf, '-', l)
+		}
+	default:
+		x, y, u, v := middleSnake(a, b)
+		diffLines(buf, a[:x], b[:y])
+		for _, l := range a[x:u] {
+			writeDiffLine(buf, ' ', l)
+		}
+		diffLines(buf, a[u:], b[v:])
+	}
+	for _, l := range suffix {
+		writeDiffLine(buf, ' ', l)
+	}
+}
+
+// writeDiffLine writes a line of a diff, with the given prefix.
+func writeDiffLine(buf *strings.Builder, prefix byte, line string) {
+	buf.WriteByte(prefix)
+	buf.WriteByte(' ')
+	buf.WriteString(line)
+	buf.WriteByte('\n')
+}
+
+// middleSnake returns the middle snake of a shortest edit script between a
+// and b, which are not empty, i.e. the lines a[x:u], equal to b[y:v], which
+// the script keeps half way through its edits. The forward and backward
+// searches only keep the furthest reaching paths of the current number of
+// edits, hence the linear space.
+func middleSnake(a, b []string) (x, y, u, v int) {
+	n, m := len(a), len(b)
+	max := (n + m + 1) / 2
+	delta := n - m
+	odd := delta%2 != 0
+	// forward[off+k] is the furthest x reached on the diagonal x-y=k by the
+	// forward search, and backward[off+k] is the furthest distance from the
+	// ends reached on the diagonal k by the backward search, which runs on
+	// the reversed lines.
+	off := max + 1
+	forward := make([]int, 2*max+3)
+	backward := make([]int, 2*max+3)
+	for d := 0; d <= max; d++ {
+		for k := -d; k <= d; k += 2 {
+			x := forward[off+k-1] + 1
+			if k == -d || k != d && forward[off+k-1] < forward[off+k+1] {
+				x = forward[off+k+1]
+			}
+			y := x - k
+			x0, y0 := x, y
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[off+k] = x
+			if c := delta - k; odd && c >= -(d-1) && c <= d-1 && x+backward[off+c] >= n {
+				return x0, y0, x, y
+			}
+		}
+		for c := -d; c <= d; c += 2 {
+			x := backward[off+c-1] + 1
+			if c == -d || c != d && backward[off+c-1] < backward[off+c+1] {
+				x = backward[off+c+1]
+			}
+			y := x - c
+			x0, y0 := x, y
+			for x < n && y < m && a[n-1-x] == b[m-1-y] {
+				x++
+				y++
+			}
+			backward[off+c] = x
+			if k := delta - c; !odd && k >= -d && k <= d && x+forward[off+k] >= n {
+				return n - x, m - y, n - x0, m - y0
+			}
+		}
+	}
+	panic("no middle snake")
+}
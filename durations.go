@@ -0,0 +1,84 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadDuration returns the duration of the last successful run of the test
+// file at the given path, if it was recorded.
+func loadDuration(path string) (time.Duration, bool) {
+	cacheFile, err := cachePath("durations", path)
+	if err != nil {
+		return 0, false
+	}
+	data, err := ioutil.ReadFile(cacheFile)
+	if err != nil {
+		return 0, false
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(string(data)))
+	return d, err == nil
+}
+
+// saveDuration records the duration of a successful run of the test file
+// at the given path, for scheduleFiles.
+func saveDuration(t *testing.T, path string, d time.Duration) {
+	cacheFile, err := cachePath("durations", path)
+	if err != nil {
+		t.Logf("cannot record the duration of %s: %v", path, err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(cacheFile), 0755); err != nil {
+		t.Logf("cannot record the duration of %s: %v", path, err)
+		return
+	}
+	if err := ioutil.WriteFile(cacheFile, []byte(d.String()+"\n"), 0644); err != nil {
+		t.Logf("cannot record the duration of %s: %v", path, err)
+	}
+}
+
+// scheduleFiles orders the entries of a directory walked with Parallel so
+// that the longest test files start first, and the wall-clock time is not
+// dominated by a long file which starts last. The directories come first,
+// as they are run before the test files of the directory start anyway. The
+// test files which have no recorded duration, e.g. new ones, come next, as
+// they may be long, followed by the others by decreasing duration of their
+// last successful run.
+func scheduleFiles(dir string, files []os.FileInfo) {
+	durations := make(map[string]time.Duration)
+	for _, file := range files {
+		if d, ok := loadDuration(filepath.Join(dir, file.Name())); ok && !file.IsDir() {
+			durations[file.Name()] = d
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].IsDir() || files[j].IsDir() {
+			return files[i].IsDir() && !files[j].IsDir()
+		}
+		di, iok := durations[files[i].Name()]
+		dj, jok := durations[files[j].Name()]
+		if !iok || !jok {
+			return !iok && jok
+		}
+		return di > dj
+	})
+}
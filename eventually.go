@@ -0,0 +1,77 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// maxEventuallyInterval is the maximum interval between two invocations of
+// the function passed to Eventually.
+const maxEventuallyInterval = time.Second
+
+// Eventually invokes fn repeatedly, with exponential backoff, until its
+// output matches the expected output of the directive (as it would be
+// compared by RunTest, after applying mungers and sorting the lines with
+// the sort-output argument), or until timeout elapses.
+// It returns the last output of fn, which the test function should return.
+// This is useful for directives asserting on state which converges
+// asynchronously:
+//
+//   return d.Eventually(t, 5*time.Second, func() string {
+//     return describeClusterState()
+//   })
+//
+// When rewriting, there is no expected output to wait for, so fn is invoked
+// until its output is the same twice in a row, or until timeout elapses.
+// The same applies to the directives of a macro, whose expected output is
+// only known for the macro invocation as a whole. For the directives
+// generated by foreach, the output is compared with the expected output of
+// the iteration.
+func (td *TestData) Eventually(t *testing.T, timeout time.Duration, fn func() string) string {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	interval := 10 * time.Millisecond
+	var prev string
+	for i := 0; ; i++ {
+		out := fn()
+		munged := sortOutput(t, td, applyMungers(t, td, ensureNewline(out)))
+		if td.Rewrite || td.expectedUnknown {
+			if i > 0 && munged == prev {
+				return out
+			}
+			prev = munged
+		} else if equal, _ := compareOutput(t, td, munged); equal {
+			return out
+		}
+		if time.Now().After(deadline) {
+			return out
+		}
+		time.Sleep(interval)
+		if interval *= 2; interval > maxEventuallyInterval {
+			interval = maxEventuallyInterval
+		}
+	}
+}
+
+// ensureNewline returns s with a trailing newline, unless it is empty.
+func ensureNewline(s string) string {
+	if s != "" && !strings.HasSuffix(s, "\n") {
+		s += "\n"
+	}
+	return s
+}
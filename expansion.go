@@ -0,0 +1,503 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/cockroachdb/errors"
+)
+
+// substitute replaces the ${name} references in s with the values
+// returned by lookup. A reference for which lookup does not return a value
+// results in an error, except for references to environment variables
+// (${env:NAME}), which are left as-is for expandEnv.
+func substitute(s string, lookup func(name string) (string, bool)) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var buf strings.Builder
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end < 0 {
+			return "", errors.Newf("unterminated variable reference: %s", s[start:])
+		}
+		name := s[start+2 : start+end]
+		val, ok := lookup(name)
+		if !ok {
+			if !strings.HasPrefix(name, envVarPrefix) {
+				return "", errors.Newf("undefined variable: %s", name)
+			}
+			val = s[start : start+end+1]
+		}
+		buf.WriteString(s[:start])
+		buf.WriteString(val)
+		s = s[start+end+1:]
+	}
+	buf.WriteString(s)
+	return buf.String(), nil
+}
+
+// foreachVar is a variable of a foreach directive, along with the values
+// it takes.
+type foreachVar struct {
+	name string
+	vals []string
+}
+
+func parseForeachVars(t testing.TB, d *TestData, args []CmdArg) []foreachVar {
+	t.Helper()
+	if len(args) == 0 {
+		d.Fatalf(t, "foreach requires at least one variable")
+	}
+	vars := make([]foreachVar, len(args))
+	for i, arg := range args {
+		if len(arg.Vals) == 0 {
+			d.Fatalf(t, "foreach variable %s has no values", arg.Key)
+		}
+		vars[i] = foreachVar{name: arg.Key, vals: arg.Vals}
+	}
+	return vars
+}
+
+// foreachIteration is one assignment of values to the variables of a
+// foreach directive.
+type foreachIteration []string
+
+// header returns the line which precedes the expected results of the
+// iteration.
+func (it foreachIteration) header(vars []foreachVar) string {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i, v := range vars {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		fmt.Fprintf(&buf, "%s=%s", v.name, it[i])
+	}
+	buf.WriteByte(']')
+	return buf.String()
+}
+
+// foreachIterations returns the cross product of the values of the given
+// variables, with the first variable varying the slowest.
+func foreachIterations(vars []foreachVar) []foreachIteration {
+	res := []foreachIteration{nil}
+	for _, v := range vars {
+		var next []foreachIteration
+		for _, it := range res {
+			for _, val := range v.vals {
+				next = append(next, append(append(foreachIteration(nil), it...), val))
+			}
+		}
+		res = next
+	}
+	return res
+}
+
+// runForeach invokes the test function once per iteration of the foreach
+// directive preceding d, and returns the combined output. The generated
+// directives may invoke the given macros.
+func runForeach(
+	t *testing.T, d *TestData, macros map[string]*macro, f func(*testing.T, *TestData) string,
+) string {
+	t.Helper()
+	iterations := foreachIterations(d.foreach)
+	headers := make([]string, len(iterations))
+	for i, it := range iterations {
+		headers[i] = it.header(d.foreach)
+	}
+	// Each iteration is given its own section of the expected output, e.g.
+	// for Eventually.
+	expected := splitSections(d.Expected, headers)
+	var buf bytes.Buffer
+	for k, it := range iterations {
+		lookup := func(name string) (string, bool) {
+			for i, v := range d.foreach {
+				if v.name == name {
+					return it[i], true
+				}
+			}
+			return "", false
+		}
+		line, err := substitute(d.line, lookup)
+		if err != nil {
+			d.Fatalf(t, "%v", err)
+		}
+		input, err := substitute(d.Input, lookup)
+		if err != nil {
+			d.Fatalf(t, "%v", err)
+		}
+		cmd, args, err := ParseLine(line)
+		if err != nil {
+			d.Fatalf(t, "%v", err)
+		}
+		cmd = normalizeCmd(cmd, d.opts)
+		iterData := *d
+		iterData.Cmd, iterData.CmdArgs, iterData.Input = cmd, args, input
+		iterData.line = line
+		iterData.macro = macros[cmd]
+		iterData.foreach = nil
+		iterData.Expected, iterData.alternatives = expected[k], nil
+		fmt.Fprintln(&buf, headers[k])
+		out := invoke(t, &iterData, f)
+		buf.WriteString(runMungers(t, &iterData, iterData.mungers, out))
+	}
+	return buf.String()
+}
+
+// normalizeCmd returns the command of a directive generated by foreach or
+// a macro, normalized as the reader does for the directives of the test
+// file: lowercased with CaseInsensitiveCommands.
+func normalizeCmd(cmd string, o *options) string {
+	if o != nil && o.caseInsensitiveCmds {
+		return strings.ToLower(cmd)
+	}
+	return cmd
+}
+
+// reportForeachMismatch fails the test, reporting the first iteration of
+// the foreach directive preceding d whose output differs from the
+// expected results.
+func reportForeachMismatch(t *testing.T, d *TestData, actual string) {
+	t.Helper()
+	var headers []string
+	for _, it := range foreachIterations(d.foreach) {
+		headers = append(headers, it.header(d.foreach))
+	}
+	expectedSections := splitSections(d.Expected, headers)
+	actualSections := splitSections(actual, headers)
+	for i, h := range headers {
+		if expectedSections[i] != actualSections[i] {
+			t.Fatalf("\n%s: %s\n%s\nexpected:\n%s\nfound:\n%s",
+				d.Pos, d.Input, h, expectedSections[i], actualSections[i])
+		}
+	}
+}
+
+// splitSections splits s into the sections following each of the given
+// header lines. Text preceding the first header is ignored.
+func splitSections(s string, headers []string) []string {
+	sections := make([]string, len(headers))
+	cur := -1
+	for _, line := range strings.SplitAfter(s, "\n") {
+		if line == "" {
+			continue
+		}
+		if next := cur + 1; next < len(headers) && strings.TrimSuffix(line, "\n") == headers[next] {
+			cur = next
+			continue
+		}
+		if cur >= 0 {
+			sections[cur] += line
+		}
+	}
+	return sections
+}
+
+// macro is a named sequence of directives, defined using the macro
+// directive.
+type macro struct {
+	name   string
+	params []string
+	// body is the text of the directives, which are separated by blank
+	// lines.
+	body string
+	// file and line are the position of the first line of the body.
+	file string
+	line int
+	// macros are all the macros visible from the definition of this
+	// macro, which can be invoked from its body.
+	macros map[string]*macro
+}
+
+// maxMacroDepth limits the nesting of macro invocations, to catch
+// recursive macros.
+const maxMacroDepth = 100
+
+// defineMacro defines a macro from the macro directive that was just read.
+func (r *testDataReader) defineMacro(t testing.TB) {
+	t.Helper()
+	d := &r.data
+	if len(d.CmdArgs) == 0 {
+		d.Fatalf(t, "macro requires a name")
+	}
+	m := &macro{
+		name:   d.CmdArgs[0].Key,
+		body:   d.Input,
+		file:   r.sourceName,
+		line:   d.inputLine,
+		macros: r.macros,
+	}
+	for _, arg := range d.CmdArgs[1:] {
+		if len(arg.Vals) != 0 {
+			d.Fatalf(t, "invalid macro parameter: %s", arg)
+		}
+		m.params = append(m.params, arg.Key)
+	}
+	if m.name == "macro" || m.name == "include" || m.name == "subtest" {
+		d.Fatalf(t, "invalid macro name: %s", m.name)
+	}
+	r.macros[m.name] = m
+}
+
+// include reads the macro definitions from the files named by the given
+// arguments. Paths are relative to the directory of the including file.
+func (r *testDataReader) include(t testing.TB, args []CmdArg) {
+	t.Helper()
+	if len(args) == 0 {
+		r.data.Fatalf(t, "include requires a file name")
+	}
+	for _, arg := range args {
+		path := filepath.Join(filepath.Dir(r.sourceName), arg.Key)
+		recordUsedFile(path)
+		recordDependency(r.sourceName, path)
+		file, err := os.Open(path)
+		if err != nil {
+			r.data.Fatalf(t, "%v", err)
+		}
+		ir := newTestDataReader(t, path, file, false /* record */, r.opts)
+		ir.macros = r.macros
+		if ir.Next(t) {
+			ir.data.Fatalf(t, "included files may only contain macro definitions")
+		}
+		_ = file.Close()
+	}
+}
+
+// runMacro runs the directives of the macro invoked by d, and returns their
+// combined output.
+func runMacro(
+	t *testing.T, d *TestData, f func(*testing.T, *TestData) string, depth int,
+) string {
+	t.Helper()
+	m := d.macro
+	if depth >= maxMacroDepth {
+		d.Fatalf(t, "macro %s: maximum nesting depth exceeded", m.name)
+	}
+	vals := make(map[string]string, len(d.CmdArgs))
+	for _, arg := range d.CmdArgs {
+		switch len(arg.Vals) {
+		case 0:
+			vals[arg.Key] = ""
+		case 1:
+			vals[arg.Key] = arg.Vals[0]
+		default:
+			vals[arg.Key] = "(" + strings.Join(arg.Vals, ", ") + ")"
+		}
+	}
+	for _, p := range m.params {
+		if _, ok := vals[p]; !ok {
+			d.Fatalf(t, "macro %s: missing value for parameter %s", m.name, p)
+		}
+	}
+	if len(vals) != len(m.params) {
+		d.Fatalf(t, "macro %s: expected parameters %v, got %v", m.name, m.params, d.CmdArgs)
+	}
+	lookup := func(name string) (string, bool) {
+		val, ok := vals[name]
+		return val, ok
+	}
+
+	invocation := d.Pos
+	var buf bytes.Buffer
+	lines := strings.Split(m.body, "\n")
+	for i := 0; i < len(lines); {
+		// Skip the blank lines between directives.
+		if strings.TrimSpace(lines[i]) == "" {
+			i++
+			continue
+		}
+		start := i
+		for i < len(lines) && strings.TrimSpace(lines[i]) != "" {
+			i++
+		}
+		// The expected output of the directives of the macro is not known
+		// separately.
+		md := TestData{
+			Pos:             Pos{File: m.file, Line: m.line + start, Macro: m.name, Invocation: &invocation},
+			Config:          d.Config,
+			Rewrite:         d.Rewrite,
+			file:            m.file,
+			opts:            d.opts,
+			logs:            d.logs,
+			expectedUnknown: true,
+		}
+		line, err := substitute(strings.TrimSpace(lines[start]), lookup)
+		if err != nil {
+			md.Fatalf(t, "%v", err)
+		}
+		input, err := substitute(strings.Join(lines[start+1:i], "\n"), lookup)
+		if err != nil {
+			md.Fatalf(t, "%v", err)
+		}
+		md.line = line
+		md.Input = strings.TrimSpace(input)
+		if md.Cmd, md.CmdArgs, err = ParseLine(line); err != nil {
+			md.Fatalf(t, "%v", err)
+		}
+		md.Cmd = normalizeCmd(md.Cmd, d.opts)
+		if md.macro = m.macros[md.Cmd]; md.macro != nil {
+			buf.WriteString(runMacro(t, &md, f, depth+1))
+		} else {
+			out := callHandler(t, &md, f)
+			buf.WriteString(runMungers(t, &md, md.mungers, out))
+		}
+	}
+	return buf.String()
+}
+
+// execute runs the input of d through the template.
+func (it *inputTemplate) execute(t *testing.T, d *TestData) string {
+	t.Helper()
+	tmpl, err := template.New(d.Pos.String()).Funcs(it.funcs).Parse(d.Input)
+	if err != nil {
+		d.Fatalf(t, "%v", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, it.data); err != nil {
+		d.Fatalf(t, "%v", err)
+	}
+	return buf.String()
+}
+
+// envVarPrefix is the prefix of references to environment variables.
+const envVarPrefix = "env:"
+
+// expandEnv replaces the references to environment variables in the
+// arguments and input of d.
+func expandEnv(t *testing.T, d *TestData) {
+	t.Helper()
+	lookup := func(name string) (string, bool) {
+		if !strings.HasPrefix(name, envVarPrefix) {
+			// Leave other references alone.
+			return "${" + name + "}", true
+		}
+		name = strings.TrimPrefix(name, envVarPrefix)
+		return os.LookupEnv(name)
+	}
+	if err := substituteArgs(d.CmdArgs, lookup); err != nil {
+		d.Fatalf(t, "%v", err)
+	}
+	if strings.Contains(d.Input, "${"+envVarPrefix) {
+		input, err := substitute(d.Input, lookup)
+		if err != nil {
+			d.Fatalf(t, "%v", err)
+		}
+		d.Input = input
+	}
+}
+
+// loadArgFiles replaces the argument values of d of the form @path with the
+// contents of the file at path, relative to the directory of the test file.
+// A single trailing newline is removed from the contents.
+func loadArgFiles(t *testing.T, d *TestData) {
+	t.Helper()
+	for i := range d.CmdArgs {
+		vals := d.CmdArgs[i].Vals
+		for j, val := range vals {
+			if !strings.HasPrefix(val, "@") {
+				continue
+			}
+			path := filepath.Join(filepath.Dir(d.file), val[1:])
+			recordUsedFile(path)
+			recordDependency(d.file, path)
+			contents, err := ioutil.ReadFile(path)
+			if err != nil {
+				d.Fatalf(t, "argument %s: %v", d.CmdArgs[i].Key, err)
+			}
+			vals[j] = strings.TrimSuffix(string(contents), "\n")
+		}
+	}
+}
+
+// substituteArgs replaces the ${name} references in the values of args
+// with the values returned by lookup. The values are substituted in place,
+// after the directive line has been parsed, so that the substituted values
+// may contain spaces or other special characters.
+func substituteArgs(args CmdArgs, lookup func(name string) (string, bool)) error {
+	for i := range args {
+		for j, val := range args[i].Vals {
+			v, err := substitute(val, lookup)
+			if err != nil {
+				return err
+			}
+			args[i].Vals[j] = v
+		}
+	}
+	return nil
+}
+
+// unexpandArgs returns a copy of args in which the values which are the
+// expansion of a value in raw, as given by expanded, are replaced with the
+// unexpanded value. A value is looked up under the same key and position
+// first, so that arguments which were renamed by the test function still
+// map back to their unexpanded values.
+func unexpandArgs(args, expanded, raw CmdArgs) CmdArgs {
+	res := cloneArgs(args)
+	if len(expanded) != len(raw) {
+		return res
+	}
+	lookup := func(key string, j int, val string) (string, bool) {
+		for k := range expanded {
+			if expanded[k].Key == key && j < len(expanded[k].Vals) &&
+				expanded[k].Vals[j] == val && j < len(raw[k].Vals) {
+				return raw[k].Vals[j], true
+			}
+		}
+		for k := range expanded {
+			for l := range expanded[k].Vals {
+				if expanded[k].Vals[l] == val && l < len(raw[k].Vals) {
+					return raw[k].Vals[l], true
+				}
+			}
+		}
+		return "", false
+	}
+	for i := range res {
+		for j, val := range res[i].Vals {
+			if rawVal, ok := lookup(res[i].Key, j, val); ok {
+				res[i].Vals[j] = rawVal
+			}
+		}
+	}
+	return res
+}
+
+// cloneArgs returns a copy of args which shares no values with it.
+func cloneArgs(args CmdArgs) CmdArgs {
+	if args == nil {
+		return nil
+	}
+	res := make(CmdArgs, len(args))
+	for i := range args {
+		res[i] = CmdArg{Key: args[i].Key}
+		if args[i].Vals != nil {
+			res[i].Vals = append([]string(nil), args[i].Vals...)
+		}
+	}
+	return res
+}
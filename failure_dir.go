@@ -0,0 +1,83 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var failureDirFlag = flag.String(
+	"datadriven-failure-dir", "",
+	"dump the input, expected and actual output of each mismatched directive into a "+
+		"subdirectory of the given directory. See FailureDir.",
+)
+
+// FailureDir causes the input, expected output, actual output and metadata
+// of each directive whose output does not match the expected output to be
+// written to a subdirectory of dir, named after the position of the
+// directive, e.g. testdata_foo_12. The path of the subdirectory is included
+// in the failure message. The artifacts survive the truncation of CI logs,
+// and can be fed to diff tools. It can also be enabled for all tests with
+// the -datadriven-failure-dir flag.
+func FailureDir(dir string) Option {
+	return func(o *options) {
+		o.failureDir = dir
+	}
+}
+
+// dumpFailure writes the artifacts of a mismatched directive, and returns
+// the path of the directory they are written to, if any.
+func dumpFailure(t *testing.T, d *TestData, actual string) string {
+	t.Helper()
+	dir := *failureDirFlag
+	if d.opts != nil && d.opts.failureDir != "" {
+		dir = d.opts.failureDir
+	}
+	if dir == "" {
+		return ""
+	}
+	name := fmt.Sprintf("%s_%d", d.Pos.File, d.Pos.Line)
+	if d.Config != "" {
+		name += "_" + d.Config
+	}
+	dir = filepath.Join(dir, sanitizeSubtestName(strings.TrimLeft(name, "./")))
+	metadata := fmt.Sprintf("test: %s\nposition: %s\ndirective: %s\n", t.Name(), d.Pos, d.line)
+	if d.Config != "" {
+		metadata += fmt.Sprintf("config: %s\n", d.Config)
+	}
+	files := []struct{ name, contents string }{
+		{"input", ensureNewline(d.Input)},
+		{"expected", d.Expected},
+		{"actual", actual},
+		{"metadata", metadata},
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Logf("%s: cannot write failure artifacts: %v", d.Pos, err)
+		return ""
+	}
+	for _, f := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, f.name), []byte(f.contents), 0644); err != nil {
+			t.Logf("%s: cannot write failure artifacts: %v", d.Pos, err)
+			return ""
+		}
+	}
+	return dir
+}
@@ -0,0 +1,38 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// recordFailure records that a directive of the test file failed.
+func (r *testDataReader) recordFailure(d *TestData) {
+	r.failures = append(r.failures, fmt.Sprintf("%s: %s", d.Pos, d.Cmd))
+}
+
+// reportFailures ends the test file with a summary of the directives which
+// failed, if there are several of them, e.g. with KeepGoing, so that they
+// are not buried in the output of the failures.
+func (r *testDataReader) reportFailures(t *testing.T) {
+	t.Helper()
+	if len(r.failures) < 2 {
+		return
+	}
+	t.Logf("%s: %d directives failed:\n  %s",
+		r.sourceName, len(r.failures), strings.Join(r.failures, "\n  "))
+}
@@ -0,0 +1,173 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+)
+
+// Style configures FormatFile.
+type Style struct {
+	// CommentPrefix, Separator and IndentedArgs describe the syntax of the
+	// test files, as set with the options of the same names. The zero
+	// values are the defaults of RunTest.
+	CommentPrefix string
+	Separator     string
+	IndentedArgs  bool
+	// BuiltinDirectives causes the directives run by the framework with the
+	// option of the same name, e.g. config, to be parsed as such.
+	BuiltinDirectives bool
+	// MaxBlankLines is the maximum number of consecutive blank lines
+	// between directives; 0 means 1.
+	MaxBlankLines int
+	// JoinLines joins the continuation lines and the indented argument
+	// lines of the directives into a single directive line.
+	JoinLines bool
+}
+
+// options returns the options describing the syntax of the test files.
+func (s Style) options() []Option {
+	var opts []Option
+	if s.CommentPrefix != "" {
+		opts = append(opts, CommentPrefix(s.CommentPrefix))
+	}
+	if s.Separator != "" {
+		opts = append(opts, Separator(s.Separator))
+	}
+	if s.IndentedArgs {
+		opts = append(opts, IndentedArgs())
+	}
+	if s.BuiltinDirectives {
+		opts = append(opts, BuiltinDirectives())
+	}
+	return opts
+}
+
+// FormatFile formats a test file in the canonical style:
+//   - the directive lines are unindented, and their arguments are separated
+//     by single spaces and formatted as by CmdArg.String, e.g. a=(1, 2);
+//   - the trailing white space is removed outside of the inputs and
+//     expected outputs;
+//   - the blank lines at the start and the end of the file are removed, and
+//     the runs of blank lines between directives are shortened to
+//     MaxBlankLines;
+//   - the file ends with a newline.
+// The inputs and expected outputs are kept as is, as are the line endings
+// and the byte order mark of the file, if any. An error is returned if the
+// file cannot be parsed.
+func FormatFile(src []byte, style Style) ([]byte, error) {
+	bom := bytes.HasPrefix(src, []byte(utf8BOM))
+	src = bytes.TrimPrefix(src, []byte(utf8BOM))
+	crlf := bytes.Contains(src, []byte("\r\n"))
+	if crlf {
+		src = bytes.Replace(src, []byte("\r\n"), []byte("\n"), -1)
+	}
+	opts := style.options()
+	f, err := Parse("", src, opts...)
+	if err != nil {
+		return nil, err
+	}
+	o := makeOptions(opts)
+	maxBlank := style.MaxBlankLines
+	if maxBlank <= 0 {
+		maxBlank = 1
+	}
+
+	var buf bytes.Buffer
+	for i, n := range f.Nodes {
+		switch n := n.(type) {
+		case *Directive:
+			buf.WriteString(formatDirectiveLine(n, style, o.commentPrefix))
+			buf.WriteString(n.Input.Text)
+			buf.WriteString(n.Expected.Text)
+		case *Trivia:
+			buf.WriteString(formatTrivia(n.Text, maxBlank, i == 0, i == len(f.Nodes)-1))
+		}
+	}
+	out := buf.Bytes()
+	if len(out) > 0 && out[len(out)-1] != '\n' {
+		out = append(out, '\n')
+	}
+	if crlf {
+		out = bytes.Replace(out, []byte("\n"), []byte("\r\n"), -1)
+	}
+	if bom {
+		out = append([]byte(utf8BOM), out...)
+	}
+	return out, nil
+}
+
+// formatDirectiveLine formats the directive line of a directive, including
+// its continuation lines and indented argument lines.
+func formatDirectiveLine(d *Directive, style Style, commentPrefix string) string {
+	lines := strings.Split(strings.TrimSuffix(d.CmdLine.Text, "\n"), "\n")
+	if len(lines) == 1 || style.JoinLines {
+		cmd, args, comment, err := parseCmdLine(d.CmdLine.Text, commentPrefix)
+		line := formatCmdLine(cmd, args)
+		// Keep the directive line as is if formatting it would change its
+		// meaning, e.g. for a single value in parentheses containing a
+		// space.
+		if reCmd, reArgs, reErr := ParseLine(line); err == nil && reErr == nil &&
+			reCmd == cmd && reflect.DeepEqual(CmdArgs(reArgs), args) {
+			if comment != "" {
+				line += " " + comment
+			}
+			return line + "\n"
+		}
+	}
+	var buf strings.Builder
+	for i, l := range lines {
+		if i == 0 {
+			l = strings.TrimLeft(l, " \t")
+		}
+		buf.WriteString(strings.TrimRight(l, " \t") + "\n")
+	}
+	return buf.String()
+}
+
+// formatTrivia formats the text between directives, removing trailing
+// white space and shortening the runs of blank lines. first and last are
+// set for the text at the start and at the end of the file, whose blank
+// lines are removed.
+func formatTrivia(text string, maxBlank int, first, last bool) string {
+	var buf strings.Builder
+	blanks, content := 0, false
+	for _, l := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		l = strings.TrimRight(l, " \t")
+		if l == "" {
+			blanks++
+			continue
+		}
+		if content || !first {
+			buf.WriteString(blankLines(blanks, maxBlank))
+		}
+		buf.WriteString(l + "\n")
+		blanks, content = 0, true
+	}
+	if (content || !first) && !last {
+		buf.WriteString(blankLines(blanks, maxBlank))
+	}
+	return buf.String()
+}
+
+// blankLines returns n blank lines, but no more than max.
+func blankLines(n, max int) string {
+	if n > max {
+		n = max
+	}
+	return strings.Repeat("\n", n)
+}
@@ -0,0 +1,147 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import "testing"
+
+// generatedArg is the argument which marks the directives generated with
+// Enqueue in the test file.
+const generatedArg = "generated"
+
+// Enqueue generates a directive to run immediately after the current one.
+// This allows a directive to expand into a number of variants:
+//
+//   case "expand":
+//     for i := 0; i < n; i++ {
+//       d.Enqueue("variant", CmdArgs{{Key: "i", Vals: []string{fmt.Sprint(i)}}}, d.Input)
+//     }
+//
+// The generated directives are written in the test file after the current
+// directive when rewriting, along with their output, with an additional
+// "generated" argument. They are compared with the generated directives
+// found in the test file otherwise, and the test fails if they differ.
+//
+// Generated directives cannot enqueue directives in turn, and Enqueue has
+// no effect for the directives generated by foreach and macros. It cannot
+// be used in test files which declare configurations, and requires the
+// FrameworkArgs option, for the generated argument to be recognized.
+func (td *TestData) Enqueue(cmd string, args CmdArgs, input string) {
+	args = append(args[:len(args):len(args)], CmdArg{Key: generatedArg})
+	td.enqueued = append(td.enqueued, directiveSpec{cmd: cmd, args: args, input: input})
+}
+
+// directiveSpec describes a directive generated by a test function.
+type directiveSpec struct {
+	cmd   string
+	args  CmdArgs
+	input string
+}
+
+// isGenerated returns whether the directive was generated with Enqueue.
+func isGenerated(d *TestData) bool {
+	if !isFrameworkArg(generatedArg, d.opts) {
+		return false
+	}
+	_, ok := d.CmdArgs.Get(generatedArg)
+	return ok
+}
+
+// runGenerated runs the directives enqueued by the directive which was just
+// run. When rewriting, they replace the generated directives which follow in
+// the test file; otherwise, they are read from the test file.
+func runGenerated(
+	t *testing.T, r *testDataReader, mandatorySubTestPrefix string, f func(*testing.T, *TestData) string,
+) {
+	t.Helper()
+	parent := r.data
+	queue := parent.enqueued
+	r.data.enqueued = nil
+	if !isFrameworkArg(generatedArg, parent.opts) {
+		parent.Fatalf(t, "Enqueue requires the FrameworkArgs option")
+	}
+	if isGenerated(&parent) {
+		parent.Fatalf(t, "generated directives cannot enqueue directives")
+	}
+	if r.matrix != nil || r.config != "" {
+		parent.Fatalf(t, "Enqueue cannot be used in test files which declare configurations")
+	}
+
+	if r.rewrite == nil {
+		for _, g := range queue {
+			line := formatCmdLine(g.cmd, g.args)
+			if !r.Next(t) || !isGenerated(&r.data) {
+				parent.Fatalf(t, "missing generated directive: %s (rewrite the test file)", line)
+			}
+			if formatCmdLine(r.data.Cmd, r.data.CmdArgs) != line || r.data.Input != g.input {
+				r.data.Fatalf(t, "generated directive differs, expected: %s\n%s\n(rewrite the test file)",
+					line, g.input)
+			}
+			runDirectiveOrSubTest(t, r, mandatorySubTestPrefix, f)
+		}
+		if r.Next(t) {
+			if isGenerated(&r.data) {
+				r.data.Fatalf(t, "stale generated directive (rewrite the test file)")
+			}
+			r.pushBack = true
+		}
+		return
+	}
+
+	// Drop the generated directives which follow in the test file, and keep
+	// the text up to the next directive, to add it back after the new ones.
+	mark := r.mark()
+	more := r.Next(t)
+	for more && isGenerated(&r.data) {
+		r.rewrite.Truncate(mark)
+		more = r.Next(t)
+	}
+	next, comment := r.data, r.cmdLineComment
+	blank, blankLine := r.blankAfterExpected, r.blankLine
+	start, cmdEnd, end := r.cmdLineStart-mark, r.cmdLineEnd-mark, r.directiveEnd-mark
+	rest := append([]byte(nil), r.rewrite.Bytes()[mark:]...)
+	r.rewrite.Truncate(mark)
+
+	r.cmdLineComment = ""
+	r.blankAfterExpected, r.blankLine = false, ""
+	for _, g := range queue {
+		r.data = TestData{
+			Pos:     parent.Pos,
+			Cmd:     g.cmd,
+			CmdArgs: g.args,
+			Input:   g.input,
+			Rewrite: true,
+			line:    formatCmdLine(g.cmd, g.args),
+			file:    r.sourceName,
+			opts:    &r.opts,
+		}
+		r.data.macro = r.macros[g.cmd]
+		r.data.wrap = r.wrapWidth(t)
+		r.cmdLineStart = r.mark()
+		r.emit(r.data.line)
+		r.cmdLineEnd = r.mark()
+		if g.input != "" {
+			r.emit(g.input)
+		}
+		r.directiveEnd = r.mark()
+		runDirectiveOrSubTest(t, r, mandatorySubTestPrefix, f)
+	}
+
+	shift := r.mark()
+	r.rewrite.Write(rest)
+	r.data, r.cmdLineComment = next, comment
+	r.blankAfterExpected, r.blankLine = blank, blankLine
+	r.cmdLineStart, r.cmdLineEnd, r.directiveEnd = shift+start, shift+cmdEnd, shift+end
+	r.pushBack = more
+}
@@ -0,0 +1,75 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+var writeGotWant = flag.Bool(
+	"datadriven-got-want", false,
+	"on mismatch, write the actual and expected output of the directive to <file>.<line>.got "+
+		"and <file>.<line>.want, to compare them with external diff tools. The files are removed "+
+		"once the directive passes.",
+)
+
+// gotWantPaths returns the paths of the files which the actual and expected
+// output of a directive are written to with -datadriven-got-want.
+func gotWantPaths(d *TestData) (got, want string) {
+	prefix := fmt.Sprintf("%s.%d", d.Pos.File, d.Pos.Line)
+	return prefix + ".got", prefix + ".want"
+}
+
+// isTestFile returns whether the directive is in a test file on disk, as
+// opposed to e.g. a string passed to RunTestFromString.
+func isTestFile(d *TestData) bool {
+	info, err := os.Stat(d.Pos.File)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// writeGotWantFiles writes the actual and expected output of a mismatched
+// directive with -datadriven-got-want, and returns a note about them for the
+// failure message.
+func writeGotWantFiles(t *testing.T, d *TestData, actual string) string {
+	t.Helper()
+	if !*writeGotWant || !isTestFile(d) {
+		return ""
+	}
+	got, want := gotWantPaths(d)
+	if err := ioutil.WriteFile(got, []byte(actual), 0644); err != nil {
+		t.Logf("%s: %v", d.Pos, err)
+		return ""
+	}
+	if err := ioutil.WriteFile(want, []byte(d.Expected), 0644); err != nil {
+		t.Logf("%s: %v", d.Pos, err)
+		return ""
+	}
+	return fmt.Sprintf("\nactual and expected output written to %s and %s", got, want)
+}
+
+// removeGotWantFiles removes the files written for a directive with
+// -datadriven-got-want once it passes.
+func removeGotWantFiles(d *TestData) {
+	if !*writeGotWant || !isTestFile(d) {
+		return
+	}
+	got, want := gotWantPaths(d)
+	_ = os.Remove(got)
+	_ = os.Remove(want)
+}
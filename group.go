@@ -0,0 +1,103 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"sync"
+	"testing"
+)
+
+// groupArg is the argument which places a directive in a concurrency group.
+// Consecutive directives with the same group=<name> argument run
+// concurrently, each against its own expected output, while the groups and
+// the other directives run sequentially:
+//
+//   put k=a
+//   ----
+//   ok
+//
+//   inc k=a group=load
+//   ----
+//   ok
+//
+//   inc k=a group=load
+//   ----
+//   ok
+//
+//   get k=a
+//   ----
+//   2
+//
+// The directives of a group run in concurrent subtests of a subtest named
+// after the group, so the test function must be safe for concurrent use
+// by them. They cannot generate directives. The groups run sequentially
+// when rewriting, as the rewritten file is produced in order. The test
+// function is not invoked concurrently with CaptureOutput or Hermetic,
+// which rely on process-wide state.
+const groupArg = "group"
+
+// readGroup reads the directives which follow the current one in its
+// concurrency group, if it has the group argument, and returns the
+// directives of the group. It returns nil if the current directive is not
+// in a group, or when rewriting.
+func (r *testDataReader) readGroup(t *testing.T) []TestData {
+	t.Helper()
+	name, ok := r.data.frameworkArgValue(groupArg)
+	if !ok || r.rewrite != nil || (r.matrix != nil && r.matrix.rewrite) {
+		return nil
+	}
+	group := []TestData{r.data}
+	for r.Next(t) {
+		if other, ok := r.data.frameworkArgValue(groupArg); !ok || other != name || r.data.Cmd == "subtest" {
+			r.pushBack = true
+			break
+		}
+		group = append(group, r.data)
+	}
+	return group
+}
+
+// runGroup runs the directives of a concurrency group in concurrent
+// subtests. They are started from their own goroutines rather than with
+// t.Parallel, so that they are not limited by -test.parallel.
+func runGroup(t *testing.T, r *testDataReader, group []TestData, f func(*testing.T, *TestData) string) {
+	t.Helper()
+	name, _ := group[0].ArgValue(groupArg, 0)
+	readers := make([]*testDataReader, len(group))
+	t.Run(sanitizeSubtestName(name), func(t *testing.T) {
+		var wg sync.WaitGroup
+		defer wg.Wait()
+		for i := range group {
+			// Each directive is run with its own copy of the reader, which
+			// does not read any further.
+			gr := *r
+			gr.data, gr.failures = group[i], nil
+			readers[i] = &gr
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				t.Run(r.opts.directiveSubtestNameFor(&gr.data), func(t *testing.T) {
+					runDirective(t, &gr, f)
+					if len(gr.data.enqueued) > 0 {
+						gr.data.Fatalf(t, "directives cannot be generated in a concurrency group")
+					}
+				})
+			}()
+		}
+	})
+	for _, gr := range readers {
+		r.failures = append(r.failures, gr.failures...)
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Hermetic confines the files used by the test function to a scratch
+// directory, which is created for each test file and removed afterwards:
+//
+//  - references to ${scratch} in the arguments and input of directives are
+//    replaced with the path of the scratch directory;
+//  - TestData.ScratchPath resolves paths relative to the scratch directory,
+//    and rejects paths which escape it;
+//  - the files under the testdata root (see TestdataRoot), or else under
+//    the testdata directory of the working directory, if any, or the
+//    working directory itself, are audited around every directive, which
+//    fails if it created, modified or removed any file outside the scratch
+//    directory. The directives are serialized for this purpose, even in
+//    concurrency groups or with Parallel.
+//
+// This keeps test files reproducible across machines. The audit reads all
+// the audited files twice per directive, to compare their modification
+// times, sizes and contents, so it is slow for large trees. It does not see
+// the files outside the audited directory, e.g. in the temporary directory,
+// nor the hidden files and the temporary files of editors, which Walk skips
+// as well.
+func Hermetic() Option {
+	return func(o *options) {
+		o.hermetic = true
+	}
+}
+
+// scratchVar is the name of the reference to the scratch directory.
+const scratchVar = "scratch"
+
+// ScratchDir returns the scratch directory of the test file, or "" if the
+// Hermetic option is not used.
+func (td *TestData) ScratchDir() string {
+	if td.opts == nil {
+		return ""
+	}
+	return td.opts.scratch
+}
+
+// ScratchPath returns the path of the given file relative to the scratch
+// directory. It is a fatal error if the Hermetic option is not used, or if
+// the path is absolute or escapes the scratch directory.
+func (td *TestData) ScratchPath(t *testing.T, path string) string {
+	t.Helper()
+	dir := td.ScratchDir()
+	if dir == "" {
+		td.Fatalf(t, "ScratchPath requires the Hermetic option")
+	}
+	if filepath.IsAbs(path) {
+		td.Fatalf(t, "%s: path must be relative to the scratch directory", path)
+	}
+	p := filepath.Join(dir, path)
+	if p != dir && !strings.HasPrefix(p, dir+string(filepath.Separator)) {
+		td.Fatalf(t, "%s: path escapes the scratch directory", path)
+	}
+	return p
+}
+
+// expandScratch replaces the references to the scratch directory in the
+// arguments and input of d.
+func expandScratch(t *testing.T, d *TestData) {
+	t.Helper()
+	ref := "${" + scratchVar + "}"
+	lookup := func(name string) (string, bool) {
+		if name != scratchVar {
+			// Leave other references alone.
+			return "${" + name + "}", true
+		}
+		return d.opts.scratch, true
+	}
+	if err := substituteArgs(d.CmdArgs, lookup); err != nil {
+		d.Fatalf(t, "%v", err)
+	}
+	if strings.Contains(d.Input, ref) {
+		input, err := substitute(d.Input, lookup)
+		if err != nil {
+			d.Fatalf(t, "%v", err)
+		}
+		d.Input = input
+	}
+}
+
+// auditDir returns the directory whose files are audited with Hermetic.
+func (o *options) auditDir() string {
+	if root := o.rootDir(); root != "" {
+		return root
+	}
+	if info, err := os.Stat("testdata"); err == nil && info.IsDir() {
+		return "testdata"
+	}
+	return "."
+}
+
+// fileState is the state of a file audited with Hermetic.
+type fileState struct {
+	modTime time.Time
+	size    int64
+	hash    [sha256.Size]byte
+}
+
+// auditFiles returns the state of the files under the given directory,
+// excluding those in the scratch directory.
+func auditFiles(t *testing.T, root, scratch string) map[string]fileState {
+	states := make(map[string]fileState)
+	o := &options{}
+	err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if abs, err := filepath.Abs(file); err == nil &&
+			(abs == scratch || strings.HasPrefix(abs, scratch+string(filepath.Separator))) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if file != root && !o.walkIncludes(file, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		s := fileState{modTime: info.ModTime(), size: info.Size()}
+		if info.Mode().IsRegular() {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			s.hash = sha256.Sum256(data)
+		}
+		states[file] = s
+		return nil
+	})
+	if err != nil {
+		t.Logf("auditing %s: %v", root, err)
+	}
+	return states
+}
+
+// changedFiles returns the files which were created, modified or removed
+// between two audits.
+func changedFiles(before, after map[string]fileState) []string {
+	var changed []string
+	for file, s := range after {
+		if old, ok := before[file]; !ok || !old.modTime.Equal(s.modTime) ||
+			old.size != s.size || old.hash != s.hash {
+			changed = append(changed, file)
+		}
+	}
+	for file := range before {
+		if _, ok := after[file]; !ok {
+			changed = append(changed, file)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
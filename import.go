@@ -0,0 +1,187 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+)
+
+// GoldenCase is a test case of a golden file or snapshot test suite, to be
+// converted into a directive with FormatCases.
+type GoldenCase struct {
+	// Name identifies the case, e.g. the path of its input file.
+	Name string
+	// Input is the input of the case, if any.
+	Input string
+	// Expected is the expected output of the case.
+	Expected string
+}
+
+// goldenExt is the extension of the files holding expected outputs.
+const goldenExt = ".golden"
+
+// ImportGoldenDir reads the test cases of a directory laid out for golden
+// file tests, where the expected output of each input file is stored in a
+// file with an additional .golden extension, or with its extension replaced
+// by .golden:
+//
+//   testdata/parse/select.sql
+//   testdata/parse/select.sql.golden
+//   testdata/parse/insert.sql
+//   testdata/parse/insert.golden
+//
+// The cases are named after the path of their input file relative to dir,
+// and returned sorted by name. The files without a golden file are ignored.
+func ImportGoldenDir(dir string) ([]GoldenCase, error) {
+	var cases []GoldenCase
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Ext(path) == goldenExt {
+			return err
+		}
+		golden := path + goldenExt
+		if _, err := os.Stat(golden); err != nil {
+			golden = strings.TrimSuffix(path, filepath.Ext(path)) + goldenExt
+			if _, err := os.Stat(golden); err != nil {
+				return nil
+			}
+		}
+		input, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		expected, err := ioutil.ReadFile(golden)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		cases = append(cases, GoldenCase{
+			Name:     filepath.ToSlash(name),
+			Input:    string(input),
+			Expected: string(expected),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(cases, func(i, j int) bool { return cases[i].Name < cases[j].Name })
+	return cases, nil
+}
+
+// snapshotHeaderRE matches the header of a snapshot, e.g. "[TestName - 1]".
+var snapshotHeaderRE = regexp.MustCompile(`^\[(.+)\]$`)
+
+// snapshotEnd ends a snapshot.
+const snapshotEnd = "---"
+
+// ImportSnapshots reads the test cases of a snapshot file in the format of
+// the go-snaps library (__snapshots__/*.snap), in which each snapshot is
+// preceded by its name in brackets and followed by a --- line:
+//
+//   [TestName - 1]
+//   <snapshot>
+//   ---
+//
+// The cases are named after the snapshots, and have no input.
+func ImportSnapshots(src []byte) ([]GoldenCase, error) {
+	var cases []GoldenCase
+	lines := strings.Split(string(src), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSuffix(lines[i], "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		m := snapshotHeaderRE.FindStringSubmatch(line)
+		if m == nil {
+			return nil, errors.Newf("line %d: expected a snapshot header, found: %s", i+1, line)
+		}
+		c := GoldenCase{Name: m[1]}
+		start := i + 1
+		for i++; ; i++ {
+			if i == len(lines) {
+				return nil, errors.Newf("line %d: unterminated snapshot %s", start, c.Name)
+			}
+			if strings.TrimSuffix(lines[i], "\r") == snapshotEnd {
+				break
+			}
+			c.Expected += strings.TrimSuffix(lines[i], "\r") + "\n"
+		}
+		cases = append(cases, c)
+	}
+	return cases, nil
+}
+
+// caseNameRE matches the characters which cannot be used in the name
+// argument of the directives produced by FormatCases.
+var caseNameRE = regexp.MustCompile(`[^-a-zA-Z0-9_/.:]+`)
+
+// FormatCases formats test cases as a test file, with one directive per
+// case using the given command, and the name of the case as argument:
+//
+//   <cmd> name=<name>
+//   <input>
+//   ----
+//   <expected>
+//
+// The characters of the names which cannot be used in argument values are
+// replaced with underscores. The input is trimmed, as RunTest does. An
+// error is returned for the cases which cannot be represented, i.e. those
+// whose input or expected output contains a separator line. The options
+// are those the test file is run with; Separator changes the separator.
+func FormatCases(cmd string, cases []GoldenCase, opts ...Option) ([]byte, error) {
+	o := makeOptions(opts)
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	var buf strings.Builder
+	for i, c := range cases {
+		for _, s := range []string{c.Input, c.Expected} {
+			for _, line := range strings.Split(s, "\n") {
+				if line == o.separator || strings.HasPrefix(line, o.separator+" ") {
+					return nil, errors.Newf("case %s: separator line: %s", c.Name, line)
+				}
+			}
+		}
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		buf.WriteString(cmd)
+		if name := caseNameRE.ReplaceAllString(c.Name, "_"); name != "" {
+			buf.WriteString(" name=" + name)
+		}
+		buf.WriteString("\n")
+		if input := strings.TrimSpace(c.Input); input != "" {
+			buf.WriteString(input + "\n")
+		}
+		buf.WriteString(o.separator + "\n")
+		expected := ensureNewline(c.Expected)
+		if hasBlankLine(expected) {
+			buf.WriteString(o.separator + "\n" + expected + o.separator + "\n" + o.separator + "\n")
+		} else {
+			buf.WriteString(expected)
+		}
+	}
+	return []byte(buf.String()), nil
+}
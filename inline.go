@@ -0,0 +1,89 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// RunTestInline is a version of RunTestFromString for tests embedded in a
+// raw string literal of the calling Go source file:
+//
+//   func TestFoo(t *testing.T) {
+//     datadriven.RunTestInline(t, `
+//   put k=a
+//   ----
+//   ok
+//   `, f)
+//   }
+//
+// The positions of the directives in failure messages refer to the Go
+// source file, e.g. foo_test.go:3 for the put directive above, so that they
+// can be followed in an editor. If the literal cannot be found in the
+// source file, e.g. because the input is not a raw string literal, the
+// line numbers are relative to the line of the call.
+func RunTestInline(
+	t *testing.T, input string, f func(t *testing.T, d *TestData) string, opts ...Option,
+) {
+	t.Helper()
+	file, line := inlineSource(input)
+	opts = append(opts[:len(opts):len(opts)], func(o *options) { o.firstLine = line })
+	runTestInternal(t, file, strings.NewReader(input), f, *rewriteTestFiles, opts...)
+}
+
+// inlineSource returns the name of the Go source file of the caller of
+// RunTestInline, and the line at which the raw string literal holding the
+// input starts, or the line of the call if it cannot be found.
+func inlineSource(input string) (file string, line int) {
+	_, path, callLine, ok := runtime.Caller(2)
+	if !ok {
+		return "<string>", 1
+	}
+	file, line = filepath.Base(path), callLine
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return file, line
+	}
+	// Use the occurrence of the literal which is the closest to the call.
+	literal, text := "`"+input+"`", string(src)
+	best := -1
+	for off := 0; ; {
+		i := strings.Index(text[off:], literal)
+		if i < 0 {
+			break
+		}
+		l := 1 + strings.Count(text[:off+i], "\n")
+		if best < 0 || absInt(l-callLine) < absInt(best-callLine) {
+			best = l
+		}
+		off += i + 1
+	}
+	if best < 0 {
+		return file, line
+	}
+	return file, best
+}
+
+// absInt returns the absolute value of n.
+func absInt(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
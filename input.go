@@ -0,0 +1,126 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// InputLines returns the lines of the input. An empty input has no lines.
+func (td *TestData) InputLines() []string {
+	if td.Input == "" {
+		return nil
+	}
+	return strings.Split(td.Input, "\n")
+}
+
+// ScanInputLine splits line i (zero-based) of the input into
+// whitespace-separated fields and scans them into the given destinations in
+// order, using the same rules as ScanArgs. If the line does not exist, the
+// number of fields does not match the number of destinations, or a field
+// cannot be parsed, a fatal error citing the position of the line results.
+//
+// For example, for the input:
+//
+//   a 1 true
+//   b 2 false
+//
+// the following would be valid:
+//
+//   var s string
+//   var n int
+//   var b bool
+//   for i := range td.InputLines() {
+//     td.ScanInputLine(t, i, &s, &n, &b)
+//   }
+func (td *TestData) ScanInputLine(t *testing.T, i int, dests ...interface{}) {
+	t.Helper()
+	lines := td.InputLines()
+	if i < 0 || i >= len(lines) {
+		td.Fatalf(t, "cannot scan input line %d: input has %d lines", i+1, len(lines))
+	}
+	fields := strings.Fields(lines[i])
+	if len(fields) != len(dests) {
+		t.Fatalf("%s: got %d destinations, but %d fields", td.inputPos(i), len(dests), len(fields))
+	}
+	for j := range dests {
+		if err := scanValue(fields[j], dests[j]); err != nil {
+			t.Fatalf("%s: field #%d: %v", td.inputPos(i), j+1, err)
+		}
+	}
+}
+
+// InputCSV parses the input as comma-separated values, honoring the quoting
+// rules of encoding/csv, and returns the records. Records need not have the
+// same number of fields. A parse error results in a fatal error citing the
+// position of the offending line.
+func (td *TestData) InputCSV(t *testing.T) [][]string {
+	t.Helper()
+	return td.InputDelimited(t, ',')
+}
+
+// InputDelimited is like InputCSV, but uses the given field delimiter, e.g.
+// '\t' for tab-separated values.
+func (td *TestData) InputDelimited(t *testing.T, delim rune) [][]string {
+	t.Helper()
+	r := csv.NewReader(strings.NewReader(td.Input))
+	r.Comma = delim
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		if pErr, ok := err.(*csv.ParseError); ok {
+			t.Fatalf("%s: %v", td.inputPos(pErr.Line-1), pErr.Err)
+		}
+		td.Fatalf(t, "%v", err)
+	}
+	return records
+}
+
+// UnmarshalInputJSON decodes the input as JSON into v. A decoding error
+// results in a fatal error citing the position of the directive (or of the
+// offending line, for syntax errors).
+func (td *TestData) UnmarshalInputJSON(t *testing.T, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal([]byte(td.Input), v); err != nil {
+		if sErr, ok := err.(*json.SyntaxError); ok {
+			line := strings.Count(td.Input[:sErr.Offset], "\n")
+			t.Fatalf("%s: invalid JSON input: %v", td.inputPos(line), err)
+		}
+		td.Fatalf(t, "invalid JSON input: %v", err)
+	}
+}
+
+// UnmarshalInputYAML decodes the input as YAML into v. A decoding error
+// results in a fatal error citing the position of the directive.
+func (td *TestData) UnmarshalInputYAML(t *testing.T, v interface{}) {
+	t.Helper()
+	if err := yaml.UnmarshalStrict([]byte(td.Input), v); err != nil {
+		td.Fatalf(t, "invalid YAML input: %v", err)
+	}
+}
+
+// inputPos returns the position of line i (zero-based) of the input, or the
+// position of the directive if the position of the input is not known.
+func (td *TestData) inputPos(i int) Pos {
+	if td.inputLine == 0 || td.file == "" {
+		return td.Pos
+	}
+	return Pos{File: td.file, Line: td.inputLine + i}
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+var interactiveFlag = flag.Bool(
+	"datadriven-interactive", false,
+	"on each mismatch, show the differences and prompt whether to accept the actual output, "+
+		"which is written to the test file immediately, skip the directive, or abort.",
+)
+
+// openTTY opens the terminal used to prompt in interactive mode.
+var openTTY = func() (io.ReadWriteCloser, error) {
+	return os.OpenFile("/dev/tty", os.O_RDWR, 0)
+}
+
+// interactiveSession prompts the user to resolve the mismatches in a test
+// file run with -datadriven-interactive.
+type interactiveSession struct {
+	file    *os.File
+	tty     io.ReadWriteCloser
+	in      *bufio.Reader
+	skipped int
+}
+
+// withInteractive is an Option which causes mismatches to be resolved
+// interactively.
+func withInteractive(s *interactiveSession) Option {
+	return func(o *options) {
+		o.interactive = s
+	}
+}
+
+func newInteractiveSession(t *testing.T, file *os.File) *interactiveSession {
+	t.Helper()
+	tty, err := openTTY()
+	if err != nil {
+		t.Fatalf("-datadriven-interactive requires a terminal: %v", err)
+	}
+	return &interactiveSession{file: file, tty: tty, in: bufio.NewReader(tty)}
+}
+
+// close closes the terminal, and fails the test if any mismatch was
+// skipped.
+func (s *interactiveSession) close(t *testing.T) {
+	t.Helper()
+	_ = s.tty.Close()
+	if s.skipped > 0 {
+		t.Errorf("%s: %d mismatched directive(s) were skipped", s.file.Name(), s.skipped)
+	}
+}
+
+// resolve prompts the user whether to accept the actual output of the
+// directive. It returns the output to emit: the actual output if accepted,
+// and the expected output if skipped.
+func (s *interactiveSession) resolve(t *testing.T, d *TestData, actual string) string {
+	t.Helper()
+	diff := lineDiff(d.Expected, actual)
+	if f, _ := s.tty.(*os.File); useColor(f) {
+		diff = colorDiff(diff)
+	}
+	fmt.Fprintf(s.tty, "\n%s: %s\n%s", d.Pos, d.Input, diff)
+	for {
+		fmt.Fprintf(s.tty, "accept, skip or abort? [a/s/q] ")
+		answer, err := s.in.ReadString('\n')
+		switch strings.TrimSpace(answer) {
+		case "a", "accept":
+			return actual
+		case "s", "skip":
+			s.skipped++
+			return d.Expected
+		case "q", "abort":
+			err = io.EOF
+		}
+		if err != nil {
+			t.Fatalf("\n%s: %s\nexpected:\n%s\nfound:\n%s\naborted", d.Pos, d.Input, d.Expected, actual)
+		}
+	}
+}
+
+// write writes the rewritten test file, following an accepted change.
+func (s *interactiveSession) write(t *testing.T, data []byte) {
+	t.Helper()
+	if _, err := s.file.WriteAt(data, 0); err != nil {
+		t.Fatal(rewriteError(s.file.Name(), err))
+	}
+	if err := s.file.Truncate(int64(len(data))); err != nil {
+		t.Fatal(rewriteError(s.file.Name(), err))
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import "testing"
+
+// KeepGoing causes the directives whose output does not match the expected
+// output to be reported without stopping the test file, so that all the
+// mismatches of a file are reported at once. The other failures, e.g. those
+// reported by the test function, still stop the test file. Once a directive
+// failed, the test function must report them with TestData.Fatalf or
+// TestData.Errorf, as t.Failed no longer tells. The test file ends with a
+// summary of the directives which failed.
+//
+// With BuiltinDirectives, the keep-going directive overrides the option for
+// the directives which follow it in a test file, e.g. for files which test
+// many independent cases:
+//
+//   keep-going
+//
+// or, to stop at the first mismatch again:
+//
+//   keep-going off
+func KeepGoing() Option {
+	return func(o *options) {
+		o.keepGoing = true
+	}
+}
+
+// keepGoingCmd is the directive which overrides the KeepGoing option.
+const keepGoingCmd = "keep-going"
+
+// setKeepGoing handles a keep-going directive.
+func (r *testDataReader) setKeepGoing(t testing.TB, args CmdArgs) {
+	t.Helper()
+	r.keepGoing = true
+	for _, arg := range args {
+		switch arg.Key {
+		case "on":
+			r.keepGoing = true
+		case "off":
+			r.keepGoing = false
+		default:
+			r.data.Fatalf(t, "%s: unknown argument %q; expected on or off", keepGoingCmd, arg.Key)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// LeakCheckMode determines the granularity of the goroutine leak check
+// enabled by CheckGoroutineLeaks.
+type LeakCheckMode int
+
+const (
+	// LeakCheckDirective checks for goroutines leaked by each directive.
+	LeakCheckDirective LeakCheckMode = 1 + iota
+	// LeakCheckFile checks for goroutines leaked by each test file.
+	LeakCheckFile
+)
+
+// CheckGoroutineLeaks causes the test to fail if goroutines started while
+// running a directive (or a test file, depending on the mode) are still
+// running once it completes. Goroutines are given a grace period to exit.
+// Leaked goroutines tend to interfere with the directives that follow, so
+// this reports them at the directive which leaked them, along with their
+// stacks.
+func CheckGoroutineLeaks(mode LeakCheckMode) Option {
+	return func(o *options) {
+		o.leakCheck = mode
+	}
+}
+
+// leakGracePeriod is how long goroutines are given to exit before they are
+// considered leaked.
+var leakGracePeriod = time.Second
+
+// goroutines returns the stacks of all the goroutines, keyed by their
+// header line (e.g. "goroutine 12"), excluding the calling goroutine.
+func goroutines() map[string]string {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true /* all */)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	res := make(map[string]string)
+	// The first stack is that of the calling goroutine.
+	for _, stack := range strings.Split(string(buf), "\n\n")[1:] {
+		header := stack
+		if i := strings.Index(header, " ["); i >= 0 {
+			header = header[:i]
+		}
+		res[header] = stack
+	}
+	return res
+}
+
+// leakedGoroutines returns the stacks of the goroutines which are not in
+// before, after waiting for them to exit for the grace period.
+func leakedGoroutines(before map[string]string) []string {
+	deadline := time.Now().Add(leakGracePeriod)
+	for {
+		var leaked []string
+		for header, stack := range goroutines() {
+			if _, ok := before[header]; !ok {
+				leaked = append(leaked, stack)
+			}
+		}
+		if len(leaked) == 0 || time.Now().After(deadline) {
+			sort.Strings(leaked)
+			return leaked
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
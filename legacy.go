@@ -0,0 +1,106 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import "testing"
+
+// LegacyParsing causes the test files to be parsed as older versions of
+// this package did, for corpora which rely on the syntax that has since
+// been given a meaning. This allows migrating them incrementally, e.g. one
+// directory at a time, by removing the option from the Walk of each
+// directory once it is migrated:
+//   - lines starting with #| are ordinary comments, rather than the start
+//     of block comments;
+//   - the config, foreach, macro, include, skipfile and keep-going
+//     directives are run by the test function like any other directive,
+//     even with BuiltinDirectives;
+//   - "---- or" lines are expected output, rather than the header of an
+//     alternative expected output;
+//   - the blank line which ends an expected output is rewritten as an
+//     empty line, even if it contains white space;
+//   - the arguments interpreted by the framework, e.g. pending, group or
+//     sort-output, are ordinary arguments, which are handed to the test
+//     function like any other argument, even with FrameworkArgs.
+func LegacyParsing() Option {
+	return func(o *options) {
+		o.legacyParsing = true
+	}
+}
+
+// FrameworkArgs causes the framework to interpret the following arguments
+// of the directives, which are otherwise handed to the test function like
+// any other argument, so that the test files which already use them keep
+// their meaning: compare, chain, pending, generated, wrap, sort-output,
+// no-rewrite, doc and group. They are then accepted by all the commands of
+// a Registry.
+func FrameworkArgs() Option {
+	return func(o *options) {
+		o.frameworkArgs = true
+	}
+}
+
+// isFrameworkArg returns whether the argument with the given key is
+// interpreted by the framework (see frameworkArgs) with the given options.
+func isFrameworkArg(key string, o *options) bool {
+	return frameworkArgs[key] && o != nil && o.frameworkArgs && !o.legacyParsing
+}
+
+// frameworkArgValue returns the first value of the argument of the
+// directive with the given key, if it is interpreted by the framework.
+func (td *TestData) frameworkArgValue(key string) (string, bool) {
+	if !isFrameworkArg(key, td.opts) {
+		return "", false
+	}
+	return td.ArgValue(key, 0)
+}
+
+// frameworkArgBool returns the value of the boolean argument of the
+// directive with the given key, if it is interpreted by the framework, and
+// false otherwise.
+func (td *TestData) frameworkArgBool(t *testing.T, key string) bool {
+	t.Helper()
+	return isFrameworkArg(key, td.opts) && td.ArgBool(t, key)
+}
+
+// BuiltinDirectives causes the framework to run the config, foreach, macro,
+// include, skipfile and keep-going directives itself, which are otherwise
+// handed to the test function like any other directive, so that the test
+// files which already use these commands keep their meaning.
+func BuiltinDirectives() Option {
+	return func(o *options) {
+		o.builtinDirectives = true
+	}
+}
+
+// builtinDirectives are the directives handled by the framework rather than
+// by the test function with BuiltinDirectives, except for subtest, which is
+// always handled by the framework.
+var builtinDirectives = map[string]bool{
+	"config":     true,
+	"foreach":    true,
+	"macro":      true,
+	"include":    true,
+	"skipfile":   true,
+	keepGoingCmd: true,
+}
+
+// builtinDirective returns the command if it is a directive handled by the
+// framework with the given options, and "" otherwise.
+func builtinDirective(cmd string, o *options) string {
+	if !o.builtinDirectives || o.legacyParsing || !builtinDirectives[cmd] {
+		return ""
+	}
+	return cmd
+}
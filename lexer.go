@@ -0,0 +1,169 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"fmt"
+	"io"
+	"testing"
+)
+
+// TokenKind is the kind of a token of a test file.
+type TokenKind int
+
+const (
+	// TokenCmd is the command of a directive line.
+	TokenCmd TokenKind = iota
+	// TokenArgKey is the key of an argument of a directive.
+	TokenArgKey
+	// TokenArgValue is a value of an argument of a directive. Empty values
+	// do not produce tokens.
+	TokenArgValue
+	// TokenContinuation is the backslash which continues a directive line
+	// on the next line.
+	TokenContinuation
+	// TokenComment is a comment line, a line of a block comment, or the
+	// trailing comment of a directive line.
+	TokenComment
+	// TokenInput is a line of the input of a directive.
+	TokenInput
+	// TokenSeparator is a separator line, including the double separators
+	// and the headers of the per-configuration and alternative expected
+	// output blocks, e.g. "---- or".
+	TokenSeparator
+	// TokenExpected is a line of expected output.
+	TokenExpected
+)
+
+var tokenKindNames = [...]string{
+	TokenCmd:          "cmd",
+	TokenArgKey:       "arg-key",
+	TokenArgValue:     "arg-value",
+	TokenContinuation: "continuation",
+	TokenComment:      "comment",
+	TokenInput:        "input",
+	TokenSeparator:    "separator",
+	TokenExpected:     "expected",
+}
+
+// String implements fmt.Stringer.
+func (k TokenKind) String() string {
+	if k < 0 || int(k) >= len(tokenKindNames) {
+		return fmt.Sprintf("TokenKind(%d)", int(k))
+	}
+	return tokenKindNames[k]
+}
+
+// LexToken is a token of a test file, as returned by Lexer. The lines of
+// input and expected output, comments and separators are whole-line tokens
+// which span the entire line, indentation included. Blank lines do not
+// produce tokens, except within double separator sections, where they are
+// lines of expected output.
+type LexToken struct {
+	Kind TokenKind
+	// Line is the line (starting at 1) of the token in the file.
+	Line int
+	Token
+}
+
+// Lexer splits a test file into a stream of tokens, following the same
+// grammar as RunTest, e.g. for syntax highlighters, formatters and linters:
+//
+//   l := datadriven.NewLexer(path, f)
+//   for tok, ok := l.Next(); ok; tok, ok = l.Next() {
+//     fmt.Printf("%d:%d: %s %q\n", tok.Line, tok.Start, tok.Kind, tok.Text)
+//   }
+//   if err := l.Err(); err != nil {
+//     ...
+//   }
+//
+// The options are those the test file is run with, e.g. CommentPrefix,
+// Separator and IndentedArgs. The tokens are those of the test file
+// itself: the files it includes are not read.
+type Lexer struct {
+	// r is the reader which reads the file as RunTest does, and reports
+	// the tokens as it reads them.
+	r     *testDataReader
+	tb    lexTB
+	queue []LexToken
+	done  bool
+	err   error
+}
+
+// NewLexer creates a Lexer reading the test file with the given name from
+// r.
+func NewLexer(file string, r io.Reader, opts ...Option) *Lexer {
+	l := &Lexer{}
+	o := makeOptions(opts)
+	l.r = newTestDataReader(&l.tb, file, r, false /* record */, o)
+	l.r.tokens = func(tok LexToken) {
+		l.queue = append(l.queue, tok)
+	}
+	if err := o.validate(); err != nil {
+		l.err, l.done = err, true
+	}
+	return l
+}
+
+// Next returns the next token. It returns false at the end of the file or
+// on an error, which Err then returns.
+func (l *Lexer) Next() (LexToken, bool) {
+	for len(l.queue) == 0 {
+		if l.done {
+			return LexToken{}, false
+		}
+		l.done = !l.read()
+	}
+	tok := l.queue[0]
+	l.queue = l.queue[1:]
+	return tok, true
+}
+
+// Err returns the error which stopped the lexer, if any.
+func (l *Lexer) Err() error {
+	return l.err
+}
+
+// read reads up to and including the next directive. It returns false at
+// the end of the file or on an error.
+func (l *Lexer) read() (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if r != &l.tb {
+				panic(r)
+			}
+			l.err, ok = l.tb.err, false
+		}
+	}()
+	if !l.r.Next(&l.tb) {
+		l.err = l.r.scanner.Err()
+		return false
+	}
+	return true
+}
+
+// lexTB is the testing.TB with which a Lexer drives its reader. The
+// failures of the reader, i.e. the syntax errors, stop the lexer.
+type lexTB struct {
+	testing.TB
+	err error
+}
+
+func (tb *lexTB) Helper() {}
+
+func (tb *lexTB) Fatalf(format string, args ...interface{}) {
+	tb.err = fmt.Errorf(format, args...)
+	panic(tb)
+}
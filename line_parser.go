@@ -17,6 +17,7 @@ package datadriven
 import (
 	"regexp"
 	"strings"
+	"unicode"
 
 	"github.com/cockroachdb/errors"
 )
@@ -24,37 +25,102 @@ import (
 // ParseLine parses a line of datadriven input language and returns
 // the parsed command and CmdArgs.
 func ParseLine(line string) (cmd string, cmdArgs []CmdArg, err error) {
-	fields, err := splitDirectives(line)
+	p, err := ParseLineDetailed(line)
 	if err != nil {
 		return "", nil, err
 	}
-	if len(fields) == 0 {
-		return "", nil, nil
+	return p.Cmd.Text, p.CmdArgs(), nil
+}
+
+// Token is a token of a directive line.
+type Token struct {
+	// Text is the text of the token.
+	Text string
+	// Start and End are the columns (starting at 1) of the first byte of the
+	// token and of the byte following it.
+	Start, End int
+}
+
+// ArgTokens are the tokens of an argument of a directive line.
+type ArgTokens struct {
+	// Arg is the entire argument, e.g. "key=(a, b)".
+	Arg Token
+	// Key is the key of the argument.
+	Key Token
+	// Vals are the values of the argument, if any. An empty value, as in
+	// "key=", has Start == End.
+	Vals []Token
+}
+
+// ParsedLine is a directive line parsed with ParseLineDetailed.
+type ParsedLine struct {
+	Cmd  Token
+	Args []ArgTokens
+}
+
+// CmdArgs returns the arguments of the line, as returned by ParseLine.
+func (p ParsedLine) CmdArgs() []CmdArg {
+	var cmdArgs []CmdArg
+	for _, a := range p.Args {
+		arg := CmdArg{Key: a.Key.Text}
+		for _, v := range a.Vals {
+			arg.Vals = append(arg.Vals, v.Text)
+		}
+		cmdArgs = append(cmdArgs, arg)
 	}
-	cmd = fields[0]
+	return cmdArgs
+}
+
+// ParseLineDetailed is like ParseLine, but also returns the position of
+// each token of the line, e.g. to point at the offending token in an error
+// message or in an editor.
+func ParseLineDetailed(line string) (ParsedLine, error) {
+	var p ParsedLine
+	fields, offsets, err := splitDirectivesWithOffsets(line)
+	if err != nil || len(fields) == 0 {
+		return p, err
+	}
+	p.Cmd = newToken(fields[0], offsets[0])
 
-	for _, arg := range fields[1:] {
-		key := arg
-		var vals []string
-		if pos := strings.IndexByte(key, '='); pos >= 0 {
-			key = arg[:pos]
-			val := arg[pos+1:]
+	for i, arg := range fields[1:] {
+		offset := offsets[i+1]
+		a := ArgTokens{Arg: newToken(arg, offset), Key: newToken(arg, offset)}
+		if pos := strings.IndexByte(arg, '='); pos >= 0 {
+			a.Key = newToken(arg[:pos], offset)
+			val, valOffset := arg[pos+1:], offset+pos+1
 
 			if len(val) > 2 && val[0] == '(' && val[len(val)-1] == ')' {
-				vals = strings.Split(val[1:len(val)-1], ",")
-				for i := range vals {
-					vals[i] = strings.TrimSpace(vals[i])
+				valOffset++
+				for _, v := range strings.Split(val[1:len(val)-1], ",") {
+					leading := len(v) - len(strings.TrimLeftFunc(v, unicode.IsSpace))
+					a.Vals = append(a.Vals, newToken(strings.TrimSpace(v), valOffset+leading))
+					valOffset += len(v) + 1
 				}
 			} else {
-				vals = []string{val}
+				a.Vals = []Token{newToken(val, valOffset)}
 			}
 		}
-		cmdArgs = append(cmdArgs, CmdArg{Key: key, Vals: vals})
+		p.Args = append(p.Args, a)
 	}
-	return cmd, cmdArgs, nil
+	return p, nil
+}
+
+// newToken returns the token with the given text at the given offset in
+// the line.
+func newToken(text string, offset int) Token {
+	return Token{Text: text, Start: offset + 1, End: offset + 1 + len(text)}
 }
 
-var splitDirectivesRE = regexp.MustCompile(`^ *[-a-zA-Z0-9/_,\.]+(|=[-a-zA-Z0-9_@=+/,\.]*|=\([^)]*\))( |$)`)
+// varRefRE matches the references to variables, e.g. ${name} or
+// ${env:NAME}, which may appear in the keys and values of the directives
+// to be substituted by foreach, macros, ExpandEnv and Hermetic.
+const varRefRE = `\$\{[a-zA-Z0-9_:]+\}`
+
+// splitDirectivesRE matches a token of a directive line. Besides variable
+// references, the values may contain the characters of URLs and IPv6
+// addresses, which are not allowed in the keys.
+var splitDirectivesRE = regexp.MustCompile(`^ *(?:[-a-zA-Z0-9/_,\.]|` + varRefRE + `)+` +
+	`(|=(?:[-a-zA-Z0-9_@=+/,\.:?&%~\[\]]|` + varRefRE + `)*|=\([^)]*\))( |$)`)
 
 // splits a directive line into tokens, where each token is
 // either:
@@ -64,17 +130,27 @@ var splitDirectivesRE = regexp.MustCompile(`^ *[-a-zA-Z0-9/_,\.]+(|=[-a-zA-Z0-9_
 //  - argument=               # = empty value string
 //  - argument=(values, ...)  # a comma-separated array of value strings
 func splitDirectives(line string) ([]string, error) {
+	res, _, err := splitDirectivesWithOffsets(line)
+	return res, err
+}
+
+// splitDirectivesWithOffsets is like splitDirectives, but also returns the
+// offset of each token in the line.
+func splitDirectivesWithOffsets(line string) ([]string, []int, error) {
 	var res []string
+	var offsets []int
 
 	origLine := line
 	for line != "" {
 		str := splitDirectivesRE.FindString(line)
 		if len(str) == 0 {
 			column := len(origLine) - len(line) + 1
-			return nil, errors.Newf("cannot parse directive at column %d: %s", column, origLine)
+			return nil, nil, errors.Newf("cannot parse directive at column %d: %s", column, origLine)
 		}
+		offset := len(origLine) - len(line)
+		offsets = append(offsets, offset+len(str)-len(strings.TrimLeft(str, " ")))
 		res = append(res, strings.TrimSpace(line[0:len(str)]))
 		line = line[len(str):]
 	}
-	return res, nil
+	return res, offsets, nil
 }
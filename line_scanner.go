@@ -17,24 +17,77 @@ package datadriven
 import (
 	"bufio"
 	"io"
+	"strings"
 )
 
 type lineScanner struct {
 	*bufio.Scanner
 	line int
+	// first is the number of the first line, 1 unless the input is part of
+	// a larger file.
+	first int
+	// crlf is set if the input uses Windows line endings, as determined by
+	// the first line terminator encountered.
+	crlf   bool
+	sawEOL bool
+	// bom is set if the input starts with a UTF-8 byte order mark, which
+	// is stripped from the first line.
+	bom bool
+	// offset and end are the byte offsets of the start and the end
+	// (including the terminator) of the most recent line.
+	offset, end int
+	// advance is the length of the most recent line, including the
+	// terminator.
+	advance int
 }
 
+// utf8BOM is the UTF-8 encoding of the byte order mark.
+const utf8BOM = "\ufeff"
+
 func newLineScanner(r io.Reader) *lineScanner {
-	return &lineScanner{
+	l := &lineScanner{
 		Scanner: bufio.NewScanner(r),
 		line:    0,
+		first:   1,
 	}
+	l.Scanner.Split(l.scanLines)
+	return l
 }
 
 func (l *lineScanner) Scan() bool {
 	ok := l.Scanner.Scan()
 	if ok {
 		l.line++
+		l.offset = l.end
+		l.end += l.advance
+		if l.line == l.first {
+			l.bom = strings.HasPrefix(l.Scanner.Text(), utf8BOM)
+		}
 	}
 	return ok
 }
+
+// Text returns the most recent line read by Scan, without any leading
+// byte order mark.
+func (l *lineScanner) Text() string {
+	s := l.Scanner.Text()
+	if l.line == l.first && l.bom {
+		s = s[len(utf8BOM):]
+	}
+	return s
+}
+
+// scanLines wraps bufio.ScanLines, which already strips the carriage
+// return of a \r\n terminator, to record the line ending convention of
+// the input.
+func (l *lineScanner) scanLines(data []byte, atEOF bool) (int, []byte, error) {
+	advance, token, err := bufio.ScanLines(data, atEOF)
+	if token != nil {
+		l.advance = advance
+	}
+	if !l.sawEOL && advance > 0 && data[advance-1] == '\n' {
+		l.sawEOL = true
+		l.crlf = advance >= 2 && data[advance-2] == '\r'
+	}
+	return advance, token, err
+}
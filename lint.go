@@ -0,0 +1,67 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"os"
+	"testing"
+)
+
+// Lint checks the directives of the test files under path, which is walked
+// as with Walk, against the registry without running them: their commands
+// must be registered, and their arguments must match the ArgSpecs of the
+// commands. All the problems are reported with t.Error. As the registry is
+// defined in Go, the corpus is linted by a test:
+//
+//   func TestLint(t *testing.T) {
+//     newRegistry().Lint(t, "testdata")
+//   }
+//
+// The options are those the test files are run with.
+func (r *Registry) Lint(t *testing.T, path string, opts ...Option) {
+	t.Helper()
+	Walk(t, path, func(t *testing.T, path string) {
+		r.lintFile(t, path, opts)
+	}, opts...)
+}
+
+// lintFile checks the directives of a single test file.
+func (r *Registry) lintFile(t *testing.T, path string, opts []Option) {
+	t.Helper()
+	o := makeOptions(opts)
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = file.Close() }()
+	reader := newTestDataReader(t, path, file, false /* record */, o)
+	for reader.Next(t) {
+		d := &reader.data
+		if d.macro != nil || d.Cmd == "subtest" || (o.builtinEcho && d.Cmd == "echo") {
+			continue
+		}
+		c, ok := r.commands[d.Cmd]
+		if !ok {
+			t.Errorf("%s: unknown command %q%s", d.Pos, d.Cmd, r.suggest(d.Cmd))
+			continue
+		}
+		if c.Deprecated != "" {
+			t.Logf("%s: warning: command %q is deprecated: %s", d.Pos, c.Name, c.Deprecated)
+		}
+		for _, problem := range c.argProblems(d, true /* lint */) {
+			t.Error(problem)
+		}
+	}
+}
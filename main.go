@@ -0,0 +1,124 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+)
+
+var failNoopRewrite = flag.Bool(
+	"datadriven-fail-noop-rewrite", false,
+	"with -rewrite, fail if no test file was changed. Requires RunMain.",
+)
+
+// RunMain runs the tests and performs the checks of this package which
+// apply to the test binary as a whole. It is meant to be called from
+// TestMain:
+//
+//   func TestMain(m *testing.M) {
+//     os.Exit(datadriven.RunMain(m))
+//   }
+//
+// When rewriting, RunMain reports when no test file was changed, which
+// usually means that -rewrite was run against the wrong package or with a
+// filter which does not match any test. With -datadriven-fail-noop-rewrite,
+// this causes the test binary to fail.
+//
+// RunMain also lists the directives marked with the pending argument (see
+// FrameworkArgs), which were skipped, the directives marked with the
+// no-rewrite argument whose output would have changed, and the uses of
+// deprecated commands (see Command.Deprecate). With -datadriven-stats, it
+// prints the number of directives, failures and the time spent per test
+// file and command.
+//
+// When directives failed only because their expected output is stale,
+// RunMain suggests running with -rewrite, and distinguishes them from the
+// directives which failed otherwise, which -rewrite does not fix. With
+// -datadriven-stale-exit-code, the test binary exits with the given code
+// if the tests failed only because of stale directives, e.g. for CI to tell
+// the contributors to rewrite the test files. Only the failures of the test
+// files are known: a test which fails without running a test file does not
+// prevent the stale exit code.
+//
+// The options configure the checks; see CheckOrphans.
+func RunMain(m *testing.M, opts ...Option) int {
+	o := makeOptions(opts)
+	// The flags are otherwise parsed by m.Run.
+	if !flag.Parsed() {
+		flag.Parse()
+	}
+	code := m.Run()
+	reportPending(os.Stderr)
+	reportPinnedChanges(os.Stderr)
+	reportDeprecatedUses(os.Stderr)
+	if *statsFlag {
+		reportDirectiveStats(os.Stderr)
+	}
+	if code != 0 && reportStale(os.Stderr) && *staleExitCode != 0 && onlyStaleTests() {
+		code = *staleExitCode
+	}
+	if code == 0 && !checkRewriteStats(os.Stderr) {
+		code = 1
+	}
+	if code == 0 && !testsFiltered() && !checkOrphans(os.Stderr, &o) {
+		code = 1
+	}
+	return code
+}
+
+// rewriteStats counts the test files processed with -rewrite.
+var rewriteStats struct {
+	sync.Mutex
+	// files is the number of test files which were rewritten, and changed
+	// the number of those whose contents changed.
+	files, changed int
+}
+
+// recordRewrite records the rewrite of a test file.
+func recordRewrite(changed bool) {
+	rewriteStats.Lock()
+	defer rewriteStats.Unlock()
+	rewriteStats.files++
+	if changed {
+		rewriteStats.changed++
+	}
+}
+
+// checkRewriteStats reports to w whether the test files were changed when
+// rewriting. It returns false if no test file was changed and
+// -datadriven-fail-noop-rewrite is set.
+func checkRewriteStats(w io.Writer) bool {
+	if !*rewriteTestFiles && !*rewriteToStdout {
+		return true
+	}
+	rewriteStats.Lock()
+	defer rewriteStats.Unlock()
+	if rewriteStats.changed > 0 {
+		fmt.Fprintf(w, "rewrite: %d of %d test file(s) changed\n",
+			rewriteStats.changed, rewriteStats.files)
+		return true
+	}
+	if rewriteStats.files == 0 {
+		fmt.Fprintf(w, "rewrite: no test file was run; check the package and -run filter\n")
+	} else {
+		fmt.Fprintf(w, "rewrite: none of the %d test file(s) changed\n", rewriteStats.files)
+	}
+	return !*failNoopRewrite
+}
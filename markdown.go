@@ -0,0 +1,139 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"fmt"
+	"strings"
+)
+
+// docArg is the argument which selects the directives rendered by
+// ExportMarkdown. Its value, if any, is the title of the example:
+//
+//   # Rows can be selected by key.
+//   get k=a doc=(Reading a key)
+//   ----
+//   a=1
+const docArg = "doc"
+
+// ExportMarkdown renders the directives of a test file which have the doc
+// argument into Markdown example sections, so that the documentation stays
+// in sync with the tests, e.g. by checking in the Markdown and comparing it
+// with the output of ExportMarkdown in a test. Each section is made of:
+//   - the value of the doc argument, if any, as a heading;
+//   - the comment lines immediately preceding the directive, as text;
+//   - the directive line, without the doc argument, and its input;
+//   - the expected output, or the first one if the directive has several.
+// The options are those the test file is run with, as for Parse. The doc
+// argument is recognized even without FrameworkArgs, which the test file
+// must be run with so that the argument is not handed to the test function.
+func ExportMarkdown(file string, src []byte, opts ...Option) (string, error) {
+	f, err := Parse(file, src, opts...)
+	if err != nil {
+		return "", err
+	}
+	o := makeOptions(opts)
+	var buf strings.Builder
+	for i, n := range f.Nodes {
+		d, ok := n.(*Directive)
+		if !ok {
+			continue
+		}
+		doc, ok := d.CmdArgs.Get(docArg)
+		if !ok || o.legacyParsing {
+			continue
+		}
+		if buf.Len() > 0 {
+			buf.WriteString("\n")
+		}
+		if len(doc.Vals) > 0 {
+			fmt.Fprintf(&buf, "### %s\n\n", strings.Join(doc.Vals, ", "))
+		}
+		if i > 0 {
+			if tr, ok := f.Nodes[i-1].(*Trivia); ok {
+				if text := leadingComment(tr.Text, o.commentPrefix); text != "" {
+					buf.WriteString(text + "\n\n")
+				}
+			}
+		}
+		args := append(CmdArgs(nil), d.CmdArgs...)
+		args.Remove(docArg)
+		code := formatCmdLine(d.Cmd, args) + "\n"
+		if input := strings.TrimSpace(d.Input.Text); input != "" {
+			code += input + "\n"
+		}
+		writeCodeBlock(&buf, code)
+		if expected := firstExpected(d.Expected.Text, o.separator); expected != "" {
+			buf.WriteString("\nOutput:\n\n")
+			writeCodeBlock(&buf, expected)
+		}
+	}
+	return buf.String(), nil
+}
+
+// leadingComment returns the text of the comment lines which end the given
+// text, without their prefix.
+func leadingComment(text, commentPrefix string) string {
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	start := len(lines)
+	for start > 0 {
+		l := strings.TrimSpace(lines[start-1])
+		if !strings.HasPrefix(l, commentPrefix) || strings.HasPrefix(l, commentPrefix+"|") ||
+			strings.HasSuffix(l, "|"+commentPrefix) {
+			break
+		}
+		start--
+	}
+	var res []string
+	for _, l := range lines[start:] {
+		l = strings.TrimPrefix(strings.TrimSpace(l), commentPrefix)
+		res = append(res, strings.TrimPrefix(l, " "))
+	}
+	return strings.Join(res, "\n")
+}
+
+// firstExpected returns the first expected output of the text of the
+// Expected section of a directive.
+func firstExpected(text, separator string) string {
+	lines := strings.Split(strings.TrimSuffix(strings.Replace(text, "\r\n", "\n", -1), "\n"), "\n")
+	if len(lines) < 2 {
+		return ""
+	}
+	var buf strings.Builder
+	if lines[1] == separator {
+		// Double separator section.
+		for i := 2; i < len(lines) && !(lines[i] == separator && i+1 < len(lines) && lines[i+1] == separator); i++ {
+			buf.WriteString(lines[i] + "\n")
+		}
+		return buf.String()
+	}
+	for _, l := range lines[1:] {
+		if strings.HasPrefix(l, separator+" ") {
+			break
+		}
+		buf.WriteString(l + "\n")
+	}
+	return buf.String()
+}
+
+// writeCodeBlock writes a fenced code block, with a fence longer than the
+// runs of backquotes in the code.
+func writeCodeBlock(buf *strings.Builder, code string) {
+	fence := "```"
+	for strings.Contains(code, fence) {
+		fence += "`"
+	}
+	fmt.Fprintf(buf, "%s\n%s%s\n", fence, code, fence)
+}
@@ -0,0 +1,294 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+)
+
+// minimizeName is the name of the test files run by Minimize.
+const minimizeName = "<minimize>"
+
+// minimizeTestEnv and minimizeFileEnv are set in the child processes which
+// run the candidates of Minimize, to the name of the test which called
+// Minimize and to the path of the candidate file. The rewritten candidate
+// is written next to it, with the .out suffix.
+const (
+	minimizeTestEnv = "DATADRIVEN_MINIMIZE_TEST"
+	minimizeFileEnv = "DATADRIVEN_MINIMIZE_FILE"
+)
+
+// minimizeCalls records the tests which called Minimize.
+var minimizeCalls = struct {
+	sync.Mutex
+	tests map[string]bool
+}{tests: make(map[string]bool)}
+
+// Minimize reduces a test file in which a directive fails with the test
+// function f, and returns the smallest file it finds which still
+// reproduces the failure, e.g. to attach it to a bug report:
+//
+//   func TestMinimize(t *testing.T) {
+//     src, _ := ioutil.ReadFile("testdata/failing")
+//     min, err := datadriven.Minimize(t, src, handler)
+//     ...
+//   }
+//
+// The failure is that of the first directive whose actual output differs
+// from its expected output, and persists as long as that directive
+// produces the same actual output. Minimize uses delta debugging: it
+// removes the comments, then repeatedly removes sets of directives, and
+// then of input lines, of decreasing size, keeping each removal with which
+// the failure persists.
+//
+// The directives handled by the framework, e.g. subtest or macro, are kept,
+// except for foreach, which is removed along with the directive it applies
+// to.
+//
+// The candidate files are run in rewrite mode, so that the mismatches do not
+// fail the test. Each candidate is run in a child process of the test
+// binary, which runs the test again up to the call to Minimize, and then
+// runs the candidate rather than minimizing it, and skips the rest of the
+// test. The candidates thus start afresh, and a candidate which fails, e.g.
+// because the test function calls t.Fatal, is considered not to reproduce
+// the failure, without failing t. Minimize can therefore only be called
+// once per test, e.g. once per subtest. The options are those the test
+// file is run with.
+func Minimize(
+	t *testing.T, src []byte, f func(t *testing.T, d *TestData) string, opts ...Option,
+) ([]byte, error) {
+	t.Helper()
+	if os.Getenv(minimizeTestEnv) == t.Name() {
+		runCandidate(t, os.Getenv(minimizeFileEnv), f, opts)
+	}
+	minimizeCalls.Lock()
+	called := minimizeCalls.tests[t.Name()]
+	minimizeCalls.tests[t.Name()] = true
+	minimizeCalls.Unlock()
+	if called {
+		t.Fatalf("Minimize can only be called once per test; use subtests")
+	}
+	o := makeOptions(opts)
+	file, err := Parse(minimizeName, src, opts...)
+	if err != nil {
+		return nil, err
+	}
+	directives := file.Directives()
+	dir, err := ioutil.TempDir("", "datadriven-minimize")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "candidate")
+	// run runs a candidate file in a child process, and returns the
+	// directives of the rewritten file, whose expected outputs are the
+	// actual outputs.
+	run := func(src []byte) ([]*Directive, error) {
+		if err := ioutil.WriteFile(path, src, 0644); err != nil {
+			return nil, err
+		}
+		if err := os.Remove(path + ".out"); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		cmd := exec.Command(os.Args[0], "-test.run="+testPattern(t.Name()))
+		cmd.Env = append(os.Environ(), minimizeTestEnv+"="+t.Name(), minimizeFileEnv+"="+path)
+		// The candidate failed if it did not write its output, whatever
+		// the rest of the test did.
+		output, _ := cmd.CombinedOutput()
+		out, err := ioutil.ReadFile(path + ".out")
+		if err != nil {
+			return nil, errors.Newf("the candidate failed:\n%s", output)
+		}
+		res, err := Parse(minimizeName, out, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return res.Directives(), nil
+	}
+	actual, err := run(src)
+	if err != nil {
+		return nil, errors.Wrap(err, "running the test file")
+	}
+	if len(actual) != len(directives) {
+		return nil, errors.Newf("%d directives were rewritten into %d", len(directives), len(actual))
+	}
+	target := -1
+	for i, d := range directives {
+		if d.Expected.Text != actual[i].Expected.Text {
+			target = i
+			break
+		}
+	}
+	if target < 0 {
+		return nil, errors.New("no directive fails")
+	}
+	want := actual[target].Expected.Text
+
+	// The candidates are made of the kept directives, with their kept input
+	// lines, separated by blank lines.
+	kept := make([]bool, len(directives))
+	lines := make([][]string, len(directives))
+	keptLines := make([][]bool, len(directives))
+	for i, d := range directives {
+		kept[i] = true
+		if d.Input.Text != "" {
+			lines[i] = strings.SplitAfter(strings.TrimSuffix(d.Input.Text, "\n"), "\n")
+			lines[i][len(lines[i])-1] += "\n"
+		}
+		keptLines[i] = make([]bool, len(lines[i]))
+		for j := range keptLines[i] {
+			keptLines[i][j] = true
+		}
+	}
+	// emitted returns whether the directive at index i is part of the
+	// candidate: a foreach directive is only kept along with the directive
+	// it applies to.
+	var emitted func(i int) bool
+	emitted = func(i int) bool {
+		if directives[i].Cmd == "foreach" && builtinDirective("foreach", &o) != "" {
+			return i+1 < len(directives) && emitted(i+1)
+		}
+		return kept[i]
+	}
+	candidate := func() []byte {
+		var buf bytes.Buffer
+		for i, d := range directives {
+			if !emitted(i) {
+				continue
+			}
+			if buf.Len() > 0 {
+				buf.WriteString("\n")
+			}
+			buf.WriteString(d.CmdLine.Text)
+			for j, l := range lines[i] {
+				if keptLines[i][j] {
+					buf.WriteString(l)
+				}
+			}
+			buf.WriteString(ensureNewline(d.Expected.Text))
+		}
+		return buf.Bytes()
+	}
+	// fails returns whether the candidate reproduces the failure.
+	fails := func() bool {
+		res, err := run(candidate())
+		if err != nil {
+			return false
+		}
+		n := 0
+		for i := 0; i < target; i++ {
+			if emitted(i) {
+				n++
+			}
+		}
+		return n < len(res) && res[n].Expected.Text == want
+	}
+	if !fails() {
+		return nil, errors.New("the failure does not reproduce without the comments")
+	}
+
+	var removable []*bool
+	for i, d := range directives {
+		if i != target && d.Cmd != "subtest" && builtinDirective(d.Cmd, &o) == "" {
+			removable = append(removable, &kept[i])
+		}
+	}
+	reduce(removable, fails)
+	removable = removable[:0]
+	for i, d := range directives {
+		if kept[i] && d.Cmd != "subtest" && builtinDirective(d.Cmd, &o) == "" {
+			for j := range keptLines[i] {
+				removable = append(removable, &keptLines[i][j])
+			}
+		}
+	}
+	reduce(removable, fails)
+	return candidate(), nil
+}
+
+// runCandidate runs a candidate of Minimize in rewrite mode, in the child
+// process started for it, writes the rewritten file next to it, and skips
+// the rest of the test.
+func runCandidate(t *testing.T, path string, f func(*testing.T, *TestData) string, opts []Option) {
+	t.Helper()
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := runTestInternal(t, minimizeName, bytes.NewReader(src), f, true /* rewrite */, opts...)
+	if t.Failed() {
+		t.FailNow()
+	}
+	if err := ioutil.WriteFile(path+".out", out, 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.SkipNow()
+}
+
+// testPattern returns the -test.run pattern which only matches the test
+// with the given name.
+func testPattern(name string) string {
+	elems := strings.Split(name, "/")
+	for i, e := range elems {
+		elems[i] = "^" + regexp.QuoteMeta(e) + "$"
+	}
+	return strings.Join(elems, "/")
+}
+
+// reduce clears the flags of as many items as possible while fails holds,
+// trying to clear the flags of sets of items of decreasing size.
+func reduce(items []*bool, fails func() bool) {
+	for size := (len(items) + 1) / 2; size > 0; {
+		progress := false
+		for start := 0; start < len(items); start += size {
+			end := start + size
+			if end > len(items) {
+				end = len(items)
+			}
+			var cleared []*bool
+			for _, item := range items[start:end] {
+				if *item {
+					*item = false
+					cleared = append(cleared, item)
+				}
+			}
+			if len(cleared) == 0 {
+				continue
+			}
+			if fails() {
+				progress = true
+				continue
+			}
+			for _, item := range cleared {
+				*item = true
+			}
+		}
+		if size > 1 {
+			size /= 2
+		} else if !progress {
+			break
+		}
+	}
+}
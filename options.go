@@ -0,0 +1,906 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+	"unicode"
+
+	"github.com/cockroachdb/errors"
+	"github.com/google/go-cmp/cmp"
+)
+
+// Option configures the behavior of RunTest and the other entry points of
+// this package.
+type Option func(*options)
+
+type options struct {
+	// separator is the line separating the input of a directive from its
+	// expected output.
+	separator string
+
+	// caseInsensitiveCmds causes directive commands to be lowercased
+	// before being handed to the test function. On rewrite, the command
+	// on the directive line is normalized to lowercase as well.
+	caseInsensitiveCmds bool
+
+	// tabWidth, if non-zero, causes tabs in the indentation of input,
+	// expected and actual lines to be expanded to spaces.
+	tabWidth int
+	// rejectMixedIndent causes an error when the indentation of an input,
+	// expected or actual line mixes tabs and spaces.
+	rejectMixedIndent bool
+
+	// markTrailingWS causes expected output lines that end in whitespace
+	// to be terminated with a marker, to protect the whitespace from
+	// editors.
+	markTrailingWS bool
+
+	// inputTemplate, if set, causes the input of each directive to be
+	// executed as a text/template before being handed to the test
+	// function.
+	inputTemplate *inputTemplate
+
+	// expandEnv causes references to environment variables in directive
+	// arguments and inputs to be expanded.
+	expandEnv bool
+
+	// argsFromFiles causes argument values of the form @path to be
+	// replaced with the contents of the file at path.
+	argsFromFiles bool
+
+	// indentedArgs causes indented lines immediately following a
+	// directive line to be parsed as additional arguments.
+	indentedArgs bool
+
+	// cmpOpts are passed to cmp.Diff when comparing structured results.
+	cmpOpts []cmp.Option
+
+	// mungers are applied to the actual output of every directive, in
+	// order.
+	mungers []munger
+
+	// capture, if set, causes the output the test function writes to
+	// os.Stdout and os.Stderr to be captured.
+	capture CaptureMode
+
+	// checkDeterminism causes the test function to be invoked twice for
+	// every directive, failing if the outputs differ.
+	checkDeterminism bool
+
+	// shuffle causes the directives to run in a random order determined
+	// by shuffleSeed.
+	shuffle     bool
+	shuffleSeed int64
+
+	// setupCmds are the commands of the directives which are always run
+	// when re-running failed directives.
+	setupCmds map[string]bool
+
+	// failures, if set, records the directives which fail and selects the
+	// directives to run when re-running failed directives.
+	failures *failureCache
+
+	// interactive, if set, is used to resolve mismatches interactively.
+	interactive *interactiveSession
+
+	// leakCheck, if set, causes the test to fail if a directive or test
+	// file leaks goroutines.
+	leakCheck LeakCheckMode
+
+	// fileTimeout, if set, is the budget for running each test file.
+	fileTimeout time.Duration
+	// watchdog, if set, tracks the directive being run for the
+	// diagnostics dumped when fileTimeout expires.
+	watchdog *watchdog
+
+	// hermetic confines the files used by the test function to the scratch
+	// directory, which is set for each test file.
+	hermetic bool
+	scratch  string
+	// auditRoot is the directory whose files are audited with hermetic.
+	auditRoot string
+
+	// walkFilters select the files and directories visited by Walk.
+	walkFilters []func(path string, info os.FileInfo) bool
+	// walkRoot is the path passed to Walk.
+	walkRoot string
+	// excludeGlobs are the patterns of the paths excluded by Walk.
+	excludeGlobs []string
+	// maxDepth, if positive, limits the depth of the directories visited
+	// by Walk.
+	maxDepth int
+	// extensions, if set, restricts the files visited by Walk to those
+	// with one of the extensions.
+	extensions []string
+	// extHandlers are the functions called by Walk for the files with
+	// each extension, instead of the function passed to Walk.
+	extHandlers map[string]func(t *testing.T, path string)
+	// walkHidden causes Walk to visit hidden files and directories.
+	walkHidden bool
+	// skipSymlinks causes Walk to skip symbolic links.
+	skipSymlinks bool
+	// ignoreBrokenSymlinks causes Walk to skip broken symbolic links,
+	// instead of failing.
+	ignoreBrokenSymlinks bool
+
+	// testdataRoot, if set, is the directory relative to which the paths
+	// passed to RunTest and Walk are resolved.
+	testdataRoot string
+
+	// requireDirectives causes test files without directives to fail.
+	requireDirectives bool
+
+	// orphanDirs are the directories checked for files not used by any
+	// test, by RunMain.
+	orphanDirs []string
+
+	// subtestName, if set, returns the name of the subtest created by Walk
+	// for a file or directory.
+	subtestName func(path string) string
+	// directiveSubtests causes each directive to run in a subtest, named
+	// by directiveSubtestName.
+	directiveSubtests    bool
+	directiveSubtestName func(d *TestData) string
+
+	// compareMode is the comparison mode of the directives which do not
+	// specify one with the compare argument.
+	compareMode string
+	// commentPrefix starts comment lines.
+	commentPrefix string
+	// directiveTimeout, if set, is the budget for running each directive.
+	directiveTimeout time.Duration
+	// parallel is set if Walk runs the test files in parallel.
+	parallel bool
+	// migrateArgs, if set, transforms the arguments of every directive.
+	migrateArgs func(cmd string, args CmdArgs) CmdArgs
+	// builtinEcho is set if echo directives are handled by the framework.
+	builtinEcho bool
+	// wrapWidth, if set, is the width at which output lines are wrapped.
+	wrapWidth int
+	// postRewrite are the hooks applied to the rewritten test files.
+	postRewrite []func(path string, old, new []byte) ([]byte, bool)
+	// keepOldExpected is set if the expected output replaced when rewriting
+	// is kept as a comment.
+	keepOldExpected bool
+	// progressInterval, if set, is the interval at which Walk reports its
+	// progress, and progress the reporter of the Walk being run.
+	progressInterval time.Duration
+	progress         *progress
+	// quiet is set if the messages logged for passing directives are
+	// suppressed.
+	quiet bool
+	// failureDir, if set, is where the artifacts of mismatched directives
+	// are written.
+	failureDir string
+	// failFast is set if Walk skips the remaining files once a file fails,
+	// which is recorded in walkFailed.
+	failFast   bool
+	walkFailed int32
+	// keepGoing is set if mismatches don't stop the test files.
+	keepGoing bool
+	// legacyParsing is set to parse the test files as older versions did.
+	legacyParsing bool
+	// frameworkArgs is set if the framework interprets the arguments
+	// listed in frameworkArgs.
+	frameworkArgs bool
+	// builtinDirectives is set if the framework runs the directives listed
+	// in builtinDirectives.
+	builtinDirectives bool
+	// firstLine is the line number of the first line of the input in its
+	// source file, for RunTestInline.
+	firstLine int
+}
+
+// munger is a named transformation of the output of a directive.
+type munger struct {
+	name string
+	fn   func(string) string
+}
+
+// inputTemplate holds the arguments of TemplateInput.
+type inputTemplate struct {
+	data  interface{}
+	funcs template.FuncMap
+}
+
+// defaultOptions holds the options set with SetDefaults.
+var defaultOptions struct {
+	sync.Mutex
+	opts []Option
+}
+
+// SetDefaults sets options which apply to all the entry points of this
+// package, before the options passed to them. This allows a package with
+// many tests to set its conventions once, typically from TestMain or an
+// init function:
+//
+//   func TestMain(m *testing.M) {
+//     datadriven.SetDefaults(datadriven.ExpandTabs(8), datadriven.CommentPrefix("--"))
+//     os.Exit(datadriven.RunMain(m))
+//   }
+//
+// Each call replaces the defaults set by the previous one.
+func SetDefaults(opts ...Option) {
+	defaultOptions.Lock()
+	defer defaultOptions.Unlock()
+	defaultOptions.opts = append([]Option(nil), opts...)
+}
+
+func makeOptions(opts []Option) options {
+	o := options{
+		separator:     "----",
+		commentPrefix: "#",
+	}
+	defaultOptions.Lock()
+	defaults := defaultOptions.opts
+	defaultOptions.Unlock()
+	for _, opt := range defaults {
+		opt(&o)
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// validate returns an error if the options cannot be used to parse test
+// files, which is reported by the functions which take the options.
+func (o *options) validate() error {
+	// An empty separator would match every line, and an empty comment
+	// prefix would turn every line into a comment.
+	if o.separator == "" {
+		return errors.New("the separator cannot be empty")
+	}
+	if o.commentPrefix == "" {
+		return errors.New("the comment prefix cannot be empty")
+	}
+	return nil
+}
+
+// CaseInsensitiveCommands causes directive commands to be matched
+// case-insensitively: TestData.Cmd is always lowercase, so that e.g.
+// "SELECT" and "select" are handled identically. When rewriting, the
+// commands in the test file are normalized to lowercase.
+func CaseInsensitiveCommands() Option {
+	return func(o *options) {
+		o.caseInsensitiveCmds = true
+	}
+}
+
+// Separator overrides the "----" line which separates the input of a
+// directive from its expected output; the double separator syntax for
+// expected output containing blank lines uses the given separator twice.
+// This is useful for test files whose inputs or outputs frequently contain
+// lines of dashes. The separator cannot be empty: RunTest and Walk then fail
+// the test, and the functions which return errors, e.g. Parse, return one.
+func Separator(sep string) Option {
+	return func(o *options) {
+		o.separator = sep
+	}
+}
+
+// ExpandTabs causes tabs in the leading whitespace of input, expected and
+// actual lines to be expanded to spaces, with tab stops every width columns.
+// This avoids spurious differences between outputs that only differ in
+// invisible indentation. The expansion is also applied when rewriting.
+func ExpandTabs(width int) Option {
+	return func(o *options) {
+		o.tabWidth = width
+	}
+}
+
+// WrapOutput causes output lines longer than the given width to be wrapped
+// when rewriting, so that the expected output remains reviewable. A wrapped
+// line is split into lines ending with a backslash, which are joined again
+// when parsing the expected output; lines which legitimately end with a
+// backslash are followed by an empty continuation line. With FrameworkArgs,
+// the wrap argument of a directive overrides the width, e.g. wrap=120, or
+// disables the wrapping with wrap=0.
+func WrapOutput(width int) Option {
+	return func(o *options) {
+		o.wrapWidth = width
+	}
+}
+
+// RejectMixedIndentation causes a test failure when the leading whitespace
+// of an input, expected or actual line mixes tabs and spaces.
+func RejectMixedIndentation() Option {
+	return func(o *options) {
+		o.rejectMixedIndent = true
+	}
+}
+
+// MarkTrailingWhitespace causes output lines that end in whitespace to be
+// written with a trailing ¶ marker when rewriting, and the marker to be
+// stripped from expected output lines when parsing. This protects
+// meaningful trailing whitespace from editors that strip it. Lines that
+// legitimately end in ¶ are written with an additional marker.
+func MarkTrailingWhitespace() Option {
+	return func(o *options) {
+		o.markTrailingWS = true
+	}
+}
+
+// TemplateInput causes the input of each directive to be executed as a
+// text/template, with the given data and functions, before being handed to
+// the test function. This allows inputs to contain computed values, e.g.
+// {{repeat "x" 100}} given a suitable function. The test file itself is
+// unaffected when rewriting.
+func TemplateInput(data interface{}, funcs template.FuncMap) Option {
+	return func(o *options) {
+		o.inputTemplate = &inputTemplate{data: data, funcs: funcs}
+	}
+}
+
+// ExpandEnv causes references to environment variables of the form
+// ${env:NAME} in the arguments and input of directives to be replaced with
+// the value of the variable before the directive is handed to the test
+// function. A reference to a variable that is not set fails the test. The
+// test file itself is unaffected when rewriting.
+func ExpandEnv() Option {
+	return func(o *options) {
+		o.expandEnv = true
+	}
+}
+
+// ArgsFromFiles causes argument values of the form @path, e.g. key=@data.txt,
+// to be replaced with the contents of the named file before the directive is
+// handed to the test function, so that large values need not appear on the
+// directive line. The path is relative to the directory of the test file.
+func ArgsFromFiles() Option {
+	return func(o *options) {
+		o.argsFromFiles = true
+	}
+}
+
+// IndentedArgs causes indented lines immediately following a directive line
+// to be parsed as additional arguments of the directive, rather than as
+// input. This allows heavily configured directives to be written as:
+//
+//   <command>
+//     arg1=val1
+//     arg2=(val2, val3)
+//   <input to the command>
+//   ----
+//
+// Note that with this option, the input of a directive cannot start with an
+// indented line.
+func IndentedArgs() Option {
+	return func(o *options) {
+		o.indentedArgs = true
+	}
+}
+
+// CmpOptions sets the options passed to cmp.Diff when comparing the
+// structured results of directives run by RunTestStructured.
+func CmpOptions(opts ...cmp.Option) Option {
+	return func(o *options) {
+		o.cmpOpts = append(o.cmpOpts, opts...)
+	}
+}
+
+// Munger registers a transformation which is applied to the actual output of
+// every directive before it is compared with the expected output (or used
+// to rewrite it), e.g. to scrub timestamps or other nondeterministic
+// values. Mungers registered with this option are applied in order,
+// followed by those registered by the test function for the current
+// directive using TestData.AddMunger. The name identifies the munger in
+// traces.
+func Munger(name string, fn func(string) string) Option {
+	return func(o *options) {
+		o.mungers = append(o.mungers, munger{name: name, fn: fn})
+	}
+}
+
+// Compare sets the comparison mode of the directives which do not specify
+// one with the compare argument, e.g. Compare("rows-unordered"). See RunTest
+// for the available modes.
+func Compare(mode string) Option {
+	return func(o *options) {
+		o.compareMode = mode
+	}
+}
+
+// CommentPrefix sets the prefix of comment lines, which is # by default.
+// Block comments then start with the prefix followed by | and end with |
+// followed by the prefix. This is useful to match the comment syntax of the
+// language under test, e.g. CommentPrefix("--") for SQL. The prefix cannot
+// be empty, as for Separator.
+func CommentPrefix(prefix string) Option {
+	return func(o *options) {
+		o.commentPrefix = prefix
+	}
+}
+
+// MigrateArgs sets a function which transforms the arguments of every
+// directive before it is run, as if the test function had called
+// RewriteCmdArgs with the result. This allows migrating arguments
+// mechanically: the directives see the new arguments, and the test files
+// are updated when rewriting.
+func MigrateArgs(fn func(cmd string, args CmdArgs) CmdArgs) Option {
+	return func(o *options) {
+		o.migrateArgs = fn
+	}
+}
+
+// BuiltinEcho enables the built-in echo directive, whose output is its
+// input after all the substitutions (foreach variables, macros, ExpandEnv,
+// TemplateInput and so on) and mungers are applied. The test function is
+// not invoked for it. This is useful to debug substitutions, includes and
+// mungers:
+//
+//   echo
+//   $HOME/{{.Name}}
+//   ----
+//   /home/user/test
+func BuiltinEcho() Option {
+	return func(o *options) {
+		o.builtinEcho = true
+	}
+}
+
+// Parallel causes Walk to run the test files in parallel, by calling
+// t.Parallel in the subtest of each file. The test function must then be
+// safe to call concurrently. It is ignored with -datadriven-watch. The
+// directives run with CaptureOutput or Hermetic are still serialized, as
+// these options rely on process-wide state.
+//
+// The duration of each successful run of a test file is recorded in the
+// user cache directory, and the test files of each directory are started
+// by decreasing duration of their last run, so that the wall-clock time is
+// not dominated by a long file which starts last.
+func Parallel() Option {
+	return func(o *options) {
+		o.parallel = true
+	}
+}
+
+// PostRewrite registers a hook which is invoked with the old and new
+// contents of each test file rewritten by RunTest (and Walk), before the
+// new contents are written. The hook returns the contents to write, e.g.
+// after adding a license header or applying a project-specific
+// normalization, or false to veto the write, in which case the file is
+// left unchanged. Multiple hooks are applied in order.
+func PostRewrite(fn func(path string, old, new []byte) (data []byte, write bool)) Option {
+	return func(o *options) {
+		o.postRewrite = append(o.postRewrite, fn)
+	}
+}
+
+// KeepOldExpected causes the expected output replaced when rewriting to be
+// kept as a comment beneath the new one, to compare them in the test file
+// when reviewing a large regeneration:
+//
+//   query
+//   SELECT x FROM t
+//   ----
+//   2
+//
+//   # previous expected output, remove after review:
+//   # 1
+//
+// The comments must be removed by hand once reviewed; they can be found by
+// searching for "remove after review". This does not apply to the test
+// files which declare configurations.
+func KeepOldExpected() Option {
+	return func(o *options) {
+		o.keepOldExpected = true
+	}
+}
+
+// Quiet suppresses the messages logged for the directives which pass,
+// including those logged with TestData.Logf when running verbosely and the
+// notices of the framework, e.g. about pending directives or deprecated
+// commands, so that only failures are reported. It can also be enabled for
+// all tests with the -datadriven-quiet flag.
+func Quiet() Option {
+	return func(o *options) {
+		o.quiet = true
+	}
+}
+
+// isQuiet returns whether the messages logged for passing directives are
+// suppressed.
+func isQuiet(o *options) bool {
+	return *quietFlag || (o != nil && o.quiet)
+}
+
+// CheckDeterminism causes the test function to be invoked twice for every
+// directive, and the directive to fail if the two outputs (after mungers
+// are applied) differ. This catches output that depends on map iteration
+// order, timing and the like at the directive that produces it. It can also
+// be enabled for all tests with the -datadriven-check-determinism flag.
+//
+// Test functions which are not idempotent, e.g. because directives
+// modify the state of the test, cannot be checked this way.
+func CheckDeterminism() Option {
+	return func(o *options) {
+		o.checkDeterminism = true
+	}
+}
+
+// WalkFilter restricts the files and directories visited by Walk to those
+// for which the given function returns true. The path passed to the
+// function is that of the file or directory, starting with the path passed
+// to Walk. When a directory is excluded, none of its contents are visited.
+// If the option is used multiple times, a file must satisfy all the
+// filters. Temporary files (named XXX~ or #XXX#) are always excluded.
+func WalkFilter(fn func(path string, info os.FileInfo) bool) Option {
+	return func(o *options) {
+		o.walkFilters = append(o.walkFilters, fn)
+	}
+}
+
+// ExcludeGlob excludes the files and directories matching any of the given
+// patterns from Walk, e.g. to keep artifacts next to the test files. The
+// patterns use the syntax of filepath.Match, and are matched against both
+// the name of each file or directory and its path relative to the path
+// passed to Walk, using forward slashes (e.g. "*.out" or "scratch/*").
+func ExcludeGlob(patterns ...string) Option {
+	return func(o *options) {
+		o.excludeGlobs = append(o.excludeGlobs, patterns...)
+	}
+}
+
+// MaxDepth limits the depth of the directories visited by Walk. With a depth
+// of 1, only the files directly in the directory passed to Walk are visited;
+// with a depth of 2, the files in its subdirectories are visited as well, and
+// so on.
+func MaxDepth(depth int) Option {
+	return func(o *options) {
+		o.maxDepth = depth
+	}
+}
+
+// Extensions restricts the files visited by Walk to those with one of the
+// given extensions (e.g. ".dd" or ".sql"), as well as those with an
+// extension registered with ExtensionHandler.
+func Extensions(exts ...string) Option {
+	return func(o *options) {
+		for _, ext := range exts {
+			o.extensions = append(o.extensions, normalizeExt(ext))
+		}
+	}
+}
+
+// ExtensionHandler causes Walk to call the given function for the files with
+// the given extension, instead of the function passed to Walk. This allows a
+// single Walk to drive test files of different kinds in a directory, e.g.:
+//
+//   datadriven.Walk(t, "testdata", nil,
+//     datadriven.ExtensionHandler(".sql", runSQLTest),
+//     datadriven.ExtensionHandler(".plan", runPlanTest),
+//   )
+//
+// If the function passed to Walk is nil, the files without a handler cause
+// the test to fail.
+func ExtensionHandler(ext string, f func(t *testing.T, path string)) Option {
+	return func(o *options) {
+		if o.extHandlers == nil {
+			o.extHandlers = make(map[string]func(t *testing.T, path string))
+		}
+		o.extHandlers[normalizeExt(ext)] = f
+	}
+}
+
+// normalizeExt adds the leading dot to an extension, if missing.
+func normalizeExt(ext string) string {
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return ext
+}
+
+// walkHandler returns the function Walk calls for the file at the given
+// path, given the function passed to Walk.
+func (o *options) walkHandler(
+	f func(t *testing.T, path string), path string,
+) func(t *testing.T, path string) {
+	if h, ok := o.extHandlers[filepath.Ext(path)]; ok {
+		return h
+	}
+	if f == nil {
+		return func(t *testing.T, path string) {
+			t.Fatalf("%s: no handler for files with extension %q", path, filepath.Ext(path))
+		}
+	}
+	return f
+}
+
+// FailFast causes Walk to skip the remaining test files once a test file
+// fails, to shorten the feedback loop when a systemic change breaks all the
+// files. With Parallel, the files which already started still complete.
+func FailFast() Option {
+	return func(o *options) {
+		o.failFast = true
+	}
+}
+
+// WalkHiddenFiles causes Walk to visit hidden files and directories, whose
+// name starts with a dot, which are skipped by default.
+func WalkHiddenFiles() Option {
+	return func(o *options) {
+		o.walkHidden = true
+	}
+}
+
+// SkipSymlinks causes Walk to skip symbolic links, which are followed by
+// default.
+func SkipSymlinks() Option {
+	return func(o *options) {
+		o.skipSymlinks = true
+	}
+}
+
+// IgnoreBrokenSymlinks causes Walk to skip broken symbolic links, which
+// cause the test to fail by default.
+func IgnoreBrokenSymlinks() Option {
+	return func(o *options) {
+		o.ignoreBrokenSymlinks = true
+	}
+}
+
+// SubtestNames sets the function which returns the name of the subtest
+// created by Walk for a file or directory, given its path. By default, the
+// name of the file or directory is used. The names are sanitized: slashes
+// and whitespace are replaced with underscores, so that -run patterns are
+// predictable and stable across platforms.
+func SubtestNames(fn func(path string) string) Option {
+	return func(o *options) {
+		o.subtestName = fn
+	}
+}
+
+// DirectiveSubtests causes each directive to run in its own subtest, named
+// by the given function, so that it can be selected with -run. If the
+// function is nil, the subtests are named after the line and the command of
+// the directive, e.g. "12_build". The names are sanitized as with
+// SubtestNames. The subtests are grouped under a subtest named
+// "directives", e.g. TestFoo/directives/12_build. A failure still stops
+// the processing of the file.
+//
+// The test function can call t.Parallel to run a directive in parallel
+// with the directives which follow it in the file. It then completes after
+// the other directives, but before the file is rewritten and torn down,
+// and its failure does not stop the processing of the file. This cannot be
+// combined with CaptureOutput, Hermetic or -datadriven-interactive.
+func DirectiveSubtests(fn func(d *TestData) string) Option {
+	return func(o *options) {
+		o.directiveSubtests = true
+		o.directiveSubtestName = fn
+	}
+}
+
+// directiveSubtestNameFor returns the name of the subtest of the directive.
+func (o *options) directiveSubtestNameFor(d *TestData) string {
+	if o.directiveSubtestName != nil {
+		return sanitizeSubtestName(o.directiveSubtestName(d))
+	}
+	return sanitizeSubtestName(fmt.Sprintf("%d_%s", d.Pos.Line, d.Cmd))
+}
+
+// sanitizeSubtestName replaces the slashes and whitespace in a subtest name
+// with underscores.
+func sanitizeSubtestName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || unicode.IsSpace(r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" {
+		name = "_"
+	}
+	return name
+}
+
+// RequireDirectives causes test files which contain no directives to fail,
+// instead of passing silently. Such files are usually stray artifacts, or
+// files which are mangled, e.g. because of a mistyped separator.
+func RequireDirectives() Option {
+	return func(o *options) {
+		o.requireDirectives = true
+	}
+}
+
+// TestdataRoot causes the relative paths passed to RunTest and Walk to be
+// resolved relative to the given directory, instead of the working
+// directory. It overrides the DD_TESTDATA_ROOT environment variable, or its
+// longer form DATADRIVEN_TESTDATA_ROOT.
+//
+// Without either, the relative paths which do not exist in the working
+// directory are looked up among the Bazel runfiles of the test, if any,
+// e.g. for tests run in a sandbox or remotely: in the directories given by
+// RUNFILES_DIR or TEST_SRCDIR, under the TEST_WORKSPACE directory or not,
+// and then in the manifest given by RUNFILES_MANIFEST_FILE, which only
+// lists files.
+func TestdataRoot(dir string) Option {
+	return func(o *options) {
+		o.testdataRoot = dir
+	}
+}
+
+// testdataRootEnvs are the environment variables which set the directory
+// relative to which the paths passed to RunTest and Walk are resolved, in
+// order of precedence.
+var testdataRootEnvs = []string{"DD_TESTDATA_ROOT", "DATADRIVEN_TESTDATA_ROOT"}
+
+// rootDir returns the directory set by the TestdataRoot option or the
+// environment variables, if any.
+func (o *options) rootDir() string {
+	root := o.testdataRoot
+	for _, env := range testdataRootEnvs {
+		if root == "" {
+			root = os.Getenv(env)
+		}
+	}
+	return root
+}
+
+// resolvePath resolves a path passed to RunTest or Walk, according to the
+// TestdataRoot option, the environment variables or the Bazel runfiles.
+// The path is made absolute when it is resolved relative to a root
+// directory, so that resolving it again is a no-op. Otherwise, it is
+// returned as is if it exists in the working directory, and as found among
+// the runfiles if not.
+func (o *options) resolvePath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	root := o.rootDir()
+	if root == "" {
+		if _, err := os.Stat(path); err != nil {
+			if p, ok := runfilesPath(path); ok {
+				return p
+			}
+		}
+		return path
+	}
+	path = filepath.Join(root, path)
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return path
+}
+
+// runfilesPath looks up a relative path among the Bazel runfiles.
+func runfilesPath(path string) (string, bool) {
+	workspace := os.Getenv("TEST_WORKSPACE")
+	for _, env := range []string{"RUNFILES_DIR", "TEST_SRCDIR"} {
+		dir := os.Getenv(env)
+		if dir == "" {
+			continue
+		}
+		for _, p := range []string{filepath.Join(dir, workspace, path), filepath.Join(dir, path)} {
+			if _, err := os.Stat(p); err == nil {
+				return p, true
+			}
+		}
+	}
+	manifest := os.Getenv("RUNFILES_MANIFEST_FILE")
+	if manifest == "" {
+		return "", false
+	}
+	data, err := ioutil.ReadFile(manifest)
+	if err != nil {
+		return "", false
+	}
+	// Each line of the manifest maps a runfile to its actual path.
+	rel := filepath.ToSlash(filepath.Clean(path))
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.SplitN(strings.TrimSuffix(line, "\r"), " ", 2)
+		if len(fields) == 2 && (fields[0] == rel || fields[0] == workspace+"/"+rel) {
+			return fields[1], true
+		}
+	}
+	return "", false
+}
+
+// walkIncludes returns whether Walk visits the given file or directory,
+// which is not the root of the walk.
+func (o *options) walkIncludes(path string, info os.FileInfo) bool {
+	if tempFileRe.MatchString(info.Name()) ||
+		(!o.walkHidden && strings.HasPrefix(info.Name(), ".")) {
+		// Temp or hidden file, don't even try processing.
+		return false
+	}
+	rel := info.Name()
+	if o.walkRoot != "" {
+		if r, err := filepath.Rel(o.walkRoot, path); err == nil {
+			rel = filepath.ToSlash(r)
+		}
+	}
+	for _, pattern := range o.excludeGlobs {
+		if ok, _ := filepath.Match(pattern, info.Name()); ok {
+			return false
+		}
+		if ok, _ := filepath.Match(pattern, rel); ok {
+			return false
+		}
+	}
+	if len(o.extensions) > 0 && !info.IsDir() {
+		ext := filepath.Ext(info.Name())
+		_, ok := o.extHandlers[ext]
+		for _, e := range o.extensions {
+			ok = ok || e == ext
+		}
+		if !ok {
+			return false
+		}
+	}
+	if o.maxDepth > 0 {
+		depth := strings.Count(rel, "/") + 1
+		if depth > o.maxDepth || (info.IsDir() && depth >= o.maxDepth) {
+			return false
+		}
+	}
+	for _, fn := range o.walkFilters {
+		if !fn(path, info) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeIndent applies the indentation policy to the leading whitespace
+// of a single line.
+func (o *options) normalizeIndent(line string) (string, error) {
+	if o.tabWidth <= 0 && !o.rejectMixedIndent {
+		return line, nil
+	}
+	indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+	if o.rejectMixedIndent && strings.Contains(indent, " ") && strings.Contains(indent, "\t") {
+		return "", errors.New("mixed tabs and spaces in indentation")
+	}
+	if o.tabWidth <= 0 || !strings.Contains(indent, "\t") {
+		return line, nil
+	}
+	var buf strings.Builder
+	col := 0
+	for _, c := range indent {
+		n := 1
+		if c == '\t' {
+			n = o.tabWidth - col%o.tabWidth
+		}
+		buf.WriteString(strings.Repeat(" ", n))
+		col += n
+	}
+	buf.WriteString(line[len(indent):])
+	return buf.String(), nil
+}
+
+// normalizeIndentText applies normalizeIndent to every line of s.
+func (o *options) normalizeIndentText(s string) (string, error) {
+	if o.tabWidth <= 0 && !o.rejectMixedIndent {
+		return s, nil
+	}
+	lines := strings.Split(s, "\n")
+	for i := range lines {
+		var err error
+		if lines[i], err = o.normalizeIndent(lines[i]); err != nil {
+			return "", errors.Wrapf(err, "line %d", i+1)
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
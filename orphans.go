@@ -0,0 +1,111 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CheckOrphans causes RunMain to fail if any of the files under the given
+// directories was not used by the tests: run by RunTest, included by another
+// test file, or referenced by an argument (see ArgsFromFiles). This catches
+// test files left behind by refactors. Hidden and temporary files, as well
+// as files skipped with the .skip suffix, are ignored.
+//
+// The check is only performed if all the tests passed and the tests were
+// not filtered with -run.
+func CheckOrphans(dirs ...string) Option {
+	return func(o *options) {
+		o.orphanDirs = append(o.orphanDirs, dirs...)
+	}
+}
+
+// usedFiles is the set of the absolute paths of the test files used by the
+// tests.
+var usedFiles struct {
+	sync.Mutex
+	m map[string]bool
+}
+
+// recordUsedFile records that the test file at the given path was used.
+func recordUsedFile(path string) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+	usedFiles.Lock()
+	defer usedFiles.Unlock()
+	if usedFiles.m == nil {
+		usedFiles.m = make(map[string]bool)
+	}
+	usedFiles.m[abs] = true
+}
+
+// testsFiltered returns whether the tests were filtered with -run, in which
+// case not all the test files are expected to be used.
+func testsFiltered() bool {
+	f := flag.Lookup("test.run")
+	return f != nil && f.Value.String() != ""
+}
+
+// checkOrphans reports to w the files under the given directories which
+// were not used, and returns false if there are any.
+func checkOrphans(w io.Writer, o *options) bool {
+	if len(o.orphanDirs) == 0 {
+		return true
+	}
+	usedFiles.Lock()
+	defer usedFiles.Unlock()
+	var orphans []string
+	for _, dir := range o.orphanDirs {
+		dir = o.resolvePath(dir)
+		o.walkRoot = dir
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if path != dir && !o.walkIncludes(path, info) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.IsDir() || strings.HasSuffix(path, skipSuffix) {
+				return nil
+			}
+			if abs, err := filepath.Abs(path); err == nil && !usedFiles.m[abs] {
+				orphans = append(orphans, path)
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(w, "checking for orphaned test files: %v\n", err)
+			return false
+		}
+	}
+	if len(orphans) == 0 {
+		return true
+	}
+	sort.Strings(orphans)
+	fmt.Fprintf(w, "test files not used by any test:\n  %s\n", strings.Join(orphans, "\n  "))
+	return false
+}
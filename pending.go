@@ -0,0 +1,71 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// pendingArg is the argument which marks directives which are not run yet,
+// e.g. because the feature they test is not implemented:
+//
+//   query pending
+//   SELECT unimplemented()
+//   ----
+//   <expected results>
+//
+// Pending directives are skipped, and their expected results are kept as
+// is when rewriting. RunMain lists the pending directives at the end of the
+// run.
+const pendingArg = "pending"
+
+// pendingDirectives collects the positions of the pending directives.
+var pendingDirectives struct {
+	sync.Mutex
+	positions []string
+}
+
+// recordPending records that the directive at the given position is
+// pending.
+func recordPending(pos Pos) {
+	pendingDirectives.Lock()
+	defer pendingDirectives.Unlock()
+	pendingDirectives.positions = append(pendingDirectives.positions, pos.String())
+}
+
+// reportPending lists the pending directives to w, if any.
+func reportPending(w io.Writer) {
+	pendingDirectives.Lock()
+	defer pendingDirectives.Unlock()
+	if len(pendingDirectives.positions) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%d pending directive(s):\n  %s\n",
+		len(pendingDirectives.positions), strings.Join(pendingDirectives.positions, "\n  "))
+}
+
+// skipPending skips a pending directive, keeping its expected output.
+func (r *testDataReader) skipPending(d *TestData) {
+	recordPending(d.Pos)
+	if r.matrix != nil && r.matrix.rewrite {
+		r.matrix.record(r.config, d.Pos.String(), d.Expected)
+		r.emitConfigExpected(d.Pos.String())
+	} else {
+		r.emitExpected(d.Expected, d.alternatives...)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// noRewriteArg is the argument which pins the expected output of a
+// directive, e.g. because it was curated by hand:
+//
+//   explain no-rewrite
+//   SELECT ...
+//   ----
+//   <hand-curated expected results>
+//
+// The expected output of pinned directives is kept as is when rewriting.
+// RunMain lists the pinned directives whose output would have changed at the
+// end of the run.
+const noRewriteArg = "no-rewrite"
+
+// pinnedChanges collects the positions of the pinned directives whose
+// output would have changed when rewriting.
+var pinnedChanges struct {
+	sync.Mutex
+	positions []string
+}
+
+// recordPinnedChange records that the output of a pinned directive differs
+// from its expected output when rewriting.
+func recordPinnedChange(t *testing.T, d *TestData, actual string) {
+	t.Helper()
+	if !isQuiet(d.opts) {
+		t.Logf("%s: %s: the expected output is kept, but differs from the actual output:\n%s",
+			d.Pos, noRewriteArg, actual)
+	}
+	pinnedChanges.Lock()
+	defer pinnedChanges.Unlock()
+	pinnedChanges.positions = append(pinnedChanges.positions, d.Pos.String())
+}
+
+// reportPinnedChanges lists the pinned directives whose output would have
+// changed to w, if any.
+func reportPinnedChanges(w io.Writer) {
+	pinnedChanges.Lock()
+	defer pinnedChanges.Unlock()
+	if len(pinnedChanges.positions) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%d directive(s) with %s would have changed:\n  %s\n",
+		len(pinnedChanges.positions), noRewriteArg, strings.Join(pinnedChanges.positions, "\n  "))
+}
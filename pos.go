@@ -0,0 +1,101 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Pos is a position in a test file.
+type Pos struct {
+	File string
+	Line int
+	// Col is the column (starting at 1) within the line, or 0 if the
+	// position refers to the line as a whole.
+	Col int
+
+	// Macro is set if the position is within the body of a macro, in which
+	// case Invocation is the position of the directive that invoked it.
+	Macro      string
+	Invocation *Pos
+}
+
+// String returns the position in the file:line[:col] format, followed by
+// the macro invocation chain, if any. It is suitable for inclusion in logs
+// and error messages.
+func (p Pos) String() string {
+	if p.Macro == "" || p.Invocation == nil {
+		return p.Location()
+	}
+	return fmt.Sprintf("%s (in macro %s invoked at %s)", p.Location(), p.Macro, p.Invocation)
+}
+
+// Location returns the position in the file:line[:col] format, without the
+// macro invocation chain. This is the format understood by most editors.
+func (p Pos) Location() string {
+	if p.Col > 0 {
+		return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Col)
+	}
+	return fmt.Sprintf("%s:%d", p.File, p.Line)
+}
+
+// ArgPos returns the position of the first argument with the given key on
+// the directive line, or the position of the directive if it is not known.
+func (td *TestData) ArgPos(key string) Pos {
+	if pos, ok := td.argPos[key]; ok {
+		return pos
+	}
+	return td.Pos
+}
+
+// lineSegment is a physical line that is part of a (possibly continued)
+// directive line.
+type lineSegment struct {
+	// start is the offset of the segment in the directive line.
+	start int
+	// line and col are the position of the start of the segment in the
+	// file.
+	line, col int
+}
+
+// argPositions returns the positions of the arguments of the given
+// directive line, keyed by the first occurrence of each key.
+func argPositions(file, line string, segs []lineSegment, into map[string]Pos) map[string]Pos {
+	fields, offsets, err := splitDirectivesWithOffsets(line)
+	if err != nil || len(segs) == 0 {
+		return into
+	}
+	if into == nil {
+		into = make(map[string]Pos)
+	}
+	for i := 1; i < len(fields); i++ {
+		key := fields[i]
+		if pos := strings.IndexByte(key, '='); pos >= 0 {
+			key = key[:pos]
+		}
+		if _, ok := into[key]; ok {
+			continue
+		}
+		seg := segs[0]
+		for _, s := range segs[1:] {
+			if s.start <= offsets[i] {
+				seg = s
+			}
+		}
+		into[key] = Pos{File: file, Line: seg.line, Col: seg.col + offsets[i] - seg.start}
+	}
+	return into
+}
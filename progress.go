@@ -0,0 +1,218 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// WalkProgress causes Walk to report its progress to stderr if it takes
+// longer than the given interval, and then at every interval: the number of
+// test files completed out of the total, and the directives being run. This
+// keeps long-running suites from looking hung, e.g. in CI.
+func WalkProgress(interval time.Duration) Option {
+	return func(o *options) {
+		o.progressInterval = interval
+	}
+}
+
+// progressOutput is where the progress of Walk is reported.
+var progressOutput io.Writer = os.Stderr
+
+// progress reports the progress of a Walk.
+type progress struct {
+	// name is the name of the test running the Walk.
+	name  string
+	start time.Time
+	// done is closed to stop the reporting, and stopped once it stopped.
+	done, stopped chan struct{}
+	once          sync.Once
+
+	mu struct {
+		sync.Mutex
+		// total is the number of test files which are run: the files
+		// filtered out, e.g. by -run, are removed from it.
+		total     int
+		completed int
+		// running describes the directives being run, keyed by test file.
+		running map[string]string
+	}
+}
+
+// activeProgress holds the progress of the Walks being run, keyed by the
+// name of their test, so that the directives run by the subtests of a Walk
+// report to it.
+var activeProgress struct {
+	sync.Mutex
+	m map[string]*progress
+}
+
+// startProgress starts reporting the progress of the Walk run by the given
+// test over total test files at every interval, until all the files are
+// completed or stop is called.
+func startProgress(t *testing.T, total int, interval time.Duration) *progress {
+	p := &progress{
+		name: t.Name(), start: time.Now(), done: make(chan struct{}), stopped: make(chan struct{}),
+	}
+	p.mu.total = total
+	p.mu.running = make(map[string]string)
+	activeProgress.Lock()
+	if activeProgress.m == nil {
+		activeProgress.m = make(map[string]*progress)
+	}
+	activeProgress.m[p.name] = p
+	activeProgress.Unlock()
+	go func() {
+		defer close(p.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.report(progressOutput)
+			case <-p.done:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// stop stops reporting the progress. Nothing is reported once it returns.
+func (p *progress) stop() {
+	p.once.Do(func() {
+		close(p.done)
+		activeProgress.Lock()
+		if activeProgress.m[p.name] == p {
+			delete(activeProgress.m, p.name)
+		}
+		activeProgress.Unlock()
+	})
+	<-p.stopped
+}
+
+// filesDone records the completion of n test files.
+func (p *progress) filesDone(n int) {
+	p.update(n, 0)
+}
+
+// filesSkipped records that n test files are not run, e.g. because they are
+// filtered out by -run.
+func (p *progress) filesSkipped(n int) {
+	p.update(0, n)
+}
+
+// update records the completion of n test files, and that skipped test
+// files are not run. The reporting stops once all the files are completed.
+func (p *progress) update(completed, skipped int) {
+	p.mu.Lock()
+	p.mu.completed += completed
+	p.mu.total -= skipped
+	finished := p.mu.completed >= p.mu.total
+	p.mu.Unlock()
+	if finished {
+		p.stop()
+	}
+}
+
+// report writes the progress to w.
+func (p *progress) report(w io.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	running := make([]string, 0, len(p.mu.running))
+	for _, r := range p.mu.running {
+		running = append(running, r)
+	}
+	sort.Strings(running)
+	fmt.Fprintf(w, "datadriven: %d/%d test files completed after %s",
+		p.mu.completed, p.mu.total, time.Since(p.start).Round(time.Second))
+	if len(running) > 0 {
+		fmt.Fprintf(w, "; running %s", strings.Join(running, ", "))
+	}
+	fmt.Fprintln(w)
+}
+
+// trackProgress records the directive being run by the given test in the
+// progress of the Walk it is part of, if any, and returns a function to call
+// once it completes.
+func trackProgress(t *testing.T, file string, d *TestData) func() {
+	var p *progress
+	activeProgress.Lock()
+	// Use the innermost Walk whose test is an ancestor of t.
+	for name := t.Name(); ; {
+		if p = activeProgress.m[name]; p != nil {
+			break
+		}
+		i := strings.LastIndexByte(name, '/')
+		if i < 0 {
+			break
+		}
+		name = name[:i]
+	}
+	activeProgress.Unlock()
+	if p == nil {
+		return func() {}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.mu.running[file] = fmt.Sprintf("%s (%s)", d.Pos, d.Cmd)
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		delete(p.mu.running, file)
+	}
+}
+
+// countWalkFiles returns the number of test files which Walk runs.
+func countWalkFiles(path string, o *options, ancestors []string) int {
+	finfo, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	if !finfo.IsDir() {
+		return 1
+	}
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		for _, a := range ancestors {
+			if a == real {
+				return 0
+			}
+		}
+		ancestors = append(ancestors[:len(ancestors):len(ancestors)], real)
+	}
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, file := range files {
+		p := filepath.Join(path, file.Name())
+		if !o.walkIncludes(p, file) || strings.HasSuffix(file.Name(), skipSuffix) ||
+			(file.Mode()&os.ModeSymlink != 0 && o.skipSymlinks) {
+			continue
+		}
+		n += countWalkFiles(p, o, ancestors)
+	}
+	return n
+}
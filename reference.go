@@ -0,0 +1,90 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ReferenceFormat is the format of the reference produced by
+// Registry.Reference.
+type ReferenceFormat int
+
+const (
+	// TextReference is plain text, made of the Usage of each command
+	// followed by its examples.
+	TextReference ReferenceFormat = iota
+	// MarkdownReference is Markdown, with a section per command and a
+	// table of its arguments.
+	MarkdownReference
+)
+
+// Reference renders a reference of the registered commands, with their
+// descriptions, arguments and examples, in the given format. This keeps the
+// documentation of the directives of a test suite in sync with the code,
+// e.g. by checking in the reference and comparing it with the output of
+// Reference in a test.
+func (r *Registry) Reference(format ReferenceFormat) string {
+	var buf strings.Builder
+	for i, c := range r.Commands() {
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		if format == MarkdownReference {
+			c.writeMarkdown(&buf)
+			continue
+		}
+		buf.WriteString(c.Usage())
+		for _, ex := range c.Examples {
+			buf.WriteString("\nexample:\n")
+			for _, line := range strings.Split(strings.TrimRight(ex, "\n"), "\n") {
+				buf.WriteString(strings.TrimRight("  "+line, " ") + "\n")
+			}
+		}
+	}
+	return buf.String()
+}
+
+// writeMarkdown writes the Markdown reference of the command.
+func (c *Command) writeMarkdown(buf *strings.Builder) {
+	fmt.Fprintf(buf, "## %s\n\n", c.Name)
+	if c.Help != "" {
+		buf.WriteString(ensureNewline(c.Help) + "\n")
+	}
+	if c.Deprecated != "" {
+		fmt.Fprintf(buf, "**Deprecated:** %s\n\n", c.Deprecated)
+	}
+	usage := []string{c.Name}
+	for _, spec := range c.ArgSpecs {
+		usage = append(usage, spec.usage())
+	}
+	fmt.Fprintf(buf, "Usage: `%s`\n", strings.Join(usage, " "))
+	if len(c.ArgSpecs) > 0 {
+		buf.WriteString("\n| Argument | Type | Required | Description |\n")
+		buf.WriteString("| --- | --- | --- | --- |\n")
+		for _, spec := range c.ArgSpecs {
+			required := "no"
+			if spec.Required {
+				required = "yes"
+			}
+			fmt.Fprintf(buf, "| `%s` | %s | %s | %s |\n",
+				spec.Name, spec.Type, required, strings.Replace(spec.Help, "|", `\|`, -1))
+		}
+	}
+	for _, ex := range c.Examples {
+		fmt.Fprintf(buf, "\nExample:\n\n```\n%s```\n", ensureNewline(ex))
+	}
+}
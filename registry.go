@@ -0,0 +1,226 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var strictDeprecations = flag.Bool(
+	"datadriven-strict-deprecations", false,
+	"fail the directives which use deprecated commands",
+)
+
+// Registry maps the commands of a test suite to their handlers. Its Handler
+// can be passed to RunTest and the other entry points in place of a test
+// function which switches on d.Cmd:
+//
+//   reg := datadriven.NewRegistry()
+//   reg.Register("put", func(t *testing.T, d *datadriven.TestData) string { ... })
+//   reg.Register("get", func(t *testing.T, d *datadriven.TestData) string { ... })
+//   datadriven.RunTest(t, path, reg.Handler())
+//
+// Directives with an unregistered command fail, with a suggestion if the
+// command is close to a registered one.
+type Registry struct {
+	commands map[string]*Command
+}
+
+// Command is a command registered in a Registry.
+type Command struct {
+	// Name is the name of the command, as used in directives.
+	Name string
+	// Handler runs the directives with this command.
+	Handler func(t *testing.T, d *TestData) string
+	// Deprecated is set if the command is deprecated, to a hint about what
+	// to use instead.
+	Deprecated string
+	// ArgSpecs declare the arguments of the command, if set with WithArgs.
+	ArgSpecs []ArgSpec
+	// Help describes the command, for Usage.
+	Help string
+	// Examples are example directives using the command, for Reference.
+	Examples []string
+}
+
+// WithHelp sets the description of the command.
+func (c *Command) WithHelp(help string) *Command {
+	c.Help = help
+	return c
+}
+
+// WithExample adds an example directive using the command, including its
+// input and expected output if any, for Reference.
+func (c *Command) WithExample(directive string) *Command {
+	c.Examples = append(c.Examples, directive)
+	return c
+}
+
+// Deprecate marks the command as deprecated, with a hint about what to use
+// instead, e.g. "use scan instead". The directives using the command log a
+// warning, and RunMain lists them at the end of the run, to help migrate
+// the test files. With -datadriven-strict-deprecations, they fail instead.
+func (c *Command) Deprecate(hint string) *Command {
+	c.Deprecated = hint
+	return c
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{commands: make(map[string]*Command)}
+}
+
+// Register registers the handler of a command, and returns the Command. It
+// panics if the command is already registered.
+func (r *Registry) Register(name string, f func(t *testing.T, d *TestData) string) *Command {
+	if _, ok := r.commands[name]; ok {
+		panic(fmt.Sprintf("command %q registered twice", name))
+	}
+	c := &Command{Name: name, Handler: f}
+	r.commands[name] = c
+	return c
+}
+
+// Lookup returns the command with the given name, if registered.
+func (r *Registry) Lookup(name string) (*Command, bool) {
+	c, ok := r.commands[name]
+	return c, ok
+}
+
+// Commands returns the registered commands, sorted by name.
+func (r *Registry) Commands() []*Command {
+	cmds := make([]*Command, 0, len(r.commands))
+	for _, c := range r.commands {
+		cmds = append(cmds, c)
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Name < cmds[j].Name })
+	return cmds
+}
+
+// Handler returns a test function which runs each directive with the
+// handler of its command.
+func (r *Registry) Handler() func(t *testing.T, d *TestData) string {
+	return func(t *testing.T, d *TestData) string {
+		t.Helper()
+		c, ok := r.commands[d.Cmd]
+		if !ok {
+			d.Fatalf(t, "unknown command %q%s", d.Cmd, r.suggest(d.Cmd))
+		}
+		if c.Deprecated != "" {
+			if *strictDeprecations {
+				d.Fatalf(t, "command %q is deprecated: %s", c.Name, c.Deprecated)
+			}
+			if !isQuiet(d.opts) {
+				t.Logf("%s: warning: command %q is deprecated: %s", d.Pos, c.Name, c.Deprecated)
+			}
+			recordDeprecatedUse(c, d.Pos)
+		}
+		if c.ArgSpecs != nil {
+			c.checkArgs(t, d)
+		}
+		return c.Handler(t, d)
+	}
+}
+
+// suggest returns a suggestion for an unknown command, if a registered
+// command is close to it.
+func (r *Registry) suggest(name string) string {
+	var names []string
+	for _, c := range r.Commands() {
+		names = append(names, c.Name)
+	}
+	return didYouMean(name, names)
+}
+
+// didYouMean returns a suggestion for an unknown name, if one of the
+// candidates is close to it.
+func didYouMean(name string, candidates []string) string {
+	// Allow about one typo every three characters.
+	best, bestDist := "", len(name)/3+2
+	for _, c := range candidates {
+		if d := editDistance(name, c); d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf("; did you mean %q?", best)
+}
+
+// editDistance returns the Levenshtein distance between two strings.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// deprecatedUses collects the positions of the directives which use
+// deprecated commands, keyed by command.
+var deprecatedUses struct {
+	sync.Mutex
+	m map[*Command][]string
+}
+
+// recordDeprecatedUse records the use of a deprecated command.
+func recordDeprecatedUse(c *Command, pos Pos) {
+	deprecatedUses.Lock()
+	defer deprecatedUses.Unlock()
+	if deprecatedUses.m == nil {
+		deprecatedUses.m = make(map[*Command][]string)
+	}
+	deprecatedUses.m[c] = append(deprecatedUses.m[c], pos.String())
+}
+
+// reportDeprecatedUses lists the uses of deprecated commands to w, if any.
+func reportDeprecatedUses(w io.Writer) {
+	deprecatedUses.Lock()
+	defer deprecatedUses.Unlock()
+	cmds := make([]*Command, 0, len(deprecatedUses.m))
+	for c := range deprecatedUses.m {
+		cmds = append(cmds, c)
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Name < cmds[j].Name })
+	for _, c := range cmds {
+		fmt.Fprintf(w, "deprecated command %q (%s) used at:\n  %s\n",
+			c.Name, c.Deprecated, strings.Join(deprecatedUses.m[c], "\n  "))
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var rerunFailed = flag.Bool(
+	"datadriven-rerun-failed", false,
+	"record the directives which fail, and only run the directives which failed in the "+
+		"previous run of each test file with this flag, along with their setup; all the "+
+		"directives are run if none of them failed. See SetupCommands.",
+)
+
+// SetupCommands declares the commands of directives which set up state for
+// the directives following them. When only the directives which failed
+// previously are run (see -datadriven-rerun-failed), the directives with
+// these commands are run as well. The earlier directives of the chain of a
+// failed directive (see Shuffle) are also considered to be its setup.
+func SetupCommands(cmds ...string) Option {
+	return func(o *options) {
+		if o.setupCmds == nil {
+			o.setupCmds = make(map[string]bool)
+		}
+		for _, cmd := range cmds {
+			o.setupCmds[cmd] = true
+		}
+	}
+}
+
+// failureCache records the directives of a test file which failed, so that
+// they can be run again by themselves. The directives are identified by
+// their contents (see directiveKey) rather than by their position, so that
+// the cache remains valid when the test file is edited.
+type failureCache struct {
+	path string
+
+	// previous are the keys of the directives which failed in the previous
+	// run.
+	previous map[string]bool
+	// selected, if set, are the lines of the directives to run.
+	selected map[int]bool
+
+	mu struct {
+		sync.Mutex
+		failed map[string]bool
+	}
+}
+
+// directiveKey identifies a directive by its directive line and a hash of
+// its input.
+func directiveKey(d *TestData) string {
+	sum := sha256.Sum256([]byte(d.Input))
+	return formatCmdLine(d.Cmd, d.CmdArgs) + " " + hex.EncodeToString(sum[:8])
+}
+
+// withFailureCache is an Option which causes failed directives to be
+// recorded in the given cache.
+func withFailureCache(fc *failureCache) Option {
+	return func(o *options) {
+		o.failures = fc
+	}
+}
+
+// loadFailureCache returns the failure cache for the test file at the given
+// path, with the failures of the previous run.
+func loadFailureCache(path string) *failureCache {
+	fc := &failureCache{path: path, previous: make(map[string]bool)}
+	fc.mu.failed = make(map[string]bool)
+	cacheFile, err := failureCacheFile(path)
+	if err != nil {
+		return fc
+	}
+	data, err := ioutil.ReadFile(cacheFile)
+	if err != nil {
+		return fc
+	}
+	for _, key := range strings.Split(string(data), "\n") {
+		if key != "" {
+			fc.previous[key] = true
+		}
+	}
+	return fc
+}
+
+// failureCacheFile returns the path of the file in which the failures of
+// the test file at the given path are recorded.
+func failureCacheFile(path string) (string, error) {
+	return cachePath("failed", path)
+}
+
+// cachePath returns the path of the file in which the given kind of data is
+// recorded across runs for the test file at the given path.
+func cachePath(kind, path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(abs))
+	return filepath.Join(dir, "datadriven", kind, hex.EncodeToString(sum[:])), nil
+}
+
+// record notes that the given directive failed.
+func (fc *failureCache) record(d *TestData) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.mu.failed[directiveKey(d)] = true
+}
+
+// save writes the failures recorded during this run to the cache,
+// replacing those of the previous run.
+func (fc *failureCache) save(t *testing.T) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if len(fc.mu.failed) == 0 && len(fc.previous) == 0 {
+		return
+	}
+	cacheFile, err := failureCacheFile(fc.path)
+	if err != nil {
+		t.Logf("cannot record failed directives: %v", err)
+		return
+	}
+	if len(fc.mu.failed) == 0 {
+		if err := os.Remove(cacheFile); err != nil && !os.IsNotExist(err) {
+			t.Logf("cannot record failed directives: %v", err)
+		}
+		return
+	}
+	keys := make([]string, 0, len(fc.mu.failed))
+	for key := range fc.mu.failed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, key := range keys {
+		fmt.Fprintln(&buf, key)
+	}
+	if err := os.MkdirAll(filepath.Dir(cacheFile), 0755); err != nil {
+		t.Logf("cannot record failed directives: %v", err)
+		return
+	}
+	if err := ioutil.WriteFile(cacheFile, buf.Bytes(), 0644); err != nil {
+		t.Logf("cannot record failed directives: %v", err)
+	}
+}
+
+// selectDirectives returns the lines of the directives to run to re-run the
+// directives which failed previously: the failed directives themselves, the
+// directives running setup commands, and the earlier directives of the
+// chains of the failed directives. It returns nil if none of the directives
+// of the file failed previously.
+func selectDirectives(
+	t *testing.T, sourceName string, input []byte, o options, failed map[string]bool,
+) map[int]bool {
+	t.Helper()
+
+	type directive struct {
+		line   int
+		chain  string
+		setup  bool
+		failed bool
+	}
+	var directives []directive
+	// chainEnd is the line of the last failed directive of each chain.
+	chainEnd := make(map[string]int)
+	anyFailed := false
+	r := newTestDataReader(t, sourceName, bytes.NewReader(input), false, o)
+	for r.Next(t) {
+		if r.data.Cmd == "subtest" {
+			continue
+		}
+		line := r.data.Pos.Line
+		chain, _ := r.data.frameworkArgValue("chain")
+		directives = append(directives, directive{
+			line: line, chain: chain, setup: o.setupCmds[r.data.Cmd], failed: failed[directiveKey(&r.data)],
+		})
+		if directives[len(directives)-1].failed {
+			anyFailed = true
+			if chain != "" {
+				chainEnd[chain] = line
+			}
+		}
+	}
+	if !anyFailed {
+		return nil
+	}
+
+	selected := make(map[int]bool)
+	for _, d := range directives {
+		if d.failed || d.setup || (d.chain != "" && d.line <= chainEnd[d.chain]) {
+			selected[d.line] = true
+		}
+	}
+	return selected
+}
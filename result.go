@@ -0,0 +1,113 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Result is the result of a directive, as returned by the test functions
+// passed to RunTestWithResult and ResultHandler. It is rendered into the
+// actual output of the directive as follows: the Output, followed by the hex
+// dump of the Data, followed by each of the Sections, followed by the Err.
+type Result struct {
+	// Output is the textual output of the directive.
+	Output string
+	// Data is binary output, which is rendered as a hex dump.
+	Data []byte
+	// Sections are named parts of the output.
+	Sections []ResultSection
+	// Err is an error produced by the directive, which is rendered as
+	// "error: <message>".
+	Err error
+	// Artifacts are files produced by the directive, keyed by name, which
+	// are not part of the output. If the directive fails, they are written
+	// to a temporary directory, whose path is logged, to help diagnose the
+	// failure.
+	Artifacts map[string][]byte
+}
+
+// ResultSection is a named part of the output of a directive, rendered as
+// the name followed by a colon on its own line, followed by the output.
+type ResultSection struct {
+	Name   string
+	Output string
+}
+
+// RunTestWithResult is a version of RunTest for test functions which return
+// a Result instead of a string.
+func RunTestWithResult(
+	t *testing.T, path string, f func(t *testing.T, d *TestData) Result, opts ...Option,
+) {
+	t.Helper()
+	RunTest(t, path, ResultHandler(f), opts...)
+}
+
+// ResultHandler adapts a test function returning a Result to the string-based
+// interface of RunTest, RunTestFromString and the like.
+func ResultHandler(
+	f func(t *testing.T, d *TestData) Result,
+) func(t *testing.T, d *TestData) string {
+	return func(t *testing.T, d *TestData) string {
+		t.Helper()
+		res := f(t, d)
+		d.artifacts = res.Artifacts
+		return res.String()
+	}
+}
+
+// String renders the result into the output of a directive.
+func (res Result) String() string {
+	var buf strings.Builder
+	buf.WriteString(ensureNewline(res.Output))
+	if len(res.Data) > 0 {
+		buf.WriteString(hex.Dump(res.Data))
+	}
+	for _, s := range res.Sections {
+		buf.WriteString(s.Name + ":\n")
+		buf.WriteString(ensureNewline(s.Output))
+	}
+	if res.Err != nil {
+		buf.WriteString(ensureNewline("error: " + res.Err.Error()))
+	}
+	return buf.String()
+}
+
+// writeArtifacts writes the artifacts of a failed directive to a temporary
+// directory, and logs its path.
+func writeArtifacts(t *testing.T, d *TestData) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "datadriven-artifacts")
+	if err != nil {
+		t.Logf("%s: cannot write artifacts: %v", d.Pos, err)
+		return
+	}
+	names := make([]string, 0, len(d.artifacts))
+	for name := range d.artifacts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(dir, filepath.Base(name)), d.artifacts[name], 0644); err != nil {
+			t.Logf("%s: cannot write artifact %s: %v", d.Pos, name, err)
+		}
+	}
+	t.Logf("%s: artifacts written to %s: %s", d.Pos, dir, strings.Join(names, ", "))
+}
@@ -0,0 +1,58 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+var rewriteToStdout = flag.Bool(
+	"datadriven-rewrite-stdout", false,
+	"like -rewrite, but write the rewritten test files to stdout instead of modifying them. "+
+		"Each file is written between '=== REWRITE <path>' and '=== END <path>' lines.",
+)
+
+// rewriteStdout is where the rewritten test files are written with
+// -datadriven-rewrite-stdout. The mutex keeps the files written by parallel
+// tests from being interleaved.
+var rewriteStdout = struct {
+	sync.Mutex
+	w io.Writer
+}{w: os.Stdout}
+
+// writeRewriteToStdout writes the rewritten contents of a test file to
+// stdout, delimited so that scripts can extract them:
+//
+//   === REWRITE testdata/foo
+//   <contents>
+//   === END testdata/foo
+func writeRewriteToStdout(path string, data []byte) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "=== REWRITE %s\n", path)
+	buf.Write(data)
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		buf.WriteString("\n")
+	}
+	fmt.Fprintf(&buf, "=== END %s\n", path)
+	rewriteStdout.Lock()
+	defer rewriteStdout.Unlock()
+	_, err := rewriteStdout.w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+var scaffoldPath = flag.String(
+	"datadriven-scaffold", "",
+	"write a skeleton test file for the registered commands to the given path. Requires Registry.GenerateScaffold.",
+)
+
+// Scaffold returns a skeleton test file for the registered commands, to
+// bootstrap a new test suite. It contains a directive for each command
+// which is not deprecated: its first example if it has any, and otherwise
+// a directive with placeholder values for its required arguments, preceded
+// by its usage as a comment. The expected outputs of the latter are empty,
+// to be filled in by running the tests with -rewrite.
+func (r *Registry) Scaffold() string {
+	var buf strings.Builder
+	for _, c := range r.Commands() {
+		if c.Deprecated != "" {
+			continue
+		}
+		if buf.Len() > 0 {
+			buf.WriteString("\n")
+		}
+		if len(c.Examples) > 0 {
+			buf.WriteString(ensureNewline(c.Examples[0]))
+			continue
+		}
+		usage := strings.TrimPrefix(strings.SplitN(c.Usage(), "\n", 2)[0], "usage: ")
+		fmt.Fprintf(&buf, "# %s\n", usage)
+		if c.Help != "" {
+			for _, line := range strings.Split(strings.TrimRight(c.Help, "\n"), "\n") {
+				buf.WriteString(strings.TrimRight("# "+line, " ") + "\n")
+			}
+		}
+		line := []string{c.Name}
+		for _, spec := range c.ArgSpecs {
+			if spec.Required {
+				line = append(line, spec.placeholder())
+			}
+		}
+		buf.WriteString(strings.Join(line, " ") + "\n----\n")
+	}
+	return buf.String()
+}
+
+// placeholder returns the argument with placeholder values.
+func (spec ArgSpec) placeholder() string {
+	var val string
+	switch spec.Type {
+	case IntArg, UintArg, FloatArg:
+		val = "0"
+	case BoolArg:
+		val = "true"
+	case DurationArg:
+		val = "1s"
+	case TimeArg:
+		val = "2020-01-01T00:00:00Z"
+	case ByteSizeArg:
+		val = "1KiB"
+	default:
+		val = "TODO"
+	}
+	switch {
+	case spec.Arity == 0 && spec.Type == BoolArg:
+		return spec.Name
+	case spec.Arity <= 1:
+		return spec.Name + "=" + val
+	default:
+		vals := make([]string, spec.Arity)
+		for i := range vals {
+			vals[i] = val
+		}
+		return fmt.Sprintf("%s=(%s)", spec.Name, strings.Join(vals, ", "))
+	}
+}
+
+// GenerateScaffold writes the Scaffold of the registry to the path given
+// with -datadriven-scaffold, which must not exist; the test is skipped
+// without the flag. It is meant to be run with go generate:
+//
+//   //go:generate go test -run TestScaffold -datadriven-scaffold=testdata/new
+//   func TestScaffold(t *testing.T) {
+//     newRegistry().GenerateScaffold(t)
+//   }
+func (r *Registry) GenerateScaffold(t *testing.T) {
+	t.Helper()
+	if *scaffoldPath == "" {
+		t.Skip("no -datadriven-scaffold path given")
+	}
+	f, err := os.OpenFile(*scaffoldPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(r.Scaffold()); err != nil {
+		_ = f.Close()
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("wrote %s", *scaffoldPath)
+}
@@ -0,0 +1,225 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"math"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+)
+
+// parseInt parses a signed integer, which may be negative, use a base
+// prefix (0x10, 0o17, 0b101), separate digits with underscores (1_000_000),
+// use scientific notation (1e6) if its value is integral, or be a byte size
+// (see parseByteSize). Integers without a base prefix are decimal, even with
+// leading zeros.
+func parseInt(val string, bitSize int) (int64, error) {
+	n, err := strconv.ParseInt(decimalSyntax(val), 0, bitSize)
+	if err == nil {
+		return n, nil
+	}
+	if isRangeError(err) {
+		return 0, errors.Newf("integer %s out of range for %d bits", val, bitSize)
+	}
+	f, ok := parseIntegralFloat(val)
+	if !ok {
+		f, ok = parseByteSize(val)
+	}
+	if ok {
+		if f < -math.Exp2(float64(bitSize-1)) || f >= math.Exp2(float64(bitSize-1)) {
+			return 0, errors.Newf("integer %s out of range for %d bits", val, bitSize)
+		}
+		return int64(f), nil
+	}
+	return 0, errors.Newf("invalid integer: %q", val)
+}
+
+// parseUint is like parseInt, for unsigned integers.
+func parseUint(val string, bitSize int) (uint64, error) {
+	n, err := strconv.ParseUint(decimalSyntax(val), 0, bitSize)
+	if err == nil {
+		return n, nil
+	}
+	if isRangeError(err) {
+		return 0, errors.Newf("unsigned integer %s out of range for %d bits", val, bitSize)
+	}
+	if strings.HasPrefix(val, "-") {
+		return 0, errors.Newf("invalid unsigned integer: %q is negative", val)
+	}
+	f, ok := parseIntegralFloat(val)
+	if !ok {
+		f, ok = parseByteSize(val)
+	}
+	if ok {
+		if f >= math.Exp2(float64(bitSize)) {
+			return 0, errors.Newf("unsigned integer %s out of range for %d bits", val, bitSize)
+		}
+		return uint64(f), nil
+	}
+	return 0, errors.Newf("invalid unsigned integer: %q", val)
+}
+
+// decimalSyntax returns an integer without a base prefix with its leading
+// zeros removed, so that strconv parses it as decimal with base 0 rather
+// than as octal; base 0 is used for the base prefixes and underscores.
+func decimalSyntax(val string) string {
+	sign, digits := "", val
+	if strings.HasPrefix(digits, "-") || strings.HasPrefix(digits, "+") {
+		sign, digits = digits[:1], digits[1:]
+	}
+	if len(digits) > 1 && digits[0] == '0' {
+		switch digits[1] {
+		case 'x', 'X', 'o', 'O', 'b', 'B':
+			return val
+		}
+		digits = strings.TrimLeft(digits, "0")
+		if digits == "" || digits[0] == '_' {
+			digits = "0" + digits
+		}
+	}
+	return sign + digits
+}
+
+// parseFloat parses a floating-point number, which may use scientific
+// notation, separate digits with underscores, or be written as a
+// hexadecimal floating-point literal.
+func parseFloat(val string, bitSize int) (float64, error) {
+	f, err := strconv.ParseFloat(val, bitSize)
+	if err == nil {
+		return f, nil
+	}
+	if isRangeError(err) {
+		return 0, errors.Newf("number %s out of range for float%d", val, bitSize)
+	}
+	return 0, errors.Newf("invalid number: %q", val)
+}
+
+// parseIntegralFloat parses a decimal number in scientific notation, and
+// returns whether it is valid and integral.
+func parseIntegralFloat(val string) (float64, bool) {
+	if !strings.ContainsAny(val, "eE") || strings.HasPrefix(strings.TrimLeft(val, "+-"), "0x") {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil || f != math.Trunc(f) {
+		return 0, false
+	}
+	return f, true
+}
+
+// byteSizeUnits are the units of byte sizes, in lower case.
+var byteSizeUnits = map[string]float64{
+	"b":   1,
+	"kb":  1e3,
+	"mb":  1e6,
+	"gb":  1e9,
+	"tb":  1e12,
+	"pb":  1e15,
+	"eb":  1e18,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+	"pib": 1 << 50,
+	"eib": 1 << 60,
+}
+
+// parseByteSize parses a human-readable byte size, made of a number
+// followed by a decimal (KB, MB, ...) or binary (KiB, MiB, ...) unit, e.g.
+// 64KiB or 1.5GB. Units are case-insensitive. It returns whether the size is
+// valid and is a whole number of bytes.
+func parseByteSize(val string) (float64, bool) {
+	sign := 0
+	if strings.HasPrefix(val, "-") || strings.HasPrefix(val, "+") {
+		sign = 1
+	}
+	i := strings.IndexFunc(val[sign:], func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.' && r != '_'
+	})
+	if i <= 0 {
+		return 0, false
+	}
+	i += sign
+	unit, ok := byteSizeUnits[strings.ToLower(val[i:])]
+	if !ok {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(val[:i], 64)
+	if err != nil {
+		return 0, false
+	}
+	f *= unit
+	if f != math.Trunc(f) {
+		return 0, false
+	}
+	return f, true
+}
+
+// parseBool parses a boolean: true, false, 1, 0, yes or no, in any case. For
+// compatibility with strconv.ParseBool, t and f are also accepted.
+func parseBool(val string) (bool, error) {
+	switch strings.ToLower(val) {
+	case "true", "t", "1", "yes":
+		return true, nil
+	case "false", "f", "0", "no":
+		return false, nil
+	}
+	return false, errors.Newf("invalid boolean: %q (expected true, false, 1, 0, yes or no)", val)
+}
+
+// isRangeError returns whether err is a strconv error for a value out of
+// range.
+func isRangeError(err error) bool {
+	numErr, ok := err.(*strconv.NumError)
+	return ok && numErr.Err == strconv.ErrRange
+}
+
+// extraScanners parse values into destinations of types not handled by
+// scanValue itself. They return false if they do not handle the type of the
+// destination.
+var extraScanners = []func(val string, dest interface{}) (bool, error){
+	scanNetValue,
+}
+
+// scanNetValue parses IP addresses, networks and URLs.
+func scanNetValue(val string, dest interface{}) (bool, error) {
+	switch dest := dest.(type) {
+	case *net.IP:
+		ip := net.ParseIP(val)
+		if ip == nil {
+			return true, errors.Newf("invalid IP address: %q", val)
+		}
+		*dest = ip
+	case *net.IPNet:
+		_, ipNet, err := net.ParseCIDR(val)
+		if err != nil {
+			return true, errors.Newf("invalid CIDR network: %q", val)
+		}
+		*dest = *ipNet
+	case *url.URL:
+		u, err := url.Parse(val)
+		if err != nil || !u.IsAbs() {
+			return true, errors.Newf("invalid absolute URL: %q", val)
+		}
+		*dest = *u
+	default:
+		return false, nil
+	}
+	return true, nil
+}
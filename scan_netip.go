@@ -0,0 +1,55 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build go1.18
+// +build go1.18
+
+package datadriven
+
+import (
+	"net/netip"
+
+	"github.com/cockroachdb/errors"
+)
+
+func init() {
+	extraScanners = append(extraScanners, scanNetipValue)
+}
+
+// scanNetipValue parses the types of the net/netip package.
+func scanNetipValue(val string, dest interface{}) (bool, error) {
+	switch dest := dest.(type) {
+	case *netip.Addr:
+		addr, err := netip.ParseAddr(val)
+		if err != nil {
+			return true, errors.Newf("invalid IP address: %q", val)
+		}
+		*dest = addr
+	case *netip.Prefix:
+		prefix, err := netip.ParsePrefix(val)
+		if err != nil {
+			return true, errors.Newf("invalid IP prefix: %q", val)
+		}
+		*dest = prefix
+	case *netip.AddrPort:
+		addrPort, err := netip.ParseAddrPort(val)
+		if err != nil {
+			return true, errors.Newf("invalid IP address and port: %q", val)
+		}
+		*dest = addrPort
+	default:
+		return false, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,40 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build go1.18
+// +build go1.18
+
+package datadriven
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+)
+
+func TestScanNetip(t *testing.T) {
+	RunTestFromString(t, `
+route addr=::1 prefix=10.0.0.0/8 addrport=[::1]:80
+----
+::1 10.0.0.0/8 [::1]:80
+`, func(t *testing.T, d *TestData) string {
+		var addr netip.Addr
+		var prefix netip.Prefix
+		var addrPort netip.AddrPort
+		d.ScanArgs(t, "addr", &addr)
+		d.ScanArgs(t, "prefix", &prefix)
+		d.ScanArgs(t, "addrport", &addrPort)
+		return fmt.Sprint(addr, " ", prefix, " ", addrPort)
+	})
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"flag"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var shuffleFlag = flag.String(
+	"datadriven-shuffle", "off",
+	"run the directives of test files in random order: off, on, or the seed to use. "+
+		"Directives with the same chain=<name> argument keep their relative order.",
+)
+
+// Shuffle causes the directives of test files to run in a random order
+// determined by the given seed, to flush out hidden dependencies between
+// test cases. The seed is reported if the test fails, so that the order can
+// be reproduced with -datadriven-shuffle=<seed>. Shuffling can also be
+// enabled for all tests with -datadriven-shuffle=on.
+//
+// With FrameworkArgs, directives with the same chain=<name> argument form a
+// chain: they run in the order in which they appear in the file, at the
+// position of the first directive of the chain. All other directives are
+// assumed to be independent of each other, except that the directives of a
+// concurrency group stay together, as do the directives generated by
+// TestData.Enqueue and the directive which generated them. A directive
+// cannot have both the chain and the group arguments.
+//
+// Shuffling is disabled when rewriting, and for files containing subtests.
+func Shuffle(seed int64) Option {
+	return func(o *options) {
+		o.shuffle = true
+		o.shuffleSeed = seed
+	}
+}
+
+// shuffleSeed returns the seed to shuffle directives with, and whether
+// shuffling is enabled at all.
+func shuffleSeed(t *testing.T, o options) (int64, bool) {
+	t.Helper()
+	if o.shuffle {
+		return o.shuffleSeed, true
+	}
+	switch *shuffleFlag {
+	case "off", "":
+		return 0, false
+	case "on":
+		return time.Now().UnixNano(), true
+	}
+	seed, err := strconv.ParseInt(*shuffleFlag, 10, 64)
+	if err != nil {
+		t.Fatalf("invalid value for -datadriven-shuffle: %s", *shuffleFlag)
+	}
+	return seed, true
+}
+
+// shuffledDirective is a directive of a shuffled test file, along with the
+// keep-going state it was read with.
+type shuffledDirective struct {
+	data      TestData
+	keepGoing bool
+}
+
+// shuffle reads all the directives of the input, which Next then returns
+// in a random order determined by the seed, so that they run like those of
+// any other test file. The directives generated by TestData.Enqueue stay
+// after the directive which generated them, and the directives of a
+// concurrency group stay together. It returns false if the input contains
+// subtests, which are not shuffled.
+func (r *testDataReader) shuffle(t *testing.T, seed int64) bool {
+	t.Helper()
+
+	// Group the directives into chains, in the order in which the chains
+	// start.
+	var chains [][]shuffledDirective
+	chainIdx := make(map[string]int)
+	last, lastGroup, lastInGroup := -1, "", false
+	for r.Next(t) {
+		if r.data.Cmd == "subtest" {
+			return false
+		}
+		d := shuffledDirective{data: r.data, keepGoing: r.keepGoing}
+		group, inGroup := r.data.frameworkArgValue(groupArg)
+		chain, inChain := r.data.frameworkArgValue("chain")
+		if inGroup && inChain {
+			r.data.Fatalf(t, "the chain and group arguments cannot be combined")
+		}
+		switch {
+		case isGenerated(&r.data) && last >= 0, inGroup && lastInGroup && group == lastGroup:
+			// Stay after the previous directive.
+			chains[last] = append(chains[last], d)
+		case inChain:
+			i, ok := chainIdx[chain]
+			if !ok {
+				i = len(chains)
+				chainIdx[chain] = i
+				chains = append(chains, nil)
+			}
+			chains[i] = append(chains[i], d)
+			last = i
+		default:
+			chains = append(chains, []shuffledDirective{d})
+			last = len(chains) - 1
+		}
+		lastGroup, lastInGroup = group, inGroup
+	}
+
+	rand.New(rand.NewSource(seed)).Shuffle(len(chains), func(i, j int) {
+		chains[i], chains[j] = chains[j], chains[i]
+	})
+	r.shuffled = []shuffledDirective{}
+	for _, chain := range chains {
+		r.shuffled = append(r.shuffled, chain...)
+	}
+	return true
+}
@@ -0,0 +1,130 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+var staleExitCode = flag.Int(
+	"datadriven-stale-exit-code", 0,
+	"exit code of the test binary if all the failed directives only have a stale expected output. Requires RunMain.",
+)
+
+// failedDirectives counts the directives which failed.
+var failedDirectives struct {
+	sync.Mutex
+	// stale is the number of directives which failed only because their
+	// output differs from the expected output, and other the number of those
+	// which failed otherwise.
+	stale, other int
+	// staleTests and otherTests are the names of the top-level tests in
+	// which these directives ran, or in which test files failed otherwise
+	// for otherTests.
+	staleTests, otherTests map[string]bool
+	// tests are the names of the tests in which directives failed.
+	tests map[string]bool
+	// failedTests are the names of the top-level tests in which test files
+	// failed.
+	failedTests map[string]bool
+}
+
+// initFailedDirectives initializes the maps of failedDirectives.
+func initFailedDirectives() {
+	if failedDirectives.staleTests == nil {
+		failedDirectives.staleTests = make(map[string]bool)
+		failedDirectives.otherTests = make(map[string]bool)
+		failedDirectives.tests = make(map[string]bool)
+		failedDirectives.failedTests = make(map[string]bool)
+	}
+}
+
+// topLevelTest returns the name of the top-level test of the given test.
+func topLevelTest(test string) string {
+	return strings.SplitN(test, "/", 2)[0]
+}
+
+// recordFailedDirective records that a directive failed in the given test.
+func recordFailedDirective(test string, stale bool) {
+	failedDirectives.Lock()
+	defer failedDirectives.Unlock()
+	initFailedDirectives()
+	failedDirectives.tests[test] = true
+	if stale {
+		failedDirectives.stale++
+		failedDirectives.staleTests[topLevelTest(test)] = true
+	} else {
+		failedDirectives.other++
+		failedDirectives.otherTests[topLevelTest(test)] = true
+	}
+}
+
+// recordFailedFile records that a test file failed in the given test. If
+// none of its directives failed, the test file failed otherwise, e.g. with
+// a syntax error.
+func recordFailedFile(test string) {
+	failedDirectives.Lock()
+	defer failedDirectives.Unlock()
+	initFailedDirectives()
+	failedDirectives.failedTests[topLevelTest(test)] = true
+	for name := range failedDirectives.tests {
+		if name == test || strings.HasPrefix(name, test+"/") {
+			return
+		}
+	}
+	failedDirectives.otherTests[topLevelTest(test)] = true
+}
+
+// onlyStaleTests returns whether the top-level tests in which test files
+// failed all failed only because of stale directives.
+func onlyStaleTests() bool {
+	failedDirectives.Lock()
+	defer failedDirectives.Unlock()
+	for test := range failedDirectives.failedTests {
+		if !failedDirectives.staleTests[test] || failedDirectives.otherTests[test] {
+			return false
+		}
+	}
+	return len(failedDirectives.failedTests) > 0
+}
+
+// FailedDirectives returns the number of directives which failed so far
+// only because their output differs from the expected output, which
+// rewriting the test files fixes, and the number of directives which failed
+// otherwise, e.g. with an error reported by the test function. It can be
+// used in TestMain, after the tests ran, to tailor the messages of CI.
+func FailedDirectives() (stale, other int) {
+	failedDirectives.Lock()
+	defer failedDirectives.Unlock()
+	return failedDirectives.stale, failedDirectives.other
+}
+
+// reportStale reports the stale directives to w, if any. It returns true if
+// all the failed directives are stale.
+func reportStale(w io.Writer) bool {
+	stale, other := FailedDirectives()
+	if stale == 0 {
+		return false
+	}
+	fmt.Fprintf(w, "%d directive(s) are stale; run with -rewrite to update their expected output\n", stale)
+	if other > 0 {
+		fmt.Fprintf(w, "%d other directive(s) failed, which -rewrite does not fix\n", other)
+	}
+	return other == 0
+}
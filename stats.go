@@ -0,0 +1,116 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+var statsFlag = flag.Bool(
+	"datadriven-stats", false,
+	"at the end of the run, print the number of directives, failures and the time spent "+
+		"per test file and command. Requires RunMain.",
+)
+
+// commandStats are the statistics of the directives of a test file which
+// use a given command.
+type commandStats struct {
+	directives, failed int
+	elapsed            time.Duration
+}
+
+func (s commandStats) String() string {
+	return fmt.Sprintf("%d directive(s), %d failed, %s",
+		s.directives, s.failed, s.elapsed.Round(time.Millisecond))
+}
+
+func (s *commandStats) add(o commandStats) {
+	s.directives += o.directives
+	s.failed += o.failed
+	s.elapsed += o.elapsed
+}
+
+// directiveStats collects the statistics of the directives run with
+// -datadriven-stats, keyed by test file and command.
+var directiveStats struct {
+	sync.Mutex
+	files map[string]map[string]*commandStats
+}
+
+// recordDirectiveStats records the run of a directive.
+func recordDirectiveStats(file, cmd string, failed bool, elapsed time.Duration) {
+	directiveStats.Lock()
+	defer directiveStats.Unlock()
+	if directiveStats.files == nil {
+		directiveStats.files = make(map[string]map[string]*commandStats)
+	}
+	cmds := directiveStats.files[file]
+	if cmds == nil {
+		cmds = make(map[string]*commandStats)
+		directiveStats.files[file] = cmds
+	}
+	s := cmds[cmd]
+	if s == nil {
+		s = &commandStats{}
+		cmds[cmd] = s
+	}
+	s.directives++
+	if failed {
+		s.failed++
+	}
+	s.elapsed += elapsed
+}
+
+// reportDirectiveStats prints the statistics of the directives to w, for
+// each test file, followed by each command in decreasing order of the time
+// spent running its directives.
+func reportDirectiveStats(w io.Writer) {
+	directiveStats.Lock()
+	defer directiveStats.Unlock()
+	files := make([]string, 0, len(directiveStats.files))
+	for file := range directiveStats.files {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		cmds := directiveStats.files[file]
+		var total commandStats
+		names := make([]string, 0, len(cmds))
+		width := 0
+		for name, s := range cmds {
+			total.add(*s)
+			names = append(names, name)
+			if len(name) > width {
+				width = len(name)
+			}
+		}
+		sort.Slice(names, func(i, j int) bool {
+			a, b := cmds[names[i]], cmds[names[j]]
+			if a.elapsed != b.elapsed {
+				return a.elapsed > b.elapsed
+			}
+			return names[i] < names[j]
+		})
+		fmt.Fprintf(w, "%s: %s\n", file, total)
+		for _, name := range names {
+			fmt.Fprintf(w, "  %-*s %s\n", width, name, cmds[name])
+		}
+	}
+}
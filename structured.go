@@ -0,0 +1,87 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// RunTestStructured is a version of RunTest for test functions which return
+// structured values instead of strings. The expected results of each
+// directive are the JSON encoding of the value; the actual value is compared
+// against the decoded expected results using cmp.Diff (with the options
+// passed via CmpOptions), which produces much more readable differences for
+// nested structures than a textual comparison. When rewriting, the expected
+// results are replaced with the indented JSON encoding of the actual value.
+//
+// If the test function returns a string, it is compared textually, as with
+// RunTest.
+func RunTestStructured(
+	t *testing.T, path string, f func(t *testing.T, d *TestData) interface{}, opts ...Option,
+) {
+	t.Helper()
+	RunTest(t, path, structuredHandler(f), opts...)
+}
+
+// structuredHandler adapts a test function returning structured values to
+// the string-based interface. The value is remembered in the TestData for
+// use by compareOutput.
+func structuredHandler(
+	f func(t *testing.T, d *TestData) interface{},
+) func(t *testing.T, d *TestData) string {
+	return func(t *testing.T, d *TestData) string {
+		t.Helper()
+		v := f(t, d)
+		if s, ok := v.(string); ok {
+			return s
+		}
+		out, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			d.Fatalf(t, "cannot encode result: %v", err)
+		}
+		d.value = v
+		d.hasValue = true
+		return string(out)
+	}
+}
+
+// compareValue compares the structured result of a directive against the
+// given expected results, decoded into a value of the same type.
+func compareValue(d *TestData, exp string) (equal bool, diff string) {
+	if d.value == nil {
+		// A nil value has no type to decode into; it is encoded as null.
+		if strings.TrimSpace(exp) != "null" {
+			return false, "\nexpected results are not null"
+		}
+		return true, ""
+	}
+	expected := reflect.New(reflect.TypeOf(d.value))
+	if err := json.Unmarshal([]byte(exp), expected.Interface()); err != nil {
+		return false, "\nexpected results are not a valid encoding: " + err.Error()
+	}
+	var cmpOpts []cmp.Option
+	if d.opts != nil {
+		cmpOpts = d.opts.cmpOpts
+	}
+	if diff := cmp.Diff(expected.Elem().Interface(), d.value, cmpOpts...); diff != "" {
+		return false, "\ndiff (-expected +found):\n" + diff
+	}
+	return true, ""
+}
@@ -18,7 +18,9 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -28,10 +30,106 @@ type testDataReader struct {
 	scanner    *lineScanner
 	data       TestData
 	rewrite    *bytes.Buffer
+	opts       options
+
+	// configs are the configurations declared by the config directive at
+	// the beginning of the file, if any.
+	configs []string
+	// config is the configuration the file is being run under.
+	config string
+	// matrix collects the results of all configurations when rewriting a
+	// file which declares configurations.
+	matrix *configMatrix
+	// seenDirective is set once the first directive has been read.
+	seenDirective bool
+	// foreach holds the variables of a foreach directive until the
+	// directive it applies to has been read.
+	foreach []foreachVar
+	// macros are the macros defined so far, keyed by name.
+	macros map[string]*macro
+	// src is the contents of the input, if available, from which the raw
+	// text of directives is extracted.
+	src []byte
+	// expectedEnd is the offset of the end of the expected output of the
+	// directive being read.
+	expectedEnd int
+	// cmdLineStart and cmdLineEnd delimit the directive line of the
+	// directive being read in the rewrite buffer, including continuation
+	// lines, so that it can be replaced when its arguments are rewritten.
+	// directiveEnd is the end of its input, so that the whole directive
+	// can be replaced.
+	cmdLineStart, cmdLineEnd, directiveEnd int
+	// pushBack is set if the directive which was read last must be
+	// returned again by Next.
+	pushBack bool
+	// shuffled lists the directives which remain to be returned by Next,
+	// rather than reading the input, once the directives were shuffled.
+	shuffled []shuffledDirective
+	// blankAfterExpected is set if the expected output which was read last
+	// was terminated by a blank line (as opposed to the end of the file),
+	// and blankLine is that line, which is emitted again after the
+	// expected output so as to preserve the blank lines of the file.
+	blankAfterExpected bool
+	blankLine          string
+	// synthesizedBlankEnd is the offset in the rewrite buffer after the
+	// last blank line emitted after an expected output which was not
+	// terminated by a blank line, so that it can be removed if it ends the
+	// file.
+	synthesizedBlankEnd int
+	// cmdLineComment is the trailing comment of the directive line, if
+	// any, which is kept when the directive line is rewritten.
+	cmdLineComment string
+	// keepGoing is set if mismatches don't stop the test file, with the
+	// KeepGoing option or the keep-going directive.
+	keepGoing bool
+	// failures lists the directives which failed, for reportFailures.
+	failures []string
+	// paused lists the directives which called t.Parallel, with
+	// DirectiveSubtests, in the order of the file.
+	paused []pausedDirective
+	// tokens receives the tokens of the lines as they are read, if the
+	// reader is driven by a Lexer. The files are then only tokenized: the
+	// included files are not read, and skipfile does not skip.
+	tokens func(LexToken)
+}
+
+// pausedDirective is a directive which called t.Parallel. It completes with
+// its own reader, whose rewrite buffer is inserted at offset in the rewrite
+// buffer of the file once all the directives have run.
+type pausedDirective struct {
+	offset int
+	r      *testDataReader
+}
+
+// configMatrix records the actual results of each configuration, keyed by
+// the position of the directive, when rewriting a test file that is run
+// under multiple configurations.
+type configMatrix struct {
+	configs []string
+	rewrite bool
+
+	// mu protects results from the directives which call t.Parallel.
+	mu      sync.Mutex
+	results map[string]map[string]string
+}
+
+func (m *configMatrix) record(config, pos, actual string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.results[config] == nil {
+		m.results[config] = make(map[string]string)
+	}
+	m.results[config][pos] = actual
+}
+
+func (m *configMatrix) result(config, pos string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.results[config][pos]
 }
 
 func newTestDataReader(
-	t *testing.T, sourceName string, file io.Reader, record bool,
+	t testing.TB, sourceName string, file io.Reader, record bool, opts options,
 ) *testDataReader {
 	t.Helper()
 
@@ -39,16 +137,35 @@ func newTestDataReader(
 	if record {
 		rewrite = &bytes.Buffer{}
 	}
+	scanner := newLineScanner(file)
+	if opts.firstLine > 0 {
+		scanner.first, scanner.line = opts.firstLine, opts.firstLine-1
+	}
 	return &testDataReader{
 		sourceName: sourceName,
 		reader:     file,
-		scanner:    newLineScanner(file),
+		scanner:    scanner,
 		rewrite:    rewrite,
+		opts:       opts,
+		macros:     make(map[string]*macro),
+		keepGoing:  opts.keepGoing,
 	}
 }
 
-func (r *testDataReader) Next(t *testing.T) bool {
+func (r *testDataReader) Next(t testing.TB) bool {
 	t.Helper()
+	if r.pushBack {
+		r.pushBack = false
+		return true
+	}
+	if r.shuffled != nil {
+		if len(r.shuffled) == 0 {
+			return false
+		}
+		r.data, r.keepGoing = r.shuffled[0].data, r.shuffled[0].keepGoing
+		r.shuffled = r.shuffled[1:]
+		return true
+	}
 
 	for r.scanner.Scan() {
 		// Ensure to not re-initialize r.data unless a line is read
@@ -57,16 +174,32 @@ func (r *testDataReader) Next(t *testing.T) bool {
 		// error messages.
 		r.data = TestData{}
 		line := r.scanner.Text()
+		cmdStart, cmdLine := r.scanner.offset, r.scanner.line
+		// Remember where the directive starts in the rewrite buffer, in
+		// case the directive line needs to be normalized below.
+		mark := r.mark()
 		r.emit(line)
 
 		// Update Pos early so that a late error message has an updated
 		// position.
-		pos := fmt.Sprintf("%s:%d", r.sourceName, r.scanner.line)
+		pos := Pos{File: r.sourceName, Line: r.scanner.line}
 		r.data.Pos = pos
 
+		// segs records where each physical line of the directive line
+		// starts, to compute the positions of the arguments.
+		indent := len(line) - len(strings.TrimLeft(line, " \t"))
+		segs := []lineSegment{{line: r.scanner.line, col: indent + 1}}
 		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "#") {
+		if strings.HasPrefix(line, r.opts.commentPrefix+"|") && !r.opts.legacyParsing {
+			// Skip block comments, which may span multiple lines and are
+			// used to disable entire directives.
+			r.token(TokenComment, r.scanner.line, indent+1, line)
+			r.skipBlockComment(t, line)
+			continue
+		}
+		if strings.HasPrefix(line, r.opts.commentPrefix) {
 			// Skip comment lines.
+			r.token(TokenComment, r.scanner.line, indent+1, line)
 			continue
 		}
 
@@ -76,93 +209,355 @@ func (r *testDataReader) Next(t *testing.T) bool {
 		for strings.HasSuffix(line, `\`) && r.scanner.Scan() {
 			nextLine := r.scanner.Text()
 			r.emit(nextLine)
-			line = strings.TrimSuffix(line, `\`) + " " + strings.TrimSpace(nextLine)
+			line = strings.TrimSuffix(line, `\`) + " "
+			indent := len(nextLine) - len(strings.TrimLeft(nextLine, " \t"))
+			segs = append(segs, lineSegment{start: len(line), line: r.scanner.line, col: indent + 1})
+			line += strings.TrimSpace(nextLine)
 		}
+		cmdEnd := r.scanner.end
+		logical := line
+		line, r.cmdLineComment = splitTrailingComment(line, r.opts.commentPrefix)
 
-		cmd, args, err := ParseLine(line)
+		p, err := ParseLineDetailed(line)
 		if err != nil {
 			t.Fatalf("%s: %v", pos, err)
 		}
+		cmd, args := p.Cmd.Text, p.CmdArgs()
 		if cmd == "" {
 			// Nothing to do here.
 			continue
 		}
+		r.lexDirective(segs, logical, p)
+		if r.opts.caseInsensitiveCmds {
+			if lower := strings.ToLower(cmd); lower != cmd {
+				r.rewriteSince(mark, func(s string) string {
+					return strings.Replace(s, cmd, lower, 1)
+				})
+				cmd = lower
+			}
+		}
+		builtin := builtinDirective(cmd, &r.opts)
+
+		if builtin == "config" {
+			if r.seenDirective {
+				r.data.Fatalf(t, "config must be the first directive in the file")
+			}
+			r.seenDirective = true
+			for _, arg := range args {
+				if arg.Key == alternativeHeader {
+					r.data.Fatalf(t, "%q cannot be used as a configuration name", arg.Key)
+				}
+				r.configs = append(r.configs, arg.Key)
+			}
+			if len(r.configs) == 0 {
+				r.data.Fatalf(t, "config requires at least one configuration")
+			}
+			continue
+		}
+		if builtin == keepGoingCmd {
+			r.setKeepGoing(t, args)
+			continue
+		}
+		if builtin == "skipfile" {
+			if r.seenDirective {
+				r.data.Fatalf(t, "skipfile must be the first directive in the file")
+			}
+			// The reason is the remainder of the directive line; the
+			// directive has no input, so that the following directive
+			// cannot be mistaken for its reason.
+			reason := strings.TrimSpace(line[len(cmd):])
+			if reason == "" {
+				reason = "no reason given"
+			}
+			if r.tokens != nil {
+				continue
+			}
+			t.Skipf("%s: skipping file: %s", r.data.Pos, reason)
+		}
+		r.seenDirective = true
+
+		if builtin == "foreach" {
+			// The foreach directive applies to the following directive.
+			if r.foreach != nil {
+				r.data.Fatalf(t, "foreach must be followed by a directive")
+			}
+			r.foreach = parseForeachVars(t, &r.data, args)
+			continue
+		}
 
+		r.data.Config = r.config
+		r.data.file = r.sourceName
+		r.data.opts = &r.opts
+		r.data.Rewrite = r.rewrite != nil || (r.matrix != nil && r.matrix.rewrite)
 		r.data.Cmd = cmd
 		r.data.CmdArgs = args
+		r.data.line = line
+		r.data.argPos = argPositions(r.sourceName, line, segs, nil)
+		r.data.foreach, r.foreach = r.foreach, nil
+
+		r.data.Raw.CmdLine = r.section(cmdLine, cmdStart, cmdEnd)
+		r.cmdLineStart, r.cmdLineEnd = mark, r.mark()
 
 		if cmd == "subtest" {
+			if r.data.foreach != nil {
+				r.data.Fatalf(t, "foreach cannot be applied to subtest")
+			}
 			// Subtest directives do not have an input and expected output.
 			return true
 		}
+		if builtin == "include" {
+			// Include directives do not have an input and expected output.
+			if r.tokens == nil {
+				r.include(t, args)
+			}
+			continue
+		}
 
 		var buf bytes.Buffer
 		var separator bool
+		// argLines is set while indented lines following the directive
+		// line are interpreted as additional arguments.
+		argLines := r.opts.indentedArgs
+		inputLine, inputStart, inputEnd := r.scanner.line+1, cmdEnd, cmdEnd
 		for r.scanner.Scan() {
 			line := r.scanner.Text()
-			if line == "----" {
+			if line == r.opts.separator {
+				r.lineToken(TokenSeparator, line)
 				separator = true
 				break
 			}
+			inputEnd = r.scanner.end
+
+			if argLines {
+				if trimmed := strings.TrimSpace(line); trimmed != "" &&
+					(line[0] == ' ' || line[0] == '\t') {
+					r.emit(line)
+					const prefix = "args "
+					p, err := ParseLineDetailed(prefix + trimmed)
+					if err != nil {
+						t.Fatalf("%s:%d: %v", r.sourceName, r.scanner.line, err)
+					}
+					r.data.CmdArgs = append(r.data.CmdArgs, p.CmdArgs()...)
+					r.data.line += " " + trimmed
+					indent := len(line) - len(strings.TrimLeft(line, " \t"))
+					r.lexArgs([]lineSegment{{start: len(prefix), line: r.scanner.line, col: indent + 1}}, p)
+					r.data.argPos = argPositions(r.sourceName, "_ "+trimmed,
+						[]lineSegment{{start: 2, line: r.scanner.line, col: indent + 1}}, r.data.argPos)
+					r.data.Raw.CmdLine = r.section(cmdLine, cmdStart, r.scanner.end)
+					r.cmdLineEnd = r.mark()
+					inputLine, inputStart = r.scanner.line+1, r.scanner.end
+					continue
+				}
+				argLines = false
+			}
 
+			r.lineToken(TokenInput, line)
+			line, err := r.opts.normalizeIndent(line)
+			if err != nil {
+				t.Fatalf("%s:%d: %v", r.sourceName, r.scanner.line, err)
+			}
 			r.emit(line)
+			if r.data.inputLine == 0 && strings.TrimSpace(line) != "" {
+				r.data.inputLine = r.scanner.line
+			}
 			fmt.Fprintln(&buf, line)
 		}
 
 		r.data.Input = strings.TrimSpace(buf.String())
+		r.directiveEnd = r.mark()
+		r.data.Raw.Input = r.section(inputLine, inputStart, inputEnd)
 
+		r.data.wrap = r.wrapWidth(t)
 		if separator {
+			expectedLine, expectedStart := r.scanner.line+1, r.scanner.end
+			r.expectedEnd = expectedStart
 			r.readExpected(t)
+			r.data.Raw.Expected = r.section(expectedLine, expectedStart, r.expectedEnd)
 		}
+
+		if builtin == "macro" {
+			// Macro definitions are handled by the framework. They do not
+			// produce any output.
+			r.defineMacro(t)
+			r.emitExpected("")
+			continue
+		}
+		if fn := r.opts.migrateArgs; fn != nil {
+			args := fn(cmd, append(CmdArgs(nil), r.data.CmdArgs...))
+			if formatCmdLine(cmd, args) != formatCmdLine(cmd, r.data.CmdArgs) {
+				r.data.RewriteCmdArgs(args)
+			}
+		}
+		r.data.macro = r.macros[cmd]
 		return true
 	}
+	if r.foreach != nil {
+		r.data.Fatalf(t, "foreach must be followed by a directive")
+	}
 	return false
 }
 
-func (r *testDataReader) readExpected(t *testing.T) {
+// finishRewrite post-processes the rewritten input.
+func (r *testDataReader) finishRewrite(data []byte) []byte {
+	// Remove the blank line emitted after the last expected output, unless
+	// it was in the input.
+	if l := len(data); l == r.synthesizedBlankEnd && l > 2 && data[l-1] == '\n' && data[l-2] == '\n' {
+		data = data[:l-1]
+	}
+	if r.scanner.crlf {
+		// Preserve the line ending convention of the input.
+		data = bytes.Replace(data, []byte("\n"), []byte("\r\n"), -1)
+	}
+	if r.scanner.bom {
+		data = append([]byte(utf8BOM), data...)
+	}
+	return data
+}
+
+// section returns the section of the input starting at the given line and
+// spanning the given byte offsets.
+func (r *testDataReader) section(line, start, end int) Section {
+	if end < start {
+		end = start
+	}
+	sec := Section{Line: line, Offset: start, EndOffset: end}
+	if end <= len(r.src) {
+		sec.Text = string(r.src[start:end])
+	}
+	return sec
+}
+
+// skipBlockComment consumes the lines of a block comment, starting with
+// the given (already emitted) opening line, up to and including the line
+// that ends with "|#" (or with the CommentPrefix in place of #).
+func (r *testDataReader) skipBlockComment(t testing.TB, line string) {
+	t.Helper()
+	start := r.data.Pos
+	// The opening #| does not count towards the closing |#.
+	line = strings.TrimPrefix(line, r.opts.commentPrefix+"|")
+	for !strings.HasSuffix(line, "|"+r.opts.commentPrefix) {
+		if !r.scanner.Scan() {
+			t.Fatalf("%s: unterminated block comment", start)
+		}
+		line = r.scanner.Text()
+		r.emit(line)
+		r.lineToken(TokenComment, line)
+		line = strings.TrimSpace(line)
+	}
+}
+
+// readConfigs reads up to the first directive of the file and returns the
+// configurations it declares, if any, and whether the file contains any
+// directive at all.
+func (r *testDataReader) readConfigs(t *testing.T) (configs []string, hasDirectives bool) {
+	t.Helper()
+	hasDirectives = r.Next(t)
+	return r.configs, hasDirectives
+}
+
+// readExpected reads the expected output of a directive, including the
+// per-configuration and alternative expected output blocks, if any.
+func (r *testDataReader) readExpected(t testing.TB) {
+	expected, header := r.readExpectedBlock(t)
+	r.data.Expected = expected
+	// selected is set while reading the blocks which apply to the current
+	// configuration.
+	selected := true
+	for header != "" {
+		if header == alternativeHeader {
+			expected, header = r.readExpectedBlock(t)
+			if selected {
+				r.data.alternatives = append(r.data.alternatives, expected)
+			}
+			continue
+		}
+		config := header
+		expected, header = r.readExpectedBlock(t)
+		if selected = config == r.config; selected {
+			r.data.Expected, r.data.alternatives = expected, nil
+		}
+	}
+}
+
+// readExpectedBlock reads a single expected output block. If the block is
+// terminated by the header of another block, i.e. a per-configuration header
+// or an alternative header, the header is returned.
+func (r *testDataReader) readExpectedBlock(t testing.TB) (expected, nextConfig string) {
 	var buf bytes.Buffer
 	var line string
 	var allowBlankLines bool
+	r.blankAfterExpected, r.blankLine = false, ""
 
-	if r.scanner.Scan() {
+	// scanned is set if line was read from the input.
+	scanned := r.scanner.Scan()
+	if scanned {
 		line = r.scanner.Text()
-		if line == "----" {
+		if line == r.opts.separator {
+			r.lineToken(TokenSeparator, line)
 			allowBlankLines = true
+			r.expectedEnd = r.scanner.end
 		}
 	}
 
 	if allowBlankLines {
-		// Look for two successive lines of "----" before terminating.
+		// Look for two successive separator lines before terminating.
 		for r.scanner.Scan() {
 			line = r.scanner.Text()
+			r.expectedEnd = r.scanner.end
 
-			if line == "----" {
+			if line == r.opts.separator {
 				if r.scanner.Scan() {
 					line2 := r.scanner.Text()
-					if line2 == "----" {
+					r.expectedEnd = r.scanner.end
+					if line2 == r.opts.separator {
+						r.token(TokenSeparator, r.scanner.line-1, 1, line)
+						r.lineToken(TokenSeparator, line2)
 						// Read the following blank line (if we don't do this, we will emit
 						// an extra blank line when rewriting).
-						if r.scanner.Scan() && r.scanner.Text() != "" {
-							t.Fatal("non-blank line after end of double ---- separator section")
+						if r.scanner.Scan() {
+							if config, ok := r.configHeader(r.scanner.Text()); ok {
+								r.lineToken(TokenSeparator, r.scanner.Text())
+								nextConfig = config
+								r.expectedEnd = r.scanner.end
+							} else if r.scanner.Text() != "" {
+								t.Fatalf("%s:%d: non-blank line after end of double %s separator section",
+									r.sourceName, r.scanner.line, r.opts.separator)
+							} else {
+								r.blankAfterExpected = true
+							}
 						}
 						break
 					}
 
+					r.token(TokenExpected, r.scanner.line-1, 1, line)
+					r.lineToken(TokenExpected, line2)
 					fmt.Fprintln(&buf, line)
 					fmt.Fprintln(&buf, line2)
 					continue
 				}
 			}
 
+			r.lineToken(TokenExpected, line)
 			fmt.Fprintln(&buf, line)
 		}
 	} else {
 		// Terminate on first blank line.
 		for {
 			if strings.TrimSpace(line) == "" {
+				r.blankAfterExpected, r.blankLine = scanned, line
+				if r.opts.legacyParsing {
+					r.blankLine = ""
+				}
+				break
+			}
+			r.expectedEnd = r.scanner.end
+			if config, ok := r.configHeader(line); ok {
+				r.lineToken(TokenSeparator, line)
+				nextConfig = config
 				break
 			}
 
+			r.lineToken(TokenExpected, line)
 			fmt.Fprintln(&buf, line)
 
 			if !r.scanner.Scan() {
@@ -173,7 +568,128 @@ func (r *testDataReader) readExpected(t *testing.T) {
 		}
 	}
 
-	r.data.Expected = buf.String()
+	expected, err := r.opts.normalizeIndentText(buf.String())
+	if err != nil {
+		r.data.Fatalf(t, "expected output: %v", err)
+	}
+	if r.opts.markTrailingWS {
+		expected = decodeTrailingWhitespace(expected)
+	}
+	if r.data.wrap > 0 {
+		expected = unwrapOutput(expected)
+	}
+	return expected, nextConfig
+}
+
+// alternativeHeader is returned by configHeader for the header which
+// introduces an alternative expected output block:
+//
+//   plan
+//   SELECT * FROM t WHERE x = 1
+//   ----
+//   index scan
+//   ---- or
+//   full scan
+//
+// The directive passes if its output matches any of the blocks.
+const alternativeHeader = "or"
+
+// configHeader returns the configuration name if the line is a header
+// introducing a per-configuration expected output block, or
+// alternativeHeader if it introduces an alternative expected output block.
+func (r *testDataReader) configHeader(line string) (string, bool) {
+	if !strings.HasPrefix(line, r.opts.separator+" ") {
+		return "", false
+	}
+	name := strings.TrimSpace(line[len(r.opts.separator):])
+	if name == alternativeHeader && !r.opts.legacyParsing {
+		return name, true
+	}
+	for _, config := range r.configs {
+		if config == name {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// token reports a token to the Lexer which drives the reader, if any.
+func (r *testDataReader) token(kind TokenKind, line, col int, text string) {
+	if r.tokens != nil {
+		r.tokens(LexToken{Kind: kind, Line: line, Token: newToken(text, col-1)})
+	}
+}
+
+// lineToken reports a token spanning the line which was read last.
+func (r *testDataReader) lineToken(kind TokenKind, line string) {
+	r.token(kind, r.scanner.line, 1, line)
+}
+
+// lexDirective reports the tokens of a directive line, which spans the
+// given segments of the file, in order. logical is the directive line,
+// including its trailing comment, if any, which p does not include.
+func (r *testDataReader) lexDirective(segs []lineSegment, logical string, p ParsedLine) {
+	if r.tokens == nil {
+		return
+	}
+	var toks []LexToken
+	// The backslash which continues a line precedes the start of the next
+	// segment, minus the space that replaces it.
+	for _, seg := range segs[1:] {
+		toks = append(toks, segmentToken(segs, TokenContinuation, `\`, seg.start-1))
+	}
+	toks = append(toks, segmentToken(segs, TokenCmd, p.Cmd.Text, p.Cmd.Start-1))
+	toks = append(toks, argTokens(segs, p)...)
+	if r.cmdLineComment != "" {
+		toks = append(toks, segmentToken(segs, TokenComment, r.cmdLineComment, len(logical)-len(r.cmdLineComment)))
+	}
+	sort.SliceStable(toks, func(i, j int) bool {
+		if toks[i].Line != toks[j].Line {
+			return toks[i].Line < toks[j].Line
+		}
+		return toks[i].Start < toks[j].Start
+	})
+	for _, tok := range toks {
+		r.tokens(tok)
+	}
+}
+
+// lexArgs reports the tokens of a line of additional arguments, with
+// IndentedArgs.
+func (r *testDataReader) lexArgs(segs []lineSegment, p ParsedLine) {
+	if r.tokens == nil {
+		return
+	}
+	for _, tok := range argTokens(segs, p) {
+		r.tokens(tok)
+	}
+}
+
+// argTokens returns the tokens of the arguments of a parsed line, which
+// spans the given segments of the file.
+func argTokens(segs []lineSegment, p ParsedLine) []LexToken {
+	var toks []LexToken
+	for _, a := range p.Args {
+		toks = append(toks, segmentToken(segs, TokenArgKey, a.Key.Text, a.Key.Start-1))
+		for _, v := range a.Vals {
+			if v.Text != "" {
+				toks = append(toks, segmentToken(segs, TokenArgValue, v.Text, v.Start-1))
+			}
+		}
+	}
+	return toks
+}
+
+// segmentToken returns the token at the given offset in a line which spans
+// the given segments of the file.
+func segmentToken(segs []lineSegment, kind TokenKind, text string, offset int) LexToken {
+	seg := segs[0]
+	for _, s := range segs[1:] {
+		if s.start <= offset {
+			seg = s
+		}
+	}
+	return LexToken{Kind: kind, Line: seg.line, Token: newToken(text, seg.col-1+offset-seg.start)}
 }
 
 func (r *testDataReader) emit(s string) {
@@ -182,3 +698,286 @@ func (r *testDataReader) emit(s string) {
 		r.rewrite.WriteString("\n")
 	}
 }
+
+// emitExpected emits the separator and the given expected output, which
+// must be empty or end in a newline, followed by the alternative expected
+// outputs, if any. The double separator syntax is used if the output
+// contains blank lines.
+func (r *testDataReader) emitExpected(output string, alternatives ...string) {
+	if r.rewrite == nil {
+		return
+	}
+	r.emit(r.opts.separator)
+	r.emitExpectedBlock(output)
+	for _, alt := range alternatives {
+		r.emit(r.opts.separator + " " + alternativeHeader)
+		r.emitExpectedBlock(alt)
+	}
+	r.emitBlankAfterExpected()
+}
+
+// oldExpectedHeader introduces the comment which keeps the previous
+// expected output with KeepOldExpected.
+const oldExpectedHeader = "previous expected output, remove after review:"
+
+// emitExpectedKeepingOld is like emitExpected, but also emits the previous
+// expected output as a comment beneath the new one.
+func (r *testDataReader) emitExpectedKeepingOld(output, old string) {
+	if r.rewrite == nil {
+		return
+	}
+	r.emit(r.opts.separator)
+	r.emitExpectedBlock(output)
+	r.emit("")
+	r.emit(r.opts.commentPrefix + " " + oldExpectedHeader)
+	for _, line := range strings.Split(strings.TrimSuffix(old, "\n"), "\n") {
+		r.emit(strings.TrimRight(r.opts.commentPrefix+" "+line, " "))
+	}
+	r.emitBlankAfterExpected()
+}
+
+// detachRewrite moves the part of the rewrite buffer which belongs to the
+// directive being read to a buffer of its own in dr, a copy of r, so that
+// the directive can complete after the following directives were read.
+func (r *testDataReader) detachRewrite(dr *testDataReader) {
+	if r.rewrite == nil {
+		return
+	}
+	start := r.cmdLineStart
+	dr.rewrite = bytes.NewBuffer(append([]byte(nil), r.rewrite.Bytes()[start:]...))
+	dr.cmdLineStart -= start
+	dr.cmdLineEnd -= start
+	dr.directiveEnd -= start
+	dr.synthesizedBlankEnd = -1
+	r.rewrite.Truncate(start)
+}
+
+// attachRewrite takes over the state of dr, the reader of a directive which
+// completed, appending its rewrite buffer to that of r.
+func (r *testDataReader) attachRewrite(dr *testDataReader) {
+	buf, blankEnd := r.rewrite, r.synthesizedBlankEnd
+	*r = *dr
+	if buf == nil {
+		return
+	}
+	start := buf.Len()
+	buf.Write(dr.rewrite.Bytes())
+	r.rewrite = buf
+	r.cmdLineStart += start
+	r.cmdLineEnd += start
+	r.directiveEnd += start
+	r.synthesizedBlankEnd = blankEnd
+	if dr.synthesizedBlankEnd >= 0 {
+		r.synthesizedBlankEnd = start + dr.synthesizedBlankEnd
+	}
+}
+
+// finishPaused collects the failures of the paused directives, once they
+// completed, and inserts their rewrite buffers in the rewrite buffer.
+func (r *testDataReader) finishPaused() {
+	paused := r.paused
+	r.paused = nil
+	for _, p := range paused {
+		r.failures = append(r.failures, p.r.failures...)
+	}
+	if r.rewrite == nil || len(paused) == 0 {
+		return
+	}
+	data := r.rewrite.Bytes()
+	var buf bytes.Buffer
+	prev := 0
+	for _, p := range paused {
+		buf.Write(data[prev:p.offset])
+		buf.Write(p.r.rewrite.Bytes())
+		prev = p.offset
+	}
+	buf.Write(data[prev:])
+	// Only the blank line which ends the file matters to finishRewrite.
+	blankEnd := -1
+	if last := paused[len(paused)-1]; last.offset == len(data) && last.r.rewrite.Len() > 0 {
+		if last.r.synthesizedBlankEnd == last.r.rewrite.Len() {
+			blankEnd = buf.Len()
+		}
+	} else if r.synthesizedBlankEnd == len(data) {
+		blankEnd = buf.Len()
+	}
+	r.rewrite, r.synthesizedBlankEnd = &buf, blankEnd
+}
+
+// emitBlankAfterExpected emits the blank line which follows an expected
+// output, as found in the input.
+func (r *testDataReader) emitBlankAfterExpected() {
+	r.emit(r.blankLine)
+	if !r.blankAfterExpected {
+		r.synthesizedBlankEnd = r.mark()
+	}
+}
+
+// emitConfigExpected emits the separator and the expected output recorded
+// for each configuration for the directive at the given position. The
+// results of the first configuration are used as the default; the results
+// of other configurations are only emitted if they differ.
+func (r *testDataReader) emitConfigExpected(pos string) {
+	if r.rewrite == nil {
+		return
+	}
+	r.emit(r.opts.separator)
+	defaultOutput := r.matrix.result(r.matrix.configs[0], pos)
+	r.emitExpectedBlock(defaultOutput)
+	for _, config := range r.matrix.configs[1:] {
+		if output := r.matrix.result(config, pos); output != defaultOutput {
+			r.emit(r.opts.separator + " " + config)
+			r.emitExpectedBlock(output)
+		}
+	}
+	r.emitBlankAfterExpected()
+}
+
+// emitExpectedBlock emits a single expected output block, not including
+// the separator that precedes it.
+func (r *testDataReader) emitExpectedBlock(output string) {
+	if r.data.wrap > 0 {
+		output = wrapOutput(output, r.data.wrap)
+	}
+	if r.opts.markTrailingWS {
+		output = encodeTrailingWhitespace(output)
+	}
+	if hasBlankLine(output) {
+		r.emit(r.opts.separator)
+		r.rewrite.WriteString(output)
+		r.emit(r.opts.separator)
+		r.emit(r.opts.separator)
+	} else {
+		r.rewrite.WriteString(output)
+	}
+}
+
+// mark returns the current position in the rewrite buffer, for use with
+// rewriteSince.
+func (r *testDataReader) mark() int {
+	if r.rewrite == nil {
+		return 0
+	}
+	return r.rewrite.Len()
+}
+
+// rewriteSince replaces the text emitted since the given mark with the
+// result of fn.
+func (r *testDataReader) rewriteSince(mark int, fn func(string) string) {
+	if r.rewrite == nil {
+		return
+	}
+	s := fn(string(r.rewrite.Bytes()[mark:]))
+	r.rewrite.Truncate(mark)
+	r.rewrite.WriteString(s)
+}
+
+// rewriteCmdLine replaces the directive line of the directive being read
+// in the rewrite buffer, if its arguments were rewritten.
+func (r *testDataReader) rewriteCmdLine(d *TestData) {
+	if r.rewrite == nil || !d.cmdArgsRewritten {
+		return
+	}
+	d.cmdArgsRewritten = false
+	end := r.replaceRewrite(r.cmdLineStart, r.cmdLineEnd, r.withComment(formatCmdLine(d.Cmd, d.CmdArgs))+"\n")
+	r.directiveEnd += end - r.cmdLineEnd
+	r.cmdLineEnd = end
+}
+
+// replaceDirective replaces the directive line and input of the directive
+// being read in the rewrite buffer.
+func (r *testDataReader) replaceDirective(cmd string, args CmdArgs, input string) {
+	if r.rewrite == nil {
+		return
+	}
+	line := r.withComment(formatCmdLine(cmd, args)) + "\n"
+	text := line
+	if input != "" {
+		text += input + "\n"
+	}
+	r.directiveEnd = r.replaceRewrite(r.cmdLineStart, r.directiveEnd, text)
+	r.cmdLineEnd = r.cmdLineStart + len(line)
+}
+
+// replaceRewrite replaces the text between the given offsets of the
+// rewrite buffer, and returns the new end offset.
+func (r *testDataReader) replaceRewrite(start, end int, s string) int {
+	rest := append([]byte(nil), r.rewrite.Bytes()[end:]...)
+	r.rewrite.Truncate(start)
+	r.rewrite.WriteString(s)
+	end = r.mark()
+	r.rewrite.Write(rest)
+	return end
+}
+
+// withComment appends the trailing comment of the directive line being
+// read, if any, to a rewritten directive line.
+func (r *testDataReader) withComment(line string) string {
+	if r.cmdLineComment == "" {
+		return line
+	}
+	return line + " " + r.cmdLineComment
+}
+
+// splitTrailingComment splits a directive line into the directive and its
+// trailing comment, if any, e.g.:
+//
+//   build a=1  # comment
+//
+// A trailing comment starts with the comment prefix preceded by white
+// space, outside of parenthesized values, and followed by white space or
+// the end of the line, so that e.g. a --flag argument is not mistaken for a
+// comment with CommentPrefix("--").
+func splitTrailingComment(line, prefix string) (directive, comment string) {
+	depth := 0
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case (c == ' ' || c == '\t') && depth == 0 && strings.HasPrefix(line[i+1:], prefix):
+			rest := line[i+1+len(prefix):]
+			if rest == "" || rest[0] == ' ' || rest[0] == '\t' {
+				return strings.TrimRight(line[:i], " \t"), line[i+1:]
+			}
+		}
+	}
+	return line, ""
+}
+
+// formatCmdLine formats a directive line.
+func formatCmdLine(cmd string, args CmdArgs) string {
+	parts := []string{cmd}
+	for _, arg := range args {
+		parts = append(parts, arg.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// trailingWhitespaceMarker is appended to expected output lines that end
+// in whitespace, when MarkTrailingWhitespace is used.
+const trailingWhitespaceMarker = "¶"
+
+// encodeTrailingWhitespace appends the marker to every line that ends in
+// whitespace or in the marker itself, so that the encoding is reversible.
+func encodeTrailingWhitespace(s string) string {
+	lines := strings.Split(s, "\n")
+	for i, l := range lines {
+		if strings.HasSuffix(l, " ") || strings.HasSuffix(l, "\t") ||
+			strings.HasSuffix(l, trailingWhitespaceMarker) {
+			lines[i] = l + trailingWhitespaceMarker
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// decodeTrailingWhitespace removes one marker from the end of each line
+// that has one.
+func decodeTrailingWhitespace(s string) string {
+	lines := strings.Split(s, "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimSuffix(l, trailingWhitespaceMarker)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,200 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+var watchFlag = flag.Bool(
+	"datadriven-watch", false,
+	"after running the test files passed to Walk, watch them for changes and run the files "+
+		"which change again, until interrupted. Use with -timeout=0.",
+)
+
+// watchInterval is how often watched files are checked for changes.
+const watchInterval = 500 * time.Millisecond
+
+// dependencies records the files which the test files depend on besides
+// themselves, e.g. the files they include and the files argument values
+// are loaded from (see ArgsFromFiles), keyed by absolute path.
+var dependencies struct {
+	sync.Mutex
+	m map[string]map[string]bool
+}
+
+// recordDependency records that the test file at the given path depends on
+// the file at dep.
+func recordDependency(path, dep string) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+	absDep, err := filepath.Abs(dep)
+	if err != nil {
+		return
+	}
+	dependencies.Lock()
+	defer dependencies.Unlock()
+	if dependencies.m == nil {
+		dependencies.m = make(map[string]map[string]bool)
+	}
+	if dependencies.m[abs] == nil {
+		dependencies.m[abs] = make(map[string]bool)
+	}
+	dependencies.m[abs][absDep] = true
+}
+
+// dependsOn returns whether the file at the given absolute path is one of
+// the given files, or depends on one of them, directly or not.
+func dependsOn(path string, files map[string]bool) bool {
+	dependencies.Lock()
+	defer dependencies.Unlock()
+	seen := make(map[string]bool)
+	var visit func(path string) bool
+	visit = func(path string) bool {
+		if files[path] {
+			return true
+		}
+		if seen[path] {
+			return false
+		}
+		seen[path] = true
+		for dep := range dependencies.m[path] {
+			if visit(dep) {
+				return true
+			}
+		}
+		return false
+	}
+	return visit(path)
+}
+
+// watch polls the files under path for changes, and calls f in a subtest for
+// every file which is created or modified, until stop is closed. The files
+// they depend on (see recordDependency) are watched as well, and a change
+// to one of them causes f to be called for the files which depend on it.
+// Changes made by f itself (e.g. when rewriting) do not cause f to be
+// called again.
+func watch(
+	t *testing.T,
+	path string,
+	f func(t *testing.T, path string),
+	o *options,
+	interval time.Duration,
+	stop <-chan struct{},
+) {
+	t.Logf("watching %s for changes", path)
+	_, mtimes := watchedModTimes(t, path, o)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		files, cur := watchedModTimes(t, path, o)
+		changed := make(map[string]bool)
+		for file, mtime := range cur {
+			if old, ok := mtimes[file]; !ok || !old.Equal(mtime) {
+				changed[file] = true
+			}
+		}
+		mtimes = cur
+		if len(changed) == 0 {
+			continue
+		}
+
+		var affected []string
+		for _, file := range files {
+			if abs, err := filepath.Abs(file); err == nil && dependsOn(abs, changed) {
+				affected = append(affected, file)
+			}
+		}
+		sort.Strings(affected)
+		for _, file := range affected {
+			name, err := filepath.Rel(path, file)
+			if err != nil || name == "." {
+				name = filepath.Base(file)
+			}
+			file := file
+			t.Run(filepath.ToSlash(name), func(t *testing.T) {
+				o.walkHandler(f, file)(t, file)
+			})
+		}
+		// Ignore the changes made while running the files.
+		_, mtimes = watchedModTimes(t, path, o)
+	}
+}
+
+// watchedModTimes returns the files that Walk would visit under path, with
+// the given options, along with the modification times of these files and
+// of the files they depend on, keyed by absolute path.
+func watchedModTimes(t *testing.T, path string, o *options) ([]string, map[string]time.Time) {
+	var files []string
+	mtimes := make(map[string]time.Time)
+	for file, mtime := range scanModTimes(t, path, o) {
+		files = append(files, file)
+		if abs, err := filepath.Abs(file); err == nil {
+			mtimes[abs] = mtime
+		}
+	}
+	dependencies.Lock()
+	defer dependencies.Unlock()
+	for _, deps := range dependencies.m {
+		for dep := range deps {
+			if _, ok := mtimes[dep]; ok {
+				continue
+			}
+			if info, err := os.Stat(dep); err == nil {
+				mtimes[dep] = info.ModTime()
+			}
+		}
+	}
+	return files, mtimes
+}
+
+// scanModTimes returns the modification times of the files that Walk would
+// visit under path, with the given options.
+func scanModTimes(t *testing.T, path string, o *options) map[string]time.Time {
+	mtimes := make(map[string]time.Time)
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if file != path && !o.walkIncludes(file, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() {
+			mtimes[file] = info.ModTime()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Logf("watching %s: %v", path, err)
+	}
+	return mtimes
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"strings"
+	"testing"
+)
+
+// wrapArg is the argument which sets the width at which the output of a
+// directive is wrapped, overriding the WrapOutput option:
+//
+//   explain wrap=80
+//   SELECT ...
+//   ----
+//   <long lines wrapped at 80 columns>
+//
+// wrap=0 disables the wrapping.
+const wrapArg = "wrap"
+
+// wrapContinuation ends the lines of the expected output which continue on
+// the next line.
+const wrapContinuation = `\`
+
+// wrapWidth returns the width at which the output of the directive being
+// read is wrapped, or 0 if it is not.
+func (r *testDataReader) wrapWidth(t testing.TB) int {
+	t.Helper()
+	width := r.opts.wrapWidth
+	if val, ok := r.data.frameworkArgValue(wrapArg); ok {
+		n, err := parseInt(val, 0)
+		if err != nil {
+			r.data.Fatalf(t, "invalid %s width: %v", wrapArg, err)
+		}
+		width = int(n)
+	}
+	if width < 0 || width == 1 {
+		r.data.Fatalf(t, "invalid %s width: %d", wrapArg, width)
+	}
+	return width
+}
+
+// wrapOutput wraps the lines of s which are longer than width characters,
+// by splitting them into lines ending with a backslash. A line which ends
+// with a backslash in s is followed by an empty continuation, so that
+// unwrapOutput restores s exactly.
+func wrapOutput(s string, width int) string {
+	lines := strings.Split(s, "\n")
+	var buf strings.Builder
+	for i, l := range lines {
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		runes := []rune(l)
+		for len(runes) > width {
+			buf.WriteString(string(runes[:width-1]) + wrapContinuation + "\n")
+			runes = runes[width-1:]
+		}
+		buf.WriteString(string(runes))
+		if strings.HasSuffix(l, wrapContinuation) {
+			buf.WriteString(wrapContinuation + "\n")
+		}
+	}
+	return buf.String()
+}
+
+// unwrapOutput joins the lines of s which end with a backslash with the
+// following line, undoing wrapOutput.
+func unwrapOutput(s string) string {
+	lines := strings.Split(s, "\n")
+	res := lines[:0]
+	for i := 0; i < len(lines); i++ {
+		l := lines[i]
+		for strings.HasSuffix(lines[i], wrapContinuation) && i+1 < len(lines) {
+			i++
+			l = strings.TrimSuffix(l, wrapContinuation) + lines[i]
+		}
+		res = append(res, l)
+	}
+	return strings.Join(res, "\n")
+}